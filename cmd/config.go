@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/engine"
+)
+
+// configCmd runs the config subcommands, only check for now.
+func configCmd(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "usage: uproxy config check [-conf file] [-lenient]")
+		return 2
+	}
+	return configCheck(args[1:])
+}
+
+// configCheck validates and compiles the config, printing every problem
+// found.
+func configCheck(args []string) int {
+	fs := flag.NewFlagSet("uproxy config check", flag.ContinueOnError)
+	conf, err := config.FromCmdline(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := engine.CheckConfig(conf); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%v: ok\n", conf.File)
+	return 0
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/engine"
+)
+
+const conntrackUsage = "usage: uproxy conntrack list|flush|watch [-admin address] [-proto p] [-src addr] [-dst addr] [-sport n] [-dport n] [-dev name]"
+
+// conntrackCmd runs the conntrack subcommands, which list, flush or watch
+// the flows tracked by a running instance through its admin api.
+func conntrackCmd(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, conntrackUsage)
+		return 2
+	}
+	fs := flag.NewFlagSet("uproxy conntrack "+args[0], flag.ContinueOnError)
+	admin := fs.String("admin", "127.0.0.1:9990", "Address of the admin api of the instance")
+	query := url.Values{}
+	for _, name := range []string{"proto", "src", "dst", "sport", "dport", "dev"} {
+		name := name
+		fs.Func(name, "Only flows with this "+name, func(value string) error {
+			query.Set(name, value)
+			return nil
+		})
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	target := &url.URL{Scheme: "http", Host: *admin, Path: "/conntrack", RawQuery: query.Encode()}
+
+	var err error
+	switch args[0] {
+	case "list":
+		err = conntrackList(target.String())
+	case "flush":
+		err = conntrackFlush(target.String())
+	case "watch":
+		target.Path = "/conntrack/events"
+		err = conntrackWatch(target.String())
+	default:
+		fmt.Fprintln(os.Stderr, conntrackUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// adminRequest sends the request to the admin api, failing on responses
+// other than 200.
+func adminRequest(client *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach admin api - err: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("admin api returned %v: %v", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func conntrackList(target string) error {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := adminRequest(&http.Client{Timeout: 10 * time.Second}, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var entries []engine.ConnEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return fmt.Errorf("invalid admin api response - err: %w", err)
+	}
+	for _, entry := range entries {
+		fmt.Println(formatConn(entry))
+	}
+	fmt.Fprintf(os.Stderr, "%v flows\n", len(entries))
+	return nil
+}
+
+func conntrackFlush(target string) error {
+	req, err := http.NewRequest(http.MethodDelete, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := adminRequest(&http.Client{Timeout: 10 * time.Second}, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Flushed int `json:"flushed"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("invalid admin api response - err: %w", err)
+	}
+	fmt.Printf("%v flows flushed\n", result.Flushed)
+	return nil
+}
+
+// conntrackWatch prints the events of the flows until interrupted.
+func conntrackWatch(target string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := adminRequest(http.DefaultClient, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev engine.ConnEvent
+		if err := dec.Decode(&ev); err != nil {
+			if ctx.Err() != nil || err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("event stream failed - err: %w", err)
+		}
+		fmt.Printf("%-9v %v\n", "["+ev.Type+"]", formatConn(ev.Flow))
+	}
+}
+
+// formatConn prints a flow on a line, in the manner of conntrack -L.
+func formatConn(c engine.ConnEntry) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-6v %v -> %v %v", c.Proto, c.Src, c.Dst, c.State)
+	if c.TCPState != "" {
+		fmt.Fprintf(&b, " %v", c.TCPState)
+	}
+	fmt.Fprintf(&b, " dev=%v->%v", c.InDev, c.OutDev)
+	if c.Endpoint != "" {
+		fmt.Fprintf(&b, " endpoint=%v", c.Endpoint)
+	}
+	fmt.Fprintf(&b, " packets=%v/%v bytes=%v/%v age=%v idle=%v", c.Packets, c.ReplyPackets, c.Bytes, c.ReplyBytes,
+		c.Age.Round(time.Second), c.Idle.Round(time.Second))
+	if c.Synced {
+		b.WriteString(" synced")
+	}
+	return b.String()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/engine"
+)
+
+// trace runs the trace subcommand, printing how the policies of the config
+// handle the packet given on the command line.
+func trace(args []string) int {
+	fs := flag.NewFlagSet("uproxy trace", flag.ContinueOnError)
+	src := fs.String("src", "", "Source address")
+	dst := fs.String("dst", "", "Destination address")
+	proto := fs.String("proto", "udp", "Protocol: tcp, udp, icmp, icmpv6 or a number")
+	sport := fs.Uint("sport", 0, "Source port")
+	dport := fs.Uint("dport", 0, "Destination port")
+	icmp := fs.String("icmp", "", "ICMP type and optional code, like 3/4")
+
+	conf, err := config.FromCmdline(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	spec, err := engine.ParseTraceSpec(*src, *dst, *proto, *sport, *dport, *icmp)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	result, err := engine.Trace(conf, spec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	result.Write(os.Stdout)
+	return 0
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"os"
 
 	"github.com/mazdakn/uproxy/pkg/config"
@@ -13,8 +14,19 @@ const (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "trace":
+			os.Exit(trace(os.Args[2:]))
+		case "config":
+			os.Exit(configCmd(os.Args[2:]))
+		case "conntrack":
+			os.Exit(conntrackCmd(os.Args[2:]))
+		}
+	}
+
 	logrus.Infof("Running uProxy %v", version)
-	conf, err := config.FromCmdline()
+	conf, err := config.FromCmdline(flag.CommandLine, os.Args[1:])
 	if err != nil {
 		logrus.WithError(err).Errorf("Failed to parse config file")
 		os.Exit(1)
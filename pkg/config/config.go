@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"reflect"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
@@ -15,27 +17,208 @@ const (
 	defautMaxBufferSize int    = 1600
 	defaultTunName      string = "uproxy"
 	defaultMTU          int    = 1400
+	defaultQueues       int    = 1
 )
 
 type TunConfig struct {
 	Name    string `yaml:"name"`
 	Address string `yaml:"address"`
 	MTU     int    `yaml:"mtu"`
+	Queues  int    `yaml:"queues"`
+	Offload bool   `yaml:"offload"`
 }
 
+// DefaultPolicyName names the policy made of the default action.
+const DefaultPolicyName = "default"
+
+// Device types understood by the device registry.
+const (
+	DeviceUDP   string = "udp"
+	DeviceTun   string = "tun"
+	DeviceDrop  string = "drop"
+	DeviceProxy string = "proxy"
+)
+
+// Device declares a device of the given type. Only the fields relevant to
+// the type are used: Address and BatchSize for udp, Tun for tun.
+type Device struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+
+	Address   string     `yaml:"address"`
+	BatchSize int        `yaml:"batchSize"`
+	Tun       *TunConfig `yaml:"tun"`
+}
+
+// Set is a named list of networks given inline, read from a file with one
+// network per line, or both.
+type Set struct {
+	Name  string   `yaml:"name"`
+	CIDRs []string `yaml:"cidrs"`
+	File  string   `yaml:"file"`
+}
+
+// Policy matches packets on addresses and, optionally, on a protocol. Ports
+// take the form proto:list, like tcp:80,443,8000-8100. ICMP matches take a
+// type with an optional code, like 3/4, and need proto icmp or icmpv6. Sets
+// are referenced by name, negated with a leading !. Conntrack states are a
+// list of new, established and invalid, like new,established.
 type Policy struct {
+	// Optional name, used in logs, counters and traces.
+	Name string `yaml:"name"`
+	// Policies are matched by ascending priority, then in file order.
+	Priority int `yaml:"priority"`
+
 	SrcAddr string `yaml:"srcAddr"`
 	DstAddr string `yaml:"dstAddr"`
+	SrcSet  string `yaml:"srcSet"`
+	DstSet  string `yaml:"dstSet"`
+	SrcPort string `yaml:"srcPort"`
 	DstPort string `yaml:"dstPort"`
+	Proto   string `yaml:"proto"`
+	ICMP    string `yaml:"icmp"`
+	CTState string `yaml:"ctstate"`
 
 	Action string `yaml:"action"`
+	// Endpoints taking over when every endpoint of a route action is down,
+	// in the same format as the route.
+	Backup string `yaml:"backup"`
+	// Name of the device packets are sent to. It can be left empty when a
+	// single device of the type the action needs is declared.
+	Device string `yaml:"device"`
+	// Packets over the limit are sent to the drop device.
+	RateLimit RateLimit `yaml:"ratelimit"`
+	// Stateful policies track the flows they match, so replies are sent
+	// back the way the flow came without going through the policies.
+	Stateful bool `yaml:"stateful"`
+}
+
+// String lists the fields set in the policy by their yaml names.
+func (p Policy) String() string {
+	var fields []string
+	v := reflect.ValueOf(p)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() {
+			continue
+		}
+		name := v.Type().Field(i).Tag.Get("yaml")
+		fields = append(fields, fmt.Sprintf("%v=%+v", name, v.Field(i).Interface()))
+	}
+	return "{" + strings.Join(fields, " ") + "}"
+}
+
+// RateLimit allows Rate packets per second with bursts of up to Burst
+// packets, one second worth of packets by default. The limit applies to all
+// packets together or, with PerSource, to each source address, keeping at
+// most MaxSources addresses, 65536 by default.
+type RateLimit struct {
+	Rate       float64 `yaml:"rate"`
+	Burst      int     `yaml:"burst"`
+	PerSource  bool    `yaml:"perSource"`
+	MaxSources int     `yaml:"maxSources"`
+}
+
+// HealthCheck enables probing route endpoints every interval, like 1s. An
+// endpoint is down after Failures probes in a row went unanswered.
+type HealthCheck struct {
+	Interval string `yaml:"interval"`
+	Failures int    `yaml:"failures"`
+}
+
+// Conntrack sets the idle timeouts of tracked flows per protocol, tcp, udp,
+// icmp, icmpv6 or other, like 30s. At most MaxEntries flows are tracked, the
+// least recently active ones being evicted, and idle flows are removed every
+// SweepInterval.
+type Conntrack struct {
+	Timeouts      map[string]string `yaml:"timeouts"`
+	MaxEntries    int               `yaml:"maxEntries"`
+	SweepInterval string            `yaml:"sweepInterval"`
+	Sync          *ConntrackSync    `yaml:"sync"`
+}
+
+// Conntrack sync protocols.
+const (
+	SyncUDP = "udp"
+	SyncTCP = "tcp"
+)
+
+// MinSyncKeyLen is the minimum length of conntrack sync keys, in bytes.
+const MinSyncKeyLen = 16
+
+// ConntrackSync streams the changes of tracked flows to a Peer over udp or
+// tcp, udp by default, and receives those of the peer on Listen, so either
+// instance of a pair holds a copy of the flows of the other and can take
+// them over. Every flow is sent again over each Interval, 10s by default,
+// spread across it, which refreshes the copy and makes up for lost changes.
+//
+// Changes are only accepted from the address Allow, the host of Peer by
+// default, which must be set to listen without a peer. As source addresses
+// can be spoofed, changes must also be authenticated with Key, a secret of
+// at least MinSyncKeyLen bytes both instances share. The sync link is not
+// encrypted, so anyone on its path sees the flows, and can replay changes
+// they saw, which at worst brings back flows the peer had.
+type ConntrackSync struct {
+	Protocol string `yaml:"protocol"`
+	Listen   string `yaml:"listen"`
+	Peer     string `yaml:"peer"`
+	Allow    string `yaml:"allow"`
+	Interval string `yaml:"interval"`
+	Key      string `yaml:"key"`
 }
 
 type Config struct {
-	MaxBufferSize int        `yaml:"maxBufferSize"`
-	Address       string     `yaml:"address"`
-	Tun           *TunConfig `yaml:"tun"`
-	Policies      []Policy   `yaml:"policies"`
+	MaxBufferSize int      `yaml:"maxBufferSize"`
+	Devices       []Device `yaml:"devices"`
+	Sets          []Set    `yaml:"sets"`
+	Policies      []Policy `yaml:"policies"`
+	// Action taken on packets matching no policy, drop by default.
+	DefaultAction string       `yaml:"defaultAction"`
+	HealthCheck   *HealthCheck `yaml:"healthCheck"`
+	Conntrack     *Conntrack   `yaml:"conntrack"`
+	// Address of the admin http server, disabled when empty.
+	Admin string `yaml:"admin"`
+
+	// Legacy single udp server and tun device, used when no devices are
+	// declared.
+	Address   string     `yaml:"address"`
+	BatchSize int        `yaml:"batchSize"`
+	Tun       *TunConfig `yaml:"tun"`
+
+	// Path of the file the config was loaded from.
+	File string `yaml:"-"`
+	// Lenient configs are used despite validation errors, invalid policies
+	// being skipped.
+	Lenient bool `yaml:"-"`
+
+	// Document node of the file, locating validation errors.
+	node *yaml.Node
+}
+
+// DeviceConfigs returns the declared devices or, if none are, the ones
+// derived from the legacy address and tun fields plus a proxy device. A drop
+// device is added when none is declared.
+func (c *Config) DeviceConfigs() []Device {
+	devices := c.Devices
+	if len(devices) == 0 {
+		if c.Address != "" {
+			devices = append(devices, Device{
+				Name:      DeviceUDP,
+				Type:      DeviceUDP,
+				Address:   c.Address,
+				BatchSize: c.BatchSize,
+			})
+		}
+		if c.Tun != nil {
+			devices = append(devices, Device{Name: DeviceTun, Type: DeviceTun, Tun: c.Tun})
+		}
+		devices = append(devices, Device{Name: DeviceProxy, Type: DeviceProxy})
+	}
+	for _, dev := range devices {
+		if dev.Type == DeviceDrop {
+			return devices
+		}
+	}
+	return append(devices[:len(devices):len(devices)], Device{Name: DeviceDrop, Type: DeviceDrop})
 }
 
 func ApplyDefaults(config *Config) {
@@ -45,29 +228,81 @@ func ApplyDefaults(config *Config) {
 	if config.Address == "" {
 		config.Address = defaultAddress
 	}
-	if config.Tun.Name == "" {
-		config.Tun.Name = defaultTunName
+	applyTunDefaults(config.Tun)
+	for _, dev := range config.Devices {
+		applyTunDefaults(dev.Tun)
 	}
-	if config.Tun.MTU == 0 {
-		config.Tun.MTU = defaultMTU
+}
+
+func applyTunDefaults(tun *TunConfig) {
+	if tun == nil {
+		return
+	}
+	if tun.Name == "" {
+		tun.Name = defaultTunName
+	}
+	if tun.MTU == 0 {
+		tun.MTU = defaultMTU
+	}
+	if tun.Queues == 0 {
+		tun.Queues = defaultQueues
 	}
 }
 
-func FromCmdline() (*Config, error) {
-	filename := flag.String("conf", defaultFile, "Default config file")
-	flag.Parse()
+// FromCmdline adds the -conf and -lenient flags to the flag set, parses the
+// arguments and loads the config file. Subcommands pass flag sets with flags
+// of their own. Configs failing validation are rejected unless lenient.
+func FromCmdline(fs *flag.FlagSet, args []string) (*Config, error) {
+	filename := fs.String("conf", defaultFile, "Default config file")
+	lenient := fs.Bool("lenient", false, "Start despite config errors, skipping invalid policies")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
 
-	configFile, err := os.ReadFile(*filename)
+	config, err := FromFile(*filename)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file %v - err: %w", configFile, err)
+		return nil, err
 	}
+	config.Lenient = *lenient
+	if err := config.Check(); err != nil {
+		return nil, err
+	}
+	logrus.Debugf("Parsed config from command line: %v", config)
+	return config, nil
+}
 
-	var config Config
-	err = yaml.Unmarshal(configFile, &config)
+// Check validates the config, only logging the errors when it is lenient,
+// and applies the defaults.
+func (c *Config) Check() error {
+	if err := c.Validate(); err != nil {
+		if !c.Lenient {
+			return err
+		}
+		logrus.Warnf("Ignoring config errors as lenient is set:\n%v", err)
+	}
+	ApplyDefaults(c)
+	return nil
+}
+
+func FromFile(filename string) (*Config, error) {
+	configFile, err := os.ReadFile(filename)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to parse the config file %v - err: %w", configFile, err)
+		return nil, fmt.Errorf("failed to read config file %v - err: %w", filename, err)
 	}
 
-	logrus.Debugf("Parsed config from command line: %v", config)
+	var node yaml.Node
+	err = yaml.Unmarshal(configFile, &node)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the config file %v - err: %w", filename, err)
+	}
+	var config Config
+	if len(node.Content) > 0 {
+		err = node.Decode(&config)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse the config file %v - err: %w", filename, err)
+		}
+	}
+	config.File = filename
+	config.node = &node
 	return &config, nil
 }
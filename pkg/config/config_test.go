@@ -1,6 +1,9 @@
 package config
 
 import (
+	"flag"
+	"os"
+	"path/filepath"
 	"testing"
 
 	. "github.com/onsi/gomega"
@@ -10,18 +13,113 @@ func TestDefaults(t *testing.T) {
 	RegisterTestingT(t)
 	defaultConfig := Config{}
 	ApplyDefaults(&defaultConfig)
-	Expect(defaultConfig).To(Equal(&Config{
+	Expect(defaultConfig).To(Equal(Config{
 		MaxBufferSize: defautMaxBufferSize,
+		Address:       defaultAddress,
 	}))
+
+	withTun := Config{Devices: []Device{{Name: "local", Type: DeviceTun, Tun: &TunConfig{}}}}
+	ApplyDefaults(&withTun)
+	Expect(*withTun.Devices[0].Tun).To(Equal(TunConfig{Name: defaultTunName, MTU: defaultMTU, Queues: defaultQueues}))
 }
 
 func TestDefaultCmdLine(t *testing.T) {
 	RegisterTestingT(t)
-	cliConfig, err := FromCmdline()
-	if err != nil {
-		t.Fail()
-	}
-	defaultConfig := Config{}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	Expect(os.WriteFile(path, []byte("tun:\n  address: 10.0.0.1/24\n"), 0o600)).To(Succeed())
+	cliConfig, err := FromCmdline(flag.NewFlagSet("uproxy", flag.ContinueOnError), []string{"-conf", path})
+	Expect(err).NotTo(HaveOccurred())
+
+	defaultConfig := Config{Tun: &TunConfig{Address: "10.0.0.1/24"}}
 	ApplyDefaults(&defaultConfig)
-	Expect(cliConfig).To(Equal(defaultConfig))
+	Expect(cliConfig.MaxBufferSize).To(Equal(defaultConfig.MaxBufferSize))
+	Expect(cliConfig.Address).To(Equal(defaultConfig.Address))
+	Expect(cliConfig.Tun).To(Equal(defaultConfig.Tun))
+	Expect(cliConfig.File).To(Equal(path))
+}
+
+func TestValidate(t *testing.T) {
+	RegisterTestingT(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	Expect(os.WriteFile(path, []byte(`maxBufferSize: 1000
+devices:
+  - name: tunnel
+    type: udp
+    address: 0.0.0.0:9999
+  - name: local
+    type: tun
+    tun:
+      mtu: 1400
+      queus: 2
+policies:
+  - dstAddr: 10.0.0.0/33
+    action: drop
+  - dstAddr: 0.0.0.0/0
+    dstPort: tcp:80-70
+    action: forward
+    device: missing
+`), 0o600)).To(Succeed())
+	conf, err := FromFile(path)
+	Expect(err).NotTo(HaveOccurred())
+
+	err = conf.Validate()
+	Expect(err).To(HaveOccurred())
+	errs := err.(ValidationErrors)
+	located := make([]string, len(errs))
+	for i, e := range errs {
+		located[i] = e.Error()
+	}
+	Expect(located).To(Equal([]string{
+		path + ":9:12: devices[1].tun.mtu: mtu 1400 does not fit in maxBufferSize 1000",
+		path + ":10:7: devices[1].tun.queus: unknown field \"queus\"",
+		path + ":12:14: policies[0].dstAddr: invalid cidr \"10.0.0.0/33\"",
+		path + ":15:14: policies[1].dstPort: invalid port \"tcp:80-70\": invalid port range \"80-70\"",
+		path + ":16:13: policies[1].action: unknown action \"forward\"",
+		path + ":17:13: policies[1].device: device \"missing\" does not exist",
+	}))
+
+	// Lenient configs get their errors logged only.
+	_, err = FromCmdline(flag.NewFlagSet("uproxy", flag.ContinueOnError), []string{"-conf", path})
+	Expect(err).To(HaveOccurred())
+	conf, err = FromCmdline(flag.NewFlagSet("uproxy", flag.ContinueOnError), []string{"-conf", path, "-lenient"})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(conf.Lenient).To(BeTrue())
+
+	// Policy names are unique, default being reserved for the default action.
+	err = (&Config{DefaultAction: "forward", Policies: []Policy{
+		{Name: "default", DstAddr: "10.0.0.0/8", Action: "drop"},
+		{Name: "a", DstAddr: "10.0.0.0/8", Action: "drop"},
+		{Name: "a", DstAddr: "10.0.0.0/8", Action: "drop"},
+	}}).Validate()
+	Expect(err).To(MatchError(ContainSubstring("defaultAction: unknown action \"forward\"")))
+	Expect(err).To(MatchError(ContainSubstring("policies[0].name: duplicate policy name \"default\"")))
+	Expect(err).To(MatchError(ContainSubstring("policies[2].name: duplicate policy name \"a\"")))
+
+	err = (&Config{Policies: []Policy{{CTState: "new,closing", Action: "drop"}}}).Validate()
+	Expect(err).To(MatchError("policies[0].ctstate: invalid conntrack state \"closing\""))
+	Expect((&Config{Policies: []Policy{{CTState: "established, invalid", Action: "drop"}}}).Validate()).To(Succeed())
+
+	err = (&Config{Conntrack: &Conntrack{MaxEntries: -1, SweepInterval: "soon"}}).Validate()
+	Expect(err).To(MatchError(ContainSubstring("conntrack.maxEntries: invalid number of entries -1")))
+	Expect(err).To(MatchError(ContainSubstring("conntrack.sweepInterval: invalid interval \"soon\"")))
+	err = (&Config{Conntrack: &Conntrack{Sync: &ConntrackSync{Protocol: "sctp", Peer: "peer", Interval: "0s"}}}).Validate()
+	Expect(err).To(MatchError(ContainSubstring("conntrack.sync.protocol: unknown protocol \"sctp\"")))
+	Expect(err).To(MatchError(ContainSubstring("conntrack.sync.peer: invalid address \"peer\"")))
+	Expect(err).To(MatchError(ContainSubstring("conntrack.sync.interval: invalid interval \"0s\"")))
+	Expect(err).To(MatchError(ContainSubstring("conntrack.sync.key: a key of at least 16 bytes is required")))
+	key := "0123456789abcdef"
+	err = (&Config{Conntrack: &Conntrack{Sync: &ConntrackSync{Key: key}}}).Validate()
+	Expect(err).To(MatchError("conntrack.sync: either listen or peer is required"))
+	err = (&Config{Conntrack: &Conntrack{Sync: &ConntrackSync{Listen: ":9991", Key: key}}}).Validate()
+	Expect(err).To(MatchError("conntrack.sync.allow: an address is required to listen without a peer"))
+	err = (&Config{Conntrack: &Conntrack{Sync: &ConntrackSync{Listen: ":9991", Allow: "peer", Key: key}}}).Validate()
+	Expect(err).To(MatchError("conntrack.sync.allow: invalid address \"peer\""))
+	err = (&Config{Conntrack: &Conntrack{Sync: &ConntrackSync{Listen: ":9991", Allow: "10.0.0.2", Key: key[1:]}}}).Validate()
+	Expect(err).To(MatchError("conntrack.sync.key: a key of at least 16 bytes is required"))
+	Expect((&Config{Conntrack: &Conntrack{Sync: &ConntrackSync{Protocol: "tcp", Listen: ":9991", Peer: "10.0.0.2:9991", Key: key}}}).Validate()).To(Succeed())
+	Expect((&Config{Conntrack: &Conntrack{Sync: &ConntrackSync{Listen: ":9991", Allow: "10.0.0.2", Key: key}}}).Validate()).To(Succeed())
+
+	// Configs built in code have no location.
+	err = (&Config{Policies: []Policy{{DstAddr: "x", Action: "drop"}}}).Validate()
+	Expect(err).To(MatchError("policies[0].dstAddr: invalid cidr \"x\""))
 }
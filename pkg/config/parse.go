@@ -0,0 +1,170 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Parsers of the values of policy fields, shared by validation and the
+// engine compiling policies.
+
+// ParseProto accepts a protocol name or number, empty meaning any.
+func ParseProto(proto string) (byte, error) {
+	switch strings.ToLower(proto) {
+	case "":
+		return 0, nil
+	case "tcp":
+		return unix.IPPROTO_TCP, nil
+	case "udp":
+		return unix.IPPROTO_UDP, nil
+	case "icmp":
+		return unix.IPPROTO_ICMP, nil
+	case "icmpv6", "icmp6":
+		return unix.IPPROTO_ICMPV6, nil
+	}
+	n, err := strconv.ParseUint(proto, 10, 8)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid protocol %q", proto)
+	}
+	return byte(n), nil
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Lo, Hi uint16
+}
+
+// ParsePorts parses ports of the form tcp:80,443,8000-8100, empty meaning
+// any protocol and port.
+func ParsePorts(port string) (byte, []PortRange, error) {
+	if port == "" {
+		return 0, nil, nil
+	}
+	name, list, found := strings.Cut(port, ":")
+	if !found {
+		return 0, nil, fmt.Errorf("port must be prefixed with tcp: or udp:")
+	}
+	var proto byte
+	switch name {
+	case "tcp":
+		proto = unix.IPPROTO_TCP
+	case "udp":
+		proto = unix.IPPROTO_UDP
+	default:
+		return 0, nil, fmt.Errorf("ports are not supported for protocol %q", name)
+	}
+
+	var ranges []PortRange
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		loStr, hiStr, isRange := strings.Cut(item, "-")
+		lo, err := strToPort(loStr)
+		if err != nil {
+			return 0, nil, err
+		}
+		hi := lo
+		if isRange {
+			hi, err = strToPort(hiStr)
+			if err != nil {
+				return 0, nil, err
+			}
+			if hi < lo {
+				return 0, nil, fmt.Errorf("invalid port range %q", item)
+			}
+		}
+		ranges = append(ranges, PortRange{Lo: lo, Hi: hi})
+	}
+	return proto, ranges, nil
+}
+
+func strToPort(p string) (uint16, error) {
+	pInt, err := strconv.Atoi(strings.TrimSpace(p))
+	if err != nil || pInt <= 0 || pInt > 65535 {
+		return 0, fmt.Errorf("invalid port %q", p)
+	}
+	return uint16(pInt), nil
+}
+
+// ParseICMP parses an icmp type with an optional code, like 3 or 3/4. The
+// code is negative when not given.
+func ParseICMP(icmp string) (uint8, int16, error) {
+	typStr, codeStr, hasCode := strings.Cut(icmp, "/")
+	typ, err := strconv.ParseUint(strings.TrimSpace(typStr), 10, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid icmp type %q", typStr)
+	}
+	if !hasCode {
+		return uint8(typ), -1, nil
+	}
+	code, err := strconv.ParseUint(strings.TrimSpace(codeStr), 10, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid icmp code %q", codeStr)
+	}
+	return uint8(typ), int16(code), nil
+}
+
+// Conntrack states matched by policies.
+const (
+	CTStateNew uint8 = 1 << iota
+	CTStateEstablished
+	CTStateInvalid
+)
+
+// ParseCTState parses a comma separated list of conntrack states into a
+// mask of CTState bits, empty meaning any state.
+func ParseCTState(states string) (uint8, error) {
+	if states == "" {
+		return 0, nil
+	}
+	var mask uint8
+	for _, state := range strings.Split(states, ",") {
+		switch strings.ToLower(strings.TrimSpace(state)) {
+		case "new":
+			mask |= CTStateNew
+		case "established":
+			mask |= CTStateEstablished
+		case "invalid":
+			mask |= CTStateInvalid
+		default:
+			return 0, fmt.Errorf("invalid conntrack state %q", state)
+		}
+	}
+	return mask, nil
+}
+
+// Endpoint is a host:port endpoint of a route with its weight.
+type Endpoint struct {
+	Addr   string
+	Weight int
+}
+
+// ParseEndpoints parses a comma separated list of host:port endpoints,
+// each with an optional @weight suffix.
+func ParseEndpoints(spec string) ([]Endpoint, error) {
+	var endpoints []Endpoint
+	for _, item := range strings.Split(spec, ",") {
+		addr, weightStr, hasWeight := strings.Cut(strings.TrimSpace(item), "@")
+		if addr == "" {
+			return nil, fmt.Errorf("empty endpoint in route %q", spec)
+		}
+		if _, port, err := net.SplitHostPort(addr); err != nil {
+			return nil, err
+		} else if _, err := strToPort(port); err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q - err: %w", addr, err)
+		}
+		weight := 1
+		if hasWeight {
+			var err error
+			weight, err = strconv.Atoi(weightStr)
+			if err != nil || weight <= 0 {
+				return nil, fmt.Errorf("invalid weight %q for endpoint %v", weightStr, addr)
+			}
+		}
+		endpoints = append(endpoints, Endpoint{Addr: addr, Weight: weight})
+	}
+	return endpoints, nil
+}
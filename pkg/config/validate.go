@@ -0,0 +1,493 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError is a problem found in the config. Line and Column locate
+// it in the file the config was loaded from, they are zero otherwise.
+type ValidationError struct {
+	File   string
+	Line   int
+	Column int
+	// Path of the field, like policies[2].dstAddr.
+	Field string
+	Msg   string
+}
+
+func (e ValidationError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File + ":")
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "%v:%v:", e.Line, e.Column)
+	}
+	if b.Len() > 0 {
+		b.WriteString(" ")
+	}
+	if e.Field != "" {
+		b.WriteString(e.Field + ": ")
+	}
+	b.WriteString(e.Msg)
+	return b.String()
+}
+
+// ValidationErrors lists every problem found in a config.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Validate checks the whole config and returns ValidationErrors with every
+// problem found, in file order: unknown fields, invalid values, references to missing
+// devices or sets, and tun mtus not fitting in packet buffers.
+func (c *Config) Validate() error {
+	v := &validator{conf: c}
+	if c.node != nil && len(c.node.Content) > 0 {
+		v.checkFields(c.node.Content[0], reflect.TypeOf(*c), nil)
+	}
+	v.checkDevices()
+	v.checkSets()
+	v.checkPolicies()
+	v.checkServices()
+	if len(v.errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(v.errs, func(i, j int) bool {
+		if v.errs[i].Line != v.errs[j].Line {
+			return v.errs[i].Line < v.errs[j].Line
+		}
+		return v.errs[i].Column < v.errs[j].Column
+	})
+	return v.errs
+}
+
+type validator struct {
+	conf *Config
+	errs ValidationErrors
+}
+
+// errorf records an error for the field at the path, made of map keys and
+// sequence indexes.
+func (v *validator) errorf(path []any, format string, args ...any) {
+	v.errorAt(v.lookup(path), path, format, args...)
+}
+
+func (v *validator) errorAt(node *yaml.Node, path []any, format string, args ...any) {
+	err := ValidationError{File: v.conf.File, Field: formatPath(path), Msg: fmt.Sprintf(format, args...)}
+	if node != nil {
+		err.Line, err.Column = node.Line, node.Column
+	}
+	v.errs = append(v.errs, err)
+}
+
+// lookup returns the node of the path, or of the closest parent present in
+// the file.
+func (v *validator) lookup(path []any) *yaml.Node {
+	if v.conf.node == nil || len(v.conf.node.Content) == 0 {
+		return nil
+	}
+	node := v.conf.node.Content[0]
+	for _, elem := range path {
+		next := childNode(node, elem)
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node
+}
+
+func childNode(node *yaml.Node, elem any) *yaml.Node {
+	switch elem := elem.(type) {
+	case string:
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == elem {
+				return node.Content[i+1]
+			}
+		}
+	case int:
+		if node.Kind == yaml.SequenceNode && elem < len(node.Content) {
+			return node.Content[elem]
+		}
+	}
+	return nil
+}
+
+func formatPath(path []any) string {
+	var b strings.Builder
+	for _, elem := range path {
+		switch elem := elem.(type) {
+		case string:
+			if b.Len() > 0 {
+				b.WriteString(".")
+			}
+			b.WriteString(elem)
+		case int:
+			fmt.Fprintf(&b, "[%v]", elem)
+		}
+	}
+	return b.String()
+}
+
+func extend(path []any, elems ...any) []any {
+	return append(path[:len(path):len(path)], elems...)
+}
+
+// checkFields reports the keys of the mapping nodes that match no field of
+// the type they are decoded into.
+func (v *validator) checkFields(node *yaml.Node, typ reflect.Type, path []any) {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < typ.NumField(); i++ {
+			name, _, _ := strings.Cut(typ.Field(i).Tag.Get("yaml"), ",")
+			if name != "" && name != "-" {
+				fields[name] = typ.Field(i).Type
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			fieldPath := extend(path, key.Value)
+			fieldType, ok := fields[key.Value]
+			if !ok {
+				v.errorAt(key, fieldPath, "unknown field %q", key.Value)
+				continue
+			}
+			v.checkFields(node.Content[i+1], fieldType, fieldPath)
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return
+		}
+		for i, item := range node.Content {
+			v.checkFields(item, typ.Elem(), extend(path, i))
+		}
+	}
+}
+
+func (v *validator) maxBufferSize() int {
+	if v.conf.MaxBufferSize == 0 {
+		return defautMaxBufferSize
+	}
+	return v.conf.MaxBufferSize
+}
+
+func (v *validator) checkDevices() {
+	c := v.conf
+	if c.MaxBufferSize < 0 {
+		v.errorf([]any{"maxBufferSize"}, "invalid buffer size %v", c.MaxBufferSize)
+	}
+	if len(c.Devices) == 0 {
+		if c.Address != "" {
+			v.checkAddress([]any{"address"}, c.Address)
+		}
+		if c.Tun != nil {
+			v.checkTun([]any{"tun"}, c.Tun)
+		}
+		return
+	}
+
+	names := make(map[string]bool)
+	for i, d := range c.Devices {
+		path := []any{"devices", i}
+		switch {
+		case d.Name == "":
+			v.errorf(extend(path, "name"), "device name is required")
+		case names[d.Name]:
+			v.errorf(extend(path, "name"), "duplicate device name %q", d.Name)
+		}
+		names[d.Name] = true
+
+		switch d.Type {
+		case DeviceUDP:
+			if d.Address == "" {
+				v.errorf(extend(path, "address"), "udp device requires an address")
+			} else {
+				v.checkAddress(extend(path, "address"), d.Address)
+			}
+			if d.BatchSize < 0 {
+				v.errorf(extend(path, "batchSize"), "invalid batch size %v", d.BatchSize)
+			}
+		case DeviceTun:
+			if d.Tun == nil {
+				v.errorf(extend(path, "tun"), "tun device requires a tun section")
+			} else {
+				v.checkTun(extend(path, "tun"), d.Tun)
+			}
+		case DeviceDrop, DeviceProxy:
+		default:
+			v.errorf(extend(path, "type"), "unknown device type %q", d.Type)
+		}
+	}
+}
+
+func (v *validator) checkAddress(path []any, addr string) {
+	_, port, err := net.SplitHostPort(addr)
+	if err == nil {
+		_, err = strconv.ParseUint(port, 10, 16)
+	}
+	if err != nil {
+		v.errorf(path, "invalid address %q", addr)
+	}
+}
+
+func (v *validator) checkTun(path []any, tun *TunConfig) {
+	if tun.Address != "" {
+		if _, _, err := net.ParseCIDR(tun.Address); err != nil {
+			v.errorf(extend(path, "address"), "invalid cidr %q", tun.Address)
+		}
+	}
+	if tun.Queues < 0 {
+		v.errorf(extend(path, "queues"), "invalid number of queues %v", tun.Queues)
+	}
+	mtu := tun.MTU
+	if mtu == 0 {
+		mtu = defaultMTU
+	}
+	switch {
+	case mtu < 0:
+		v.errorf(extend(path, "mtu"), "invalid mtu %v", tun.MTU)
+	case !tun.Offload && mtu > v.maxBufferSize():
+		// Offloaded packets use buffers of their own.
+		v.errorf(extend(path, "mtu"), "mtu %v does not fit in maxBufferSize %v", mtu, v.maxBufferSize())
+	}
+}
+
+func (v *validator) checkSets() {
+	names := make(map[string]bool)
+	for i, s := range v.conf.Sets {
+		path := []any{"sets", i}
+		switch {
+		case s.Name == "":
+			v.errorf(extend(path, "name"), "set name is required")
+		case names[s.Name]:
+			v.errorf(extend(path, "name"), "duplicate set name %q", s.Name)
+		}
+		names[s.Name] = true
+		for j, cidr := range s.CIDRs {
+			if _, _, err := net.ParseCIDR(strings.TrimSpace(cidr)); err != nil {
+				v.errorf(extend(path, "cidrs", j), "invalid cidr %q", cidr)
+			}
+		}
+	}
+}
+
+func (v *validator) checkPolicies() {
+	devices := make(map[string]bool)
+	for _, d := range v.conf.DeviceConfigs() {
+		devices[d.Name] = true
+	}
+	sets := make(map[string]bool)
+	for _, s := range v.conf.Sets {
+		sets[s.Name] = true
+	}
+	if v.conf.DefaultAction != "" {
+		v.checkAction([]any{"defaultAction"}, Policy{Action: v.conf.DefaultAction})
+	}
+	names := map[string]bool{DefaultPolicyName: true}
+
+	for i, p := range v.conf.Policies {
+		path := []any{"policies", i}
+		if p.Name != "" && names[p.Name] {
+			v.errorf(extend(path, "name"), "duplicate policy name %q", p.Name)
+		}
+		names[p.Name] = true
+		if p.SrcAddr == "" && p.DstAddr == "" && p.SrcSet == "" && p.DstSet == "" &&
+			p.SrcPort == "" && p.DstPort == "" && p.Proto == "" && p.CTState == "" {
+			v.errorf(path, "no match provided")
+		}
+		v.checkAction(path, p)
+		for _, f := range []field{{"srcAddr", p.SrcAddr}, {"dstAddr", p.DstAddr}} {
+			if f.value == "" {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(f.value); err != nil {
+				v.errorf(extend(path, f.name), "invalid cidr %q", f.value)
+			}
+		}
+		for _, f := range []field{{"srcSet", p.SrcSet}, {"dstSet", p.DstSet}} {
+			if name := strings.TrimPrefix(f.value, "!"); f.value != "" && !sets[name] {
+				v.errorf(extend(path, f.name), "set %q does not exist", name)
+			}
+		}
+		if p.Device != "" && !devices[p.Device] {
+			v.errorf(extend(path, "device"), "device %q does not exist", p.Device)
+		}
+		v.checkMatch(path, p)
+		if p.RateLimit != (RateLimit{}) {
+			rl := p.RateLimit
+			if rl.Rate <= 0 || rl.Burst < 0 || rl.MaxSources < 0 {
+				v.errorf(extend(path, "ratelimit"), "rate must be positive, burst and maxSources not negative")
+			}
+		}
+	}
+}
+
+// actionPath returns the path of the action of the policy at path, which
+// is the path itself for the default action.
+func actionPath(path []any) []any {
+	if len(path) == 1 && path[0] == "defaultAction" {
+		return path
+	}
+	return extend(path, "action")
+}
+
+// field is a policy field by its yaml name.
+type field struct {
+	name, value string
+}
+
+func (v *validator) checkAction(path []any, p Policy) {
+	route, isRoute := strings.CutPrefix(p.Action, "route=")
+	switch {
+	case p.Action == "":
+		v.errorf(path, "no action provided")
+	case isRoute:
+		if _, err := ParseEndpoints(route); err != nil {
+			v.errorf(actionPath(path), "invalid route: %v", err)
+		}
+	case p.Action != "drop" && p.Action != "proxy" && p.Action != "local" && p.Action != "reject":
+		v.errorf(actionPath(path), "unknown action %q", p.Action)
+	}
+	if p.Backup != "" {
+		if !isRoute {
+			v.errorf(extend(path, "backup"), "backup endpoints need a route action")
+		} else if _, err := ParseEndpoints(p.Backup); err != nil {
+			v.errorf(extend(path, "backup"), "invalid backup: %v", err)
+		}
+	}
+}
+
+// checkMatch checks the protocol, port, icmp and conntrack state criteria.
+// Protocols must agree.
+func (v *validator) checkMatch(path []any, p Policy) {
+	proto, err := ParseProto(p.Proto)
+	if err != nil {
+		v.errorf(extend(path, "proto"), "%v", err)
+	}
+	for _, f := range []field{{"srcPort", p.SrcPort}, {"dstPort", p.DstPort}} {
+		portProto, _, err := ParsePorts(f.value)
+		switch {
+		case err != nil:
+			v.errorf(extend(path, f.name), "invalid port %q: %v", f.value, err)
+		case portProto != 0 && proto != 0 && portProto != proto:
+			v.errorf(extend(path, f.name), "conflicting protocols in %q", f.value)
+		case portProto != 0:
+			proto = portProto
+		}
+	}
+	if p.ICMP != "" {
+		if _, _, err := ParseICMP(p.ICMP); err != nil {
+			v.errorf(extend(path, "icmp"), "%v", err)
+		}
+		if proto != unix.IPPROTO_ICMP && proto != unix.IPPROTO_ICMPV6 {
+			v.errorf(extend(path, "icmp"), "icmp match requires proto icmp or icmpv6")
+		}
+	}
+	if _, err := ParseCTState(p.CTState); err != nil {
+		v.errorf(extend(path, "ctstate"), "%v", err)
+	}
+}
+
+func (v *validator) checkSync(path []any, s *ConntrackSync) {
+	if s.Protocol != "" && s.Protocol != SyncUDP && s.Protocol != SyncTCP {
+		v.errorf(extend(path, "protocol"), "unknown protocol %q", s.Protocol)
+	}
+	if s.Listen == "" && s.Peer == "" {
+		v.errorf(path, "either listen or peer is required")
+	}
+	if s.Listen != "" {
+		v.checkAddress(extend(path, "listen"), s.Listen)
+	}
+	if s.Peer != "" {
+		v.checkAddress(extend(path, "peer"), s.Peer)
+	}
+	if s.Allow != "" {
+		if _, err := netip.ParseAddr(s.Allow); err != nil {
+			v.errorf(extend(path, "allow"), "invalid address %q", s.Allow)
+		}
+	} else if s.Listen != "" && s.Peer == "" {
+		v.errorf(extend(path, "allow"), "an address is required to listen without a peer")
+	}
+	if s.Interval != "" {
+		if d, err := time.ParseDuration(s.Interval); err != nil || d <= 0 {
+			v.errorf(extend(path, "interval"), "invalid interval %q", s.Interval)
+		}
+	}
+	if len(s.Key) < MinSyncKeyLen {
+		v.errorf(extend(path, "key"), "a key of at least %v bytes is required", MinSyncKeyLen)
+	}
+}
+
+// checkServices checks the settings of the health checks, conntrack and
+// admin api.
+func (v *validator) checkServices() {
+	c := v.conf
+	if c.HealthCheck != nil {
+		if d, err := time.ParseDuration(c.HealthCheck.Interval); err != nil || d <= 0 {
+			v.errorf([]any{"healthCheck", "interval"}, "invalid interval %q", c.HealthCheck.Interval)
+		}
+		if c.HealthCheck.Failures < 0 {
+			v.errorf([]any{"healthCheck", "failures"}, "invalid number of failures %v", c.HealthCheck.Failures)
+		}
+	}
+	if c.Conntrack != nil {
+		names := make([]string, 0, len(c.Conntrack.Timeouts))
+		for name := range c.Conntrack.Timeouts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value := c.Conntrack.Timeouts[name]
+			path := []any{"conntrack", "timeouts", name}
+			if name != "other" {
+				if _, err := ParseProto(name); err != nil || name == "" {
+					v.errorf(path, "unknown protocol %q", name)
+				}
+			}
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				v.errorf(path, "invalid timeout %q", value)
+			}
+		}
+		if c.Conntrack.MaxEntries < 0 {
+			v.errorf([]any{"conntrack", "maxEntries"}, "invalid number of entries %v", c.Conntrack.MaxEntries)
+		}
+		if c.Conntrack.SweepInterval != "" {
+			if d, err := time.ParseDuration(c.Conntrack.SweepInterval); err != nil || d <= 0 {
+				v.errorf([]any{"conntrack", "sweepInterval"}, "invalid interval %q", c.Conntrack.SweepInterval)
+			}
+		}
+		if c.Conntrack.Sync != nil {
+			v.checkSync([]any{"conntrack", "sync"}, c.Conntrack.Sync)
+		}
+	}
+	if c.Admin != "" {
+		v.checkAddress([]any{"admin"}, c.Admin)
+	}
+}
@@ -1,40 +1,463 @@
 package conntrack
 
 import (
+	"container/list"
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mazdakn/uproxy/pkg/devs"
 	"github.com/mazdakn/uproxy/pkg/packet"
+	"golang.org/x/sys/unix"
+)
+
+// Default idle timeouts, after which entries are considered gone.
+const (
+	DefaultTCPTimeout   = 5 * time.Minute
+	DefaultUDPTimeout   = 30 * time.Second
+	DefaultICMPTimeout  = 30 * time.Second
+	DefaultOtherTimeout = time.Minute
+)
+
+const (
+	// DefaultMaxEntries bounds the number of tracked flows, the least
+	// recently active ones being evicted past it.
+	DefaultMaxEntries = 1 << 18
+	// DefaultSweepInterval is how often Run removes idle flows.
+	DefaultSweepInterval = 10 * time.Second
+	// Shards is the number of shards of a table, which RangeShard goes
+	// through one at a time.
+	Shards = numShards
+
+	numShards = 64
 )
 
 type Connection struct {
 	InDev devs.NetIO
+	// Endpoint replies are sent to on InDev, nil when InDev is not a udp
+	// device.
+	InEndpoint *net.UDPAddr
+
+	OutDev devs.NetIO
+	// Endpoint the flow is sent to on OutDev, the only one replies are
+	// accepted from, nil when OutDev is not a udp device.
+	OutEndpoint *net.UDPAddr
+	// Monotonic times of the first and last packets of the flow.
+	created, lastActive time.Duration
+	// Packets and bytes seen in the original and reply directions.
+	packets, bytes [2]uint64
+	// Set once a packet flowed the other way.
+	replied bool
+	// Set for flows learnt from a peer that saw no packet here since.
+	synced bool
+	tcp    tcpConn
+}
+
+// TCPState returns the state of tcp flows, TCPNone for others.
+func (c Connection) TCPState() TCPState {
+	return c.tcp.state
+}
+
+type entry struct {
+	key  packet.FlowKey
+	conn Connection
+}
 
-	OutDev     devs.NetIO
-	lastActive time.Time // TODO: change to monotonic time
+// shard holds the flows whose key hashes to it, in least recently active
+// order.
+type shard struct {
+	lock  sync.Mutex
+	conns map[packet.FlowKey]*list.Element
+	lru   *list.List
 }
 
+// ConnTable tracks flows in shards, each behind its own lock, so packets of
+// different flows rarely contend. When the table is full, adding a flow
+// evicts the least recently active flow of its shard, or of another shard
+// when its own is empty. Idle flows are dropped when inspected and by Run.
 type ConnTable struct {
-	conns map[string]Connection
+	shards [numShards]shard
+	// Idle timeouts by protocol, 0 when the protocol has none of its own,
+	// in which case the timeout of protocol 0 applies.
+	timeouts [256]atomic.Int64
+	// Idle timeouts of tcp flows by state, 0 for the established state
+	// which uses the tcp timeout.
+	tcpTimeouts [numTCPStates]atomic.Int64
+	maxEntries  atomic.Int64
+	// Number of flows across the shards, counting those being added.
+	entries atomic.Int64
+	events  subscribers
+	// Monotonic clock, replaced by tests.
+	now func() time.Duration
 }
 
 func New() *ConnTable {
-	return &ConnTable{
-		conns: make(map[string]Connection),
+	c := &ConnTable{}
+	for i := range c.shards {
+		c.shards[i].conns = make(map[packet.FlowKey]*list.Element)
+		c.shards[i].lru = list.New()
+	}
+	c.SetTimeout(unix.IPPROTO_TCP, DefaultTCPTimeout)
+	c.SetTimeout(unix.IPPROTO_UDP, DefaultUDPTimeout)
+	c.SetTimeout(unix.IPPROTO_ICMP, DefaultICMPTimeout)
+	c.SetTimeout(unix.IPPROTO_ICMPV6, DefaultICMPTimeout)
+	c.SetTimeout(0, DefaultOtherTimeout)
+	c.SetTCPTimeout(TCPSynSent, DefaultTCPSynSentTimeout)
+	c.SetTCPTimeout(TCPFinWait, DefaultTCPFinWaitTimeout)
+	c.SetTCPTimeout(TCPTimeWait, DefaultTCPTimeWaitTimeout)
+	c.SetTCPTimeout(TCPClosed, DefaultTCPClosedTimeout)
+	c.SetMaxEntries(DefaultMaxEntries)
+	start := time.Now()
+	c.now = func() time.Duration { return time.Since(start) }
+	return c
+}
+
+// SetTimeout sets the idle timeout of the protocol, 0 standing for the
+// protocols without one of their own.
+func (c *ConnTable) SetTimeout(proto byte, timeout time.Duration) {
+	c.timeouts[proto].Store(int64(timeout))
+}
+
+// SetTCPTimeout sets the idle timeout of tcp flows in the state, other than
+// established.
+func (c *ConnTable) SetTCPTimeout(state TCPState, timeout time.Duration) {
+	if state != TCPNone && state != TCPEstablished && state < numTCPStates {
+		c.tcpTimeouts[state].Store(int64(timeout))
+	}
+}
+
+func (c *ConnTable) timeout(proto byte) time.Duration {
+	if timeout := c.timeouts[proto].Load(); timeout != 0 {
+		return time.Duration(timeout)
+	}
+	return time.Duration(c.timeouts[0].Load())
+}
+
+// SetMaxEntries bounds the number of tracked flows. Tables already past the
+// bound shrink as flows are added.
+func (c *ConnTable) SetMaxEntries(max int) {
+	c.maxEntries.Store(int64(max))
+}
+
+func (c *ConnTable) shard(key packet.FlowKey) *shard {
+	return &c.shards[key.Hash()%numShards]
+}
+
+// Len returns the number of tracked flows, idle ones included until they
+// are swept.
+func (c *ConnTable) Len() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.lock.Lock()
+		n += s.lru.Len()
+		s.lock.Unlock()
 	}
+	return n
 }
 
 func (c *ConnTable) Add(pkt *packet.Packet) {
-	c.conns[pkt.Tuple()] = Connection{
-		lastActive: time.Now(),
+	key := pkt.FlowKey()
+	s := c.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := c.now()
+	conn := Connection{created: now, lastActive: now}
+	conn.count(pkt, 0)
+	c.store(s, key, conn)
+}
+
+// count accounts the packet to the direction of the flow.
+func (c *Connection) count(pkt *packet.Packet, dir int) {
+	c.packets[dir]++
+	c.bytes[dir] += uint64(pkt.Len())
+}
+
+// store sets the flow of the key, making it the most recently active one
+// and evicting flows past the maximum. New flows are not stored when no flow
+// can be evicted. The shard must be locked.
+func (c *ConnTable) store(s *shard, key packet.FlowKey, conn Connection) {
+	if elem, ok := s.conns[key]; ok {
+		e := elem.Value.(*entry)
+		e.conn = conn
+		s.lru.MoveToFront(elem)
+		c.emit(EventUpdate, e)
+		return
 	}
+	// The flow is counted first so that concurrent adds to other shards
+	// cannot take the room left for it.
+	c.entries.Add(1)
+	for c.entries.Load() > c.maxEntries.Load() {
+		if !c.evict(s) {
+			c.entries.Add(-1)
+			return
+		}
+	}
+	e := &entry{key: key, conn: conn}
+	s.conns[key] = s.lru.PushFront(e)
+	c.emit(EventNew, e)
+}
+
+// evict removes the least recently active flow of the locked shard, or of
+// the first other shard that is not locked if it is empty, so that it never
+// waits for another shard. It reports whether a flow was removed.
+func (c *ConnTable) evict(s *shard) bool {
+	if elem := s.lru.Back(); elem != nil {
+		c.remove(s, elem)
+		return true
+	}
+	for i := range c.shards {
+		other := &c.shards[i]
+		if other == s || !other.lock.TryLock() {
+			continue
+		}
+		elem := other.lru.Back()
+		if elem != nil {
+			c.remove(other, elem)
+		}
+		other.lock.Unlock()
+		if elem != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// remove drops the flow of the element from the shard, which must be
+// locked.
+func (c *ConnTable) remove(s *shard, elem *list.Element) {
+	e := elem.Value.(*entry)
+	delete(s.conns, e.key)
+	s.lru.Remove(elem)
+	c.entries.Add(-1)
+	c.emit(EventDestroy, e)
+}
+
+// Track records the flow of the packet, coming from inDev and going to
+// outDev, or refreshes it if it is already known. TCP flows are only
+// recorded from their SYN. The packet is counted when it starts the flow,
+// later ones being counted by Inspect.
+func (c *ConnTable) Track(pkt *packet.Packet, inDev, outDev devs.NetIO) {
+	key := pkt.FlowKey()
+	s := c.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := c.now()
+	elem, ok := s.conns[key]
+	if ok && c.expired(&elem.Value.(*entry).conn, pkt.Protocol(), now) {
+		c.remove(s, elem)
+		ok = false
+	}
+	if !ok {
+		conn := Connection{created: now, lastActive: now}
+		if pkt.Protocol() == unix.IPPROTO_TCP {
+			seg, ok := pkt.TCPSegment()
+			if !ok || !conn.tcp.start(seg) {
+				return
+			}
+		}
+		conn.setDevices(pkt, inDev, outDev)
+		conn.count(pkt, 0)
+		c.store(s, key, conn)
+		return
+	}
+
+	e := elem.Value.(*entry)
+	e.conn.lastActive = now
+	s.lru.MoveToFront(elem)
+	if e.conn.InDev != inDev || e.conn.OutDev != outDev || !sameEndpoint(e.conn.OutEndpoint, pkt.Meta.Endpoint) || e.conn.synced {
+		e.conn.setDevices(pkt, inDev, outDev)
+		e.conn.synced = false
+		c.emit(EventUpdate, e)
+	}
+}
+
+func (c *Connection) setDevices(pkt *packet.Packet, inDev, outDev devs.NetIO) {
+	c.InDev, c.OutDev, c.InEndpoint, c.OutEndpoint = inDev, outDev, nil, pkt.Meta.Endpoint
+	if pkt.Meta.Origin.IsValid() {
+		c.InEndpoint = net.UDPAddrFromAddrPort(pkt.Meta.Origin)
+	}
+}
+
+// repliedFrom reports whether a packet coming in on the device from the
+// origin, invalid unless the device is a udp device, may be a reply of the
+// flow: it must come from where the flow is sent to.
+func (c *Connection) repliedFrom(dev devs.NetIO, origin netip.AddrPort) bool {
+	if dev != c.OutDev {
+		return false
+	}
+	return c.OutEndpoint == nil || sameAddrPort(c.OutEndpoint.AddrPort(), origin)
+}
+
+func sameEndpoint(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return sameAddrPort(a.AddrPort(), b.AddrPort())
+}
+
+// sameAddrPort compares the addresses regardless of IPv4 being mapped.
+func sameAddrPort(a, b netip.AddrPort) bool {
+	return a.Addr().Unmap() == b.Addr().Unmap() && a.Port() == b.Port()
 }
 
 func (c *ConnTable) Lookup(pkt *packet.Packet) (*Connection, bool) {
-	conn, exists := c.conns[pkt.Tuple()]
-	return &conn, exists
+	key := pkt.FlowKey()
+	s := c.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	elem, ok := s.conns[key]
+	if !ok {
+		return &Connection{}, false
+	}
+	conn := elem.Value.(*entry).conn
+	return &conn, true
+}
+
+// Inspection is what Inspect found out about a packet.
+type Inspection struct {
+	State packet.CTState
+	// Set for packets of tracked flows, Conn being their flow.
+	Tracked bool
+	Conn    Connection
+	// Set for packets flowing the other way than the one starting the flow.
+	Reply bool
+}
+
+// Inspect returns the conntrack state of the packet, which came in on the
+// device. Packets of tracked flows, either way, refresh them and advance
+// their tcp state, tcp segments out of the window of their flow being
+// invalid. Packets flowing the other way only count as such when they come
+// in on the out device of the flow, from its out endpoint if any. Other
+// packets are new, unless they are tcp segments other than a SYN. Idle
+// flows are removed, and so are closed tcp flows a new SYN reopens.
+func (c *ConnTable) Inspect(pkt *packet.Packet, dev devs.NetIO) Inspection {
+	key := pkt.FlowKey()
+	for dir, k := range [2]packet.FlowKey{key, key.Reverse()} {
+		if in, ok := c.inspect(pkt, dev, k, dir); ok {
+			return in
+		}
+	}
+	if pkt.Protocol() == unix.IPPROTO_TCP {
+		var t tcpConn
+		if seg, ok := pkt.TCPSegment(); !ok || !t.start(seg) {
+			return Inspection{State: packet.CTInvalid}
+		}
+	}
+	return Inspection{State: packet.CTNew}
+}
+
+// inspect looks the packet up as flowing in the direction of the flow of
+// the key, ok being false when the flow is not tracked or the packet is not
+// one of its replies.
+func (c *ConnTable) inspect(pkt *packet.Packet, dev devs.NetIO, key packet.FlowKey, dir int) (Inspection, bool) {
+	s := c.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	elem, ok := s.conns[key]
+	if !ok {
+		return Inspection{}, false
+	}
+	e := elem.Value.(*entry)
+	conn := &e.conn
+	now := c.now()
+	if c.expired(conn, pkt.Protocol(), now) {
+		c.remove(s, elem)
+		return Inspection{}, false
+	}
+	if dir == 1 && !conn.repliedFrom(dev, pkt.Meta.Origin) {
+		return Inspection{}, false
+	}
+
+	in := Inspection{Tracked: true, Reply: dir == 1}
+	replied, synced, state := conn.replied, conn.synced, conn.tcp.state
+	if pkt.Protocol() == unix.IPPROTO_TCP {
+		seg, ok := pkt.TCPSegment()
+		if ok && dir == 0 && reopens(conn.tcp.state, seg) {
+			c.remove(s, elem)
+			return Inspection{}, false
+		}
+		if !ok || !conn.tcp.update(seg, dir) {
+			in.State, in.Conn = packet.CTInvalid, *conn
+			return in, true
+		}
+	}
+	conn.lastActive = now
+	conn.replied = conn.replied || dir == 1
+	conn.synced = false
+	conn.count(pkt, dir)
+	s.lru.MoveToFront(elem)
+	if conn.replied != replied || conn.synced != synced || conn.tcp.state != state {
+		c.emit(EventUpdate, e)
+	}
+	in.State, in.Conn = packet.CTNew, *conn
+	if conn.replied {
+		in.State = packet.CTEstablished
+	}
+	return in, true
+}
+
+// reopens reports whether the segment starts a new connection over a
+// closing or closed one.
+func reopens(state TCPState, seg packet.TCPSegment) bool {
+	var t tcpConn
+	return (state == TCPTimeWait || state == TCPClosed) && t.start(seg)
+}
+
+func (c *ConnTable) expired(conn *Connection, proto byte, now time.Duration) bool {
+	timeout := c.timeout(proto)
+	if state := conn.tcp.state; proto == unix.IPPROTO_TCP && state != TCPNone && state != TCPEstablished {
+		timeout = time.Duration(c.tcpTimeouts[state].Load())
+	}
+	return now-conn.lastActive > timeout
 }
 
 func (c *ConnTable) Delete(pkt *packet.Packet) {
-	delete(c.conns, pkt.Tuple())
+	key := pkt.FlowKey()
+	s := c.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if elem, ok := s.conns[key]; ok {
+		c.remove(s, elem)
+	}
+}
+
+// Sweep removes the idle flows and returns how many there were.
+func (c *ConnTable) Sweep() int {
+	removed := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.lock.Lock()
+		now := c.now()
+		for elem := s.lru.Back(); elem != nil; {
+			prev := elem.Prev()
+			e := elem.Value.(*entry)
+			if c.expired(&e.conn, e.key.Proto, now) {
+				c.remove(s, elem)
+				removed++
+			}
+			elem = prev
+		}
+		s.lock.Unlock()
+	}
+	return removed
+}
+
+// Run sweeps the table every interval until the context is done.
+func (c *ConnTable) Run(ctx context.Context, wg *sync.WaitGroup, interval time.Duration) {
+	defer wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Sweep()
+		}
+	}
 }
@@ -0,0 +1,261 @@
+package conntrack
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/devs"
+	"github.com/mazdakn/uproxy/pkg/packet"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+type testDevice struct {
+	devs.Queues
+}
+
+func (d *testDevice) Start() error { return nil }
+func (d *testDevice) Stop() error  { return nil }
+func (d *testDevice) Name() string { return "test" }
+
+// testPacket returns a packet of the protocol from 10.0.0.1:1234 to
+// 10.0.0.2:80, or the other way around when reply is set. TCP packets are
+// the SYN, or the SYN-ACK answering it.
+func testPacket(proto byte, reply bool) *packet.Packet {
+	if proto == unix.IPPROTO_TCP {
+		if reply {
+			return tcpPacket(true, packet.TCPFlagSYN|packet.TCPFlagACK, 5000, 1001, 1000, 0)
+		}
+		return tcpPacket(false, packet.TCPFlagSYN, 1000, 0, 1000, 0)
+	}
+	return ipv4Packet(proto, reply, make([]byte, 8))
+}
+
+// tcpPacket returns a tcp segment of the flow of testPacket with a payload
+// of the given length.
+func tcpPacket(reply bool, flags byte, seq, ack uint32, window uint16, dataLen int) *packet.Packet {
+	l4 := make([]byte, 20+dataLen)
+	binary.BigEndian.PutUint32(l4[4:8], seq)
+	binary.BigEndian.PutUint32(l4[8:12], ack)
+	l4[12] = 5 << 4
+	l4[13] = flags
+	binary.BigEndian.PutUint16(l4[14:16], window)
+	return ipv4Packet(unix.IPPROTO_TCP, reply, l4)
+}
+
+func ipv4Packet(proto byte, reply bool, l4 []byte) *packet.Packet {
+	pkt := packet.New(20 + len(l4))
+	b := pkt.Bytes
+	b[0] = 0x45
+	b[9] = proto
+	src, dst := net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4()
+	srcPort, dstPort := byte(0xd2), byte(80)
+	if reply {
+		src, dst, srcPort, dstPort = dst, src, dstPort, srcPort
+	}
+	copy(b[12:16], src)
+	copy(b[16:20], dst)
+	copy(b[20:], l4)
+	b[21], b[23] = srcPort, dstPort
+	pkt.Size = len(b)
+	Expect(pkt.Parse()).To(Succeed())
+	return pkt
+}
+
+func TestInspect(t *testing.T) {
+	RegisterTestingT(t)
+	c := New()
+	var now time.Duration
+	c.now = func() time.Duration { return now }
+	in, out := &testDevice{}, &testDevice{}
+
+	inspection := c.Inspect(testPacket(unix.IPPROTO_UDP, true), out)
+	Expect(inspection.Tracked).To(BeFalse())
+	Expect(inspection.State).To(Equal(packet.CTNew))
+
+	pkt := testPacket(unix.IPPROTO_UDP, false)
+	pkt.Meta.Origin = netip.MustParseAddrPort("192.168.1.1:9999")
+	c.Track(pkt, in, out)
+	inspection = c.Inspect(testPacket(unix.IPPROTO_UDP, false), in)
+	Expect(inspection.Tracked).To(BeTrue())
+	Expect(inspection.Reply).To(BeFalse())
+	Expect(inspection.State).To(Equal(packet.CTNew))
+	inspection = c.Inspect(testPacket(unix.IPPROTO_UDP, true), out)
+	Expect(inspection.Reply).To(BeTrue())
+	Expect(inspection.State).To(Equal(packet.CTEstablished))
+	Expect(inspection.Conn.InDev).To(BeIdenticalTo(in))
+	Expect(inspection.Conn.OutDev).To(BeIdenticalTo(out))
+	Expect(inspection.Conn.InEndpoint.String()).To(Equal("192.168.1.1:9999"))
+	Expect(c.Inspect(testPacket(unix.IPPROTO_UDP, false), in).State).To(Equal(packet.CTEstablished))
+
+	// Packets refresh the flow until it is idle for longer than the
+	// timeout of its protocol.
+	now += DefaultUDPTimeout - time.Second
+	Expect(c.Inspect(testPacket(unix.IPPROTO_UDP, true), out).Reply).To(BeTrue())
+	now += DefaultUDPTimeout + time.Second
+	Expect(c.Inspect(testPacket(unix.IPPROTO_UDP, true), out).Tracked).To(BeFalse())
+	Expect(c.Len()).To(BeZero())
+}
+
+func TestInspectReplySource(t *testing.T) {
+	RegisterTestingT(t)
+	c := New()
+	in, out, other := &testDevice{}, &testDevice{}, &testDevice{}
+	endpoint := netip.MustParseAddrPort("192.168.2.1:7777")
+	reply := func(dev devs.NetIO, origin string) Inspection {
+		pkt := testPacket(unix.IPPROTO_UDP, true)
+		if origin != "" {
+			pkt.Meta.Origin = netip.MustParseAddrPort(origin)
+		}
+		return c.Inspect(pkt, dev)
+	}
+
+	pkt := testPacket(unix.IPPROTO_UDP, false)
+	pkt.Meta.Endpoint = net.UDPAddrFromAddrPort(endpoint)
+	c.Track(pkt, in, out)
+
+	// Replies only come in on the out device, from the endpoint the flow
+	// is sent to. Other packets leave the flow as it was.
+	Expect(reply(other, endpoint.String())).To(Equal(Inspection{State: packet.CTNew}))
+	Expect(reply(out, "192.168.2.1:7778")).To(Equal(Inspection{State: packet.CTNew}))
+	Expect(reply(out, "")).To(Equal(Inspection{State: packet.CTNew}))
+	conn, _ := c.Lookup(pkt)
+	Expect(conn.replied).To(BeFalse())
+	Expect(conn.packets).To(Equal([2]uint64{1, 0}))
+	Expect(reply(out, "[::ffff:192.168.2.1]:7777").Reply).To(BeTrue())
+
+	// Flows moved to another endpoint take their replies from it.
+	pkt.Meta.Endpoint = net.UDPAddrFromAddrPort(netip.MustParseAddrPort("192.168.2.2:7777"))
+	c.Track(pkt, in, out)
+	Expect(reply(out, endpoint.String()).Tracked).To(BeFalse())
+	Expect(reply(out, "192.168.2.2:7777").Reply).To(BeTrue())
+
+	// Flows out of devices other than udp ones take replies from anywhere
+	// on their out device.
+	pkt.Meta.Endpoint = nil
+	c.Track(pkt, in, out)
+	Expect(reply(out, "").Reply).To(BeTrue())
+	Expect(reply(in, "").Tracked).To(BeFalse())
+}
+
+func TestTimeouts(t *testing.T) {
+	RegisterTestingT(t)
+	c := New()
+	in, out := &testDevice{}, &testDevice{}
+	var now time.Duration
+	c.now = func() time.Duration { return now }
+	c.SetTimeout(0, time.Second)
+	c.SetTimeout(unix.IPPROTO_TCP, time.Hour)
+
+	c.Track(testPacket(unix.IPPROTO_TCP, false), in, out)
+	c.Track(testPacket(unix.IPPROTO_GRE, false), in, out)
+	now += time.Minute
+	Expect(c.Inspect(testPacket(unix.IPPROTO_TCP, true), out).Reply).To(BeTrue())
+	Expect(c.Inspect(testPacket(unix.IPPROTO_GRE, true), out).Tracked).To(BeFalse())
+}
+
+// flowPacket returns a udp packet from 10.0.0.1 to 10.0.0.2:80 with the
+// given source port.
+func flowPacket(srcPort uint16) *packet.Packet {
+	pkt := testPacket(unix.IPPROTO_UDP, false)
+	pkt.Bytes[20], pkt.Bytes[21] = byte(srcPort>>8), byte(srcPort)
+	Expect(pkt.Parse()).To(Succeed())
+	return pkt
+}
+
+func TestSweep(t *testing.T) {
+	RegisterTestingT(t)
+	c := New()
+	in, out := &testDevice{}, &testDevice{}
+	var now time.Duration
+	c.now = func() time.Duration { return now }
+	c.Track(testPacket(unix.IPPROTO_TCP, false), in, out)
+	c.Track(testPacket(unix.IPPROTO_UDP, false), in, out)
+	Expect(c.Sweep()).To(BeZero())
+
+	now += DefaultUDPTimeout + time.Second
+	Expect(c.Sweep()).To(Equal(1))
+	Expect(c.Len()).To(Equal(1))
+	Expect(c.Inspect(testPacket(unix.IPPROTO_TCP, true), out).Reply).To(BeTrue())
+
+	now += DefaultTCPTimeout + time.Second
+	Expect(c.Sweep()).To(Equal(1))
+	Expect(c.Len()).To(BeZero())
+}
+
+func TestMaxEntries(t *testing.T) {
+	RegisterTestingT(t)
+	c := New()
+	var now time.Duration
+	c.now = func() time.Duration { return now }
+	c.SetMaxEntries(2)
+
+	// The least recently active flow of the shard is evicted.
+	first := flowPacket(1)
+	c.Track(first, &testDevice{}, &testDevice{})
+	var port uint16 = 2
+	for ; c.shard(flowPacket(port).FlowKey()) != c.shard(first.FlowKey()); port++ {
+	}
+	now += time.Second
+	c.Track(flowPacket(port), &testDevice{}, &testDevice{})
+	now += time.Second
+	c.Track(flowPacket(port+1), &testDevice{}, &testDevice{})
+	_, ok := c.Lookup(first)
+	Expect(ok).To(BeFalse())
+	_, ok = c.Lookup(flowPacket(port))
+	Expect(ok).To(BeTrue())
+	_, ok = c.Lookup(flowPacket(port + 1))
+	Expect(ok).To(BeTrue())
+
+	// The bound holds across shards, even below one flow per shard.
+	for _, max := range []int{1, 10, 100, 1000} {
+		c.SetMaxEntries(max)
+		for i := 0; i < 2000; i++ {
+			c.Track(flowPacket(uint16(i)), &testDevice{}, &testDevice{})
+			Expect(c.Len()).To(BeNumerically("<=", max))
+		}
+		Expect(c.Len()).To(Equal(max))
+		_, ok = c.Lookup(flowPacket(1999))
+		Expect(ok).To(BeTrue())
+	}
+
+	// Shrinking the bound evicts as flows are added.
+	c.SetMaxEntries(10)
+	c.Track(flowPacket(3000), &testDevice{}, &testDevice{})
+	Expect(c.Len()).To(Equal(10))
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	RegisterTestingT(t)
+	c := New()
+	c.SetMaxEntries(256)
+	in, out := &testDevice{}, &testDevice{}
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				pkt := flowPacket(uint16(g*1000 + i))
+				c.Track(pkt, in, out)
+				c.Lookup(pkt)
+				c.Inspect(pkt, in)
+				if i%3 == 0 {
+					c.Delete(pkt)
+				}
+			}
+		}(g)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go c.Run(ctx, &wg, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	cancel()
+	wg.Wait()
+	Expect(c.Len()).To(BeNumerically("<=", 256))
+}
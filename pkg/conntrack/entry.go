@@ -0,0 +1,193 @@
+package conntrack
+
+import (
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/devs"
+	"github.com/mazdakn/uproxy/pkg/packet"
+	"golang.org/x/sys/unix"
+)
+
+// Entry is a snapshot of a tracked flow.
+type Entry struct {
+	// Key of the original direction of the flow.
+	Key packet.FlowKey
+	// Devices the flow comes from and goes to.
+	InDev, OutDev devs.NetIO
+	// Endpoint replies are sent to on InDev, invalid when there is none.
+	InEndpoint netip.AddrPort
+	// Endpoint the flow is sent to on OutDev, invalid when there is none.
+	OutEndpoint netip.AddrPort
+	// Packets and bytes seen in the original and reply directions.
+	Packets, Bytes [2]uint64
+	// Time since the first and the last packets of the flow.
+	Age, Idle time.Duration
+	// CTNew until the flow saw a reply, then CTEstablished.
+	State    packet.CTState
+	TCPState TCPState
+	// Window scales of the original and reply directions of tcp flows.
+	WindowScale [2]uint8
+	// Set for flows learnt from a peer that saw no packet here since.
+	Synced bool
+}
+
+// snapshot returns the entry as seen at the monotonic time.
+func (e *entry) snapshot(now time.Duration) Entry {
+	conn := &e.conn
+	snap := Entry{
+		Key:         e.key,
+		InDev:       conn.InDev,
+		OutDev:      conn.OutDev,
+		Packets:     conn.packets,
+		Bytes:       conn.bytes,
+		Age:         now - conn.created,
+		Idle:        now - conn.lastActive,
+		State:       packet.CTNew,
+		TCPState:    conn.tcp.state,
+		WindowScale: [2]uint8{conn.tcp.dirs[0].scale, conn.tcp.dirs[1].scale},
+		Synced:      conn.synced,
+	}
+	snap.InEndpoint = unmapped(conn.InEndpoint)
+	snap.OutEndpoint = unmapped(conn.OutEndpoint)
+	if conn.replied {
+		snap.State = packet.CTEstablished
+	}
+	return snap
+}
+
+// unmapped returns the address of the endpoint, IPv4 ones being unmapped, or
+// an invalid one for a nil endpoint.
+func unmapped(ep *net.UDPAddr) netip.AddrPort {
+	if ep == nil {
+		return netip.AddrPort{}
+	}
+	addr := ep.AddrPort()
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
+
+// Filter selects flows by their original direction, zero fields matching
+// any flow.
+type Filter struct {
+	Proto            byte
+	Src, Dst         netip.Prefix
+	SrcPort, DstPort uint16
+	// Either device of the flow.
+	Dev devs.NetIO
+}
+
+// Match reports whether the filter selects the entry.
+func (f Filter) Match(e Entry) bool {
+	src, dst := e.Key.SrcAddrPort(), e.Key.DstAddrPort()
+	switch {
+	case f.Proto != 0 && f.Proto != e.Key.Proto:
+		return false
+	case f.Src.IsValid() && !f.Src.Contains(src.Addr()):
+		return false
+	case f.Dst.IsValid() && !f.Dst.Contains(dst.Addr()):
+		return false
+	case f.SrcPort != 0 && f.SrcPort != src.Port():
+		return false
+	case f.DstPort != 0 && f.DstPort != dst.Port():
+		return false
+	case f.Dev != nil && f.Dev != e.InDev && f.Dev != e.OutDev:
+		return false
+	}
+	return true
+}
+
+// Range calls fn with every tracked flow, idle ones included until they are
+// swept, until fn returns false. Flows are snapshotted a shard at a time, so
+// fn runs without holding any lock and may use the table.
+func (c *ConnTable) Range(fn func(Entry) bool) {
+	for i := range c.shards {
+		if !c.RangeShard(i, fn) {
+			return
+		}
+	}
+}
+
+// RangeShard calls fn with every flow of the shard i, below Shards, like
+// Range does. It returns false if fn did.
+func (c *ConnTable) RangeShard(i int, fn func(Entry) bool) bool {
+	s := &c.shards[i]
+	s.lock.Lock()
+	now := c.now()
+	entries := make([]Entry, 0, s.lru.Len())
+	for elem := s.lru.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, elem.Value.(*entry).snapshot(now))
+	}
+	s.lock.Unlock()
+	for _, e := range entries {
+		if !fn(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// Flush removes the flows the filter selects and returns how many there
+// were.
+func (c *ConnTable) Flush(f Filter) int {
+	removed := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.lock.Lock()
+		now := c.now()
+		for elem := s.lru.Front(); elem != nil; {
+			next := elem.Next()
+			if f.Match(elem.Value.(*entry).snapshot(now)) {
+				c.remove(s, elem)
+				removed++
+			}
+			elem = next
+		}
+		s.lock.Unlock()
+	}
+	return removed
+}
+
+// Import records a flow learnt from a peer, as found in the entry, unless
+// the flow of its key saw packets here since it was learnt, if ever. The
+// sequence numbers of tcp flows are learnt from their next segments.
+func (c *ConnTable) Import(e Entry) {
+	s := c.shard(e.Key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if elem, ok := s.conns[e.Key]; ok && !elem.Value.(*entry).conn.synced {
+		return
+	}
+	now := c.now()
+	conn := Connection{
+		InDev:      e.InDev,
+		OutDev:     e.OutDev,
+		created:    now - e.Age,
+		lastActive: now - e.Idle,
+		packets:    e.Packets,
+		bytes:      e.Bytes,
+		replied:    e.State == packet.CTEstablished,
+		synced:     true,
+	}
+	if e.InEndpoint.IsValid() {
+		conn.InEndpoint = net.UDPAddrFromAddrPort(e.InEndpoint)
+	}
+	if e.OutEndpoint.IsValid() {
+		conn.OutEndpoint = net.UDPAddrFromAddrPort(e.OutEndpoint)
+	}
+	if e.Key.Proto == unix.IPPROTO_TCP {
+		conn.tcp.pickup(e.TCPState, e.WindowScale)
+	}
+	c.store(s, e.Key, conn)
+}
+
+// Forget removes the flow of the key if it was learnt from a peer and saw
+// no packet here since.
+func (c *ConnTable) Forget(key packet.FlowKey) {
+	s := c.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if elem, ok := s.conns[key]; ok && elem.Value.(*entry).conn.synced {
+		c.remove(s, elem)
+	}
+}
@@ -0,0 +1,185 @@
+package conntrack
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/devs"
+	"github.com/mazdakn/uproxy/pkg/packet"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+func entries(c *ConnTable, f Filter) []Entry {
+	var found []Entry
+	c.Range(func(e Entry) bool {
+		if f.Match(e) {
+			found = append(found, e)
+		}
+		return true
+	})
+	return found
+}
+
+func TestRange(t *testing.T) {
+	RegisterTestingT(t)
+	c := New()
+	var now time.Duration
+	c.now = func() time.Duration { return now }
+	var in, out devs.NetIO = &testDevice{}, &testDevice{}
+
+	pkt := testPacket(unix.IPPROTO_UDP, false)
+	pkt.Meta.Origin = netip.MustParseAddrPort("192.168.1.1:9999")
+	pkt.Meta.Endpoint = net.UDPAddrFromAddrPort(netip.MustParseAddrPort("[::ffff:192.168.2.1]:7777"))
+	c.Track(pkt, in, out)
+	now += time.Second
+	c.Inspect(testPacket(unix.IPPROTO_UDP, false), in)
+	reply := testPacket(unix.IPPROTO_UDP, true)
+	reply.Meta.Origin = netip.MustParseAddrPort("192.168.2.1:7777")
+	c.Inspect(reply, out)
+	now += time.Second
+
+	found := entries(c, Filter{})
+	Expect(found).To(HaveLen(1))
+	Expect(found[0]).To(Equal(Entry{
+		Key:         pkt.FlowKey(),
+		InDev:       in,
+		OutDev:      out,
+		InEndpoint:  netip.MustParseAddrPort("192.168.1.1:9999"),
+		OutEndpoint: netip.MustParseAddrPort("192.168.2.1:7777"),
+		Packets:     [2]uint64{2, 1},
+		Bytes:       [2]uint64{56, 28},
+		Age:         2 * time.Second,
+		Idle:        time.Second,
+		State:       packet.CTEstablished,
+	}))
+
+	c.Track(testPacket(unix.IPPROTO_TCP, false), in, out)
+	Expect(entries(c, Filter{})).To(HaveLen(2))
+	tcp := entries(c, Filter{Proto: unix.IPPROTO_TCP})
+	Expect(tcp).To(HaveLen(1))
+	Expect(tcp[0].State).To(Equal(packet.CTNew))
+	Expect(tcp[0].TCPState).To(Equal(TCPSynSent))
+
+	n := 0
+	c.Range(func(Entry) bool {
+		n++
+		return false
+	})
+	Expect(n).To(Equal(1))
+
+	n = 0
+	for i := 0; i < Shards; i++ {
+		Expect(c.RangeShard(i, func(Entry) bool {
+			n++
+			return true
+		})).To(BeTrue())
+	}
+	Expect(n).To(Equal(2))
+}
+
+func TestFilter(t *testing.T) {
+	RegisterTestingT(t)
+	in, out := &testDevice{}, &testDevice{}
+	e := Entry{Key: testPacket(unix.IPPROTO_UDP, false).FlowKey(), InDev: in, OutDev: out}
+	for _, f := range []Filter{
+		{},
+		{Proto: unix.IPPROTO_UDP},
+		{Src: netip.MustParsePrefix("10.0.0.0/8"), Dst: netip.MustParsePrefix("10.0.0.2/32")},
+		{SrcPort: 210, DstPort: 80},
+		{Dev: in},
+		{Dev: out},
+	} {
+		Expect(f.Match(e)).To(BeTrue(), "%+v", f)
+	}
+	for _, f := range []Filter{
+		{Proto: unix.IPPROTO_TCP},
+		{Src: netip.MustParsePrefix("10.0.0.2/32")},
+		{Dst: netip.MustParsePrefix("fd00::/8")},
+		{SrcPort: 80},
+		{DstPort: 210},
+		{Dev: &testDevice{}},
+	} {
+		Expect(f.Match(e)).To(BeFalse(), "%+v", f)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	RegisterTestingT(t)
+	c := New()
+	var in, out devs.NetIO = &testDevice{}, &testDevice{}
+	for i := 0; i < 10; i++ {
+		c.Track(flowPacket(uint16(i)), in, out)
+	}
+	c.Track(testPacket(unix.IPPROTO_TCP, false), out, in)
+
+	Expect(c.Flush(Filter{Proto: unix.IPPROTO_TCP, Dev: &testDevice{}})).To(BeZero())
+	Expect(c.Flush(Filter{SrcPort: 3})).To(Equal(1))
+	_, ok := c.Lookup(flowPacket(3))
+	Expect(ok).To(BeFalse())
+	Expect(c.Flush(Filter{Proto: unix.IPPROTO_UDP})).To(Equal(9))
+	Expect(c.Len()).To(Equal(1))
+	Expect(c.Flush(Filter{})).To(Equal(1))
+	Expect(c.Len()).To(BeZero())
+}
+
+func TestImport(t *testing.T) {
+	RegisterTestingT(t)
+	c := New()
+	var now time.Duration = time.Hour
+	c.now = func() time.Duration { return now }
+	events, cancel := c.Subscribe(16)
+	defer cancel()
+	var in, out devs.NetIO = &testDevice{}, &testDevice{}
+
+	pkt := testPacket(unix.IPPROTO_UDP, false)
+	imported := Entry{
+		Key:         pkt.FlowKey(),
+		InDev:       in,
+		OutDev:      out,
+		InEndpoint:  netip.MustParseAddrPort("192.168.1.1:9999"),
+		OutEndpoint: netip.MustParseAddrPort("192.168.2.1:7777"),
+		Packets:     [2]uint64{5, 4},
+		Bytes:       [2]uint64{500, 400},
+		Age:         time.Minute,
+		Idle:        time.Second,
+		State:       packet.CTEstablished,
+		Synced:      true,
+	}
+	c.Import(imported)
+	ev := receive(events)
+	Expect(ev.Type).To(Equal(EventNew))
+	Expect(ev.Entry).To(Equal(imported))
+
+	// Replies of imported flows come from where the peer sent them and go
+	// back where it got them from.
+	reply := testPacket(unix.IPPROTO_UDP, true)
+	Expect(c.Inspect(reply, out).Tracked).To(BeFalse())
+	reply.Meta.Origin = netip.MustParseAddrPort("192.168.2.1:7777")
+	inspection := c.Inspect(reply, out)
+	Expect(inspection.Reply).To(BeTrue())
+	Expect(inspection.State).To(Equal(packet.CTEstablished))
+	Expect(inspection.Conn.InDev).To(BeIdenticalTo(in))
+	Expect(inspection.Conn.InEndpoint.String()).To(Equal("192.168.1.1:9999"))
+
+	// Flows seeing packets here are no longer the peer's.
+	ev = receive(events)
+	Expect(ev.Type).To(Equal(EventUpdate))
+	Expect(ev.Entry.Synced).To(BeFalse())
+	Expect(ev.Entry.Packets).To(Equal([2]uint64{5, 5}))
+	c.Forget(imported.Key)
+	c.Import(imported)
+	Expect(entries(c, Filter{})[0].Synced).To(BeFalse())
+
+	c.Track(flowPacket(7), in, out)
+	c.Delete(flowPacket(7))
+	imported.Key = flowPacket(7).FlowKey()
+	c.Import(imported)
+	imported.Idle = 2 * time.Second
+	c.Import(imported)
+	Expect(entries(c, Filter{SrcPort: 7})[0].Idle).To(Equal(2 * time.Second))
+	c.Forget(imported.Key)
+	Expect(c.Len()).To(Equal(1))
+}
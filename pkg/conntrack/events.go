@@ -0,0 +1,101 @@
+package conntrack
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// EventType tells what happened to a flow.
+type EventType uint8
+
+const (
+	// EventNew flows were just tracked.
+	EventNew EventType = iota + 1
+	// EventUpdate flows saw their first reply, changed tcp state or devices.
+	EventUpdate
+	// EventDestroy flows were removed, idle, evicted, deleted or flushed.
+	EventDestroy
+)
+
+var eventTypeNames = [...]string{"", "NEW", "UPDATE", "DESTROY"}
+
+// Valid reports whether the type is one of the types above.
+func (t EventType) Valid() bool {
+	return t >= EventNew && t <= EventDestroy
+}
+
+func (t EventType) String() string {
+	if int(t) < len(eventTypeNames) && t != 0 {
+		return eventTypeNames[t]
+	}
+	return "UNKNOWN"
+}
+
+// Event reports a change of a tracked flow, Entry being the flow right after
+// it.
+type Event struct {
+	Type  EventType
+	Entry Entry
+}
+
+// subscribers holds the channels events are sent to. The number of
+// subscribers is kept aside so flows change without locking when nobody
+// listens.
+type subscribers struct {
+	lock    sync.RWMutex
+	chans   map[chan Event]struct{}
+	count   atomic.Int32
+	dropped atomic.Uint64
+}
+
+// Subscribe returns a channel receiving the events of the table, buffering
+// up to size of them, and a function ending the subscription, which closes
+// the channel. Events of a flow are received in order, but they are dropped
+// rather than delay packets when the buffer is full.
+func (c *ConnTable) Subscribe(size int) (<-chan Event, func()) {
+	subs := &c.events
+	ch := make(chan Event, size)
+	subs.lock.Lock()
+	if subs.chans == nil {
+		subs.chans = make(map[chan Event]struct{})
+	}
+	subs.chans[ch] = struct{}{}
+	subs.count.Add(1)
+	subs.lock.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			subs.lock.Lock()
+			delete(subs.chans, ch)
+			subs.count.Add(-1)
+			close(ch)
+			subs.lock.Unlock()
+		})
+	}
+}
+
+// DroppedEvents returns how many events subscribers missed for having their
+// buffer full.
+func (c *ConnTable) DroppedEvents() uint64 {
+	return c.events.dropped.Load()
+}
+
+// emit sends the event of the entry to the subscribers. The shard of the
+// entry must be locked, so events of a flow are sent in order.
+func (c *ConnTable) emit(typ EventType, e *entry) {
+	subs := &c.events
+	if subs.count.Load() == 0 {
+		return
+	}
+	ev := Event{Type: typ, Entry: e.snapshot(c.now())}
+	subs.lock.RLock()
+	defer subs.lock.RUnlock()
+	for ch := range subs.chans {
+		select {
+		case ch <- ev:
+		default:
+			subs.dropped.Add(1)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package conntrack
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/packet"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+func receive(events <-chan Event) Event {
+	var ev Event
+	Eventually(events).Should(Receive(&ev))
+	return ev
+}
+
+func TestEvents(t *testing.T) {
+	RegisterTestingT(t)
+	c := New()
+	in, out := &testDevice{}, &testDevice{}
+	var now time.Duration
+	c.now = func() time.Duration { return now }
+	events, cancel := c.Subscribe(16)
+
+	handshake(c, in, out)
+	ev := receive(events)
+	Expect(ev.Type).To(Equal(EventNew))
+	Expect(ev.Entry.Key).To(Equal(testPacket(unix.IPPROTO_TCP, false).FlowKey()))
+	Expect(ev.Entry.TCPState).To(Equal(TCPSynSent))
+	ev = receive(events)
+	Expect(ev.Type).To(Equal(EventUpdate))
+	Expect(ev.Entry.State).To(Equal(packet.CTEstablished))
+	Expect(ev.Entry.TCPState).To(Equal(TCPEstablished))
+	Expect(ev.Entry.Packets).To(Equal([2]uint64{1, 1}))
+
+	// Packets not changing the flow send no event.
+	c.Inspect(tcpPacket(false, ack, 1001, 5001, 1000, 10), in)
+	Consistently(events, 10*time.Millisecond).ShouldNot(Receive())
+
+	c.Inspect(tcpPacket(false, finAck, 1011, 5001, 1000, 0), in)
+	Expect(receive(events).Entry.TCPState).To(Equal(TCPFinWait))
+
+	c.Track(testPacket(unix.IPPROTO_UDP, false), in, out)
+	Expect(receive(events).Type).To(Equal(EventNew))
+	now += DefaultTCPFinWaitTimeout + time.Second
+	Expect(c.Sweep()).To(Equal(2))
+	Expect(receive(events).Type).To(Equal(EventDestroy))
+	Expect(receive(events).Type).To(Equal(EventDestroy))
+
+	c.Track(flowPacket(1), in, out)
+	c.Delete(flowPacket(1))
+	Expect(receive(events).Type).To(Equal(EventNew))
+	ev = receive(events)
+	Expect(ev.Type).To(Equal(EventDestroy))
+	Expect(ev.Entry.Key).To(Equal(flowPacket(1).FlowKey()))
+
+	cancel()
+	cancel()
+	Eventually(events).Should(BeClosed())
+	c.Track(flowPacket(2), in, out)
+}
+
+func TestEventsDropped(t *testing.T) {
+	RegisterTestingT(t)
+	c := New()
+	events, cancel := c.Subscribe(1)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		c.Track(flowPacket(uint16(i)), &testDevice{}, &testDevice{})
+	}
+	Expect(c.DroppedEvents()).To(BeEquivalentTo(2))
+	Expect(receive(events).Entry.Key).To(Equal(flowPacket(0).FlowKey()))
+}
+
+func TestEventsConcurrent(t *testing.T) {
+	RegisterTestingT(t)
+	c := New()
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(2)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				pkt := flowPacket(uint16(g*1000 + i))
+				c.Track(pkt, &testDevice{}, &testDevice{})
+				c.Delete(pkt)
+			}
+		}(g)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				events, cancel := c.Subscribe(4)
+				select {
+				case <-events:
+				default:
+				}
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,208 @@
+package conntrack
+
+import (
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/packet"
+)
+
+// TCPState is the state of a tracked tcp connection.
+type TCPState uint8
+
+const (
+	TCPNone TCPState = iota
+	TCPSynSent
+	TCPEstablished
+	TCPFinWait
+	TCPTimeWait
+	TCPClosed
+
+	numTCPStates
+)
+
+var tcpStateNames = [numTCPStates]string{"NONE", "SYN_SENT", "ESTABLISHED", "FIN_WAIT", "TIME_WAIT", "CLOSED"}
+
+// Valid reports whether the state is one of the states above.
+func (s TCPState) Valid() bool {
+	return s < numTCPStates
+}
+
+func (s TCPState) String() string {
+	if s < numTCPStates {
+		return tcpStateNames[s]
+	}
+	return "UNKNOWN"
+}
+
+// Default idle timeouts of tcp connections by state. Established ones use
+// the tcp timeout.
+const (
+	DefaultTCPSynSentTimeout  = 2 * time.Minute
+	DefaultTCPFinWaitTimeout  = 2 * time.Minute
+	DefaultTCPTimeWaitTimeout = 2 * time.Minute
+	DefaultTCPClosedTimeout   = 10 * time.Second
+)
+
+// Least window of acknowledged data accepted below the end of the peer,
+// as in the Linux tracker.
+const minAckWindow = 66000
+
+// tcpDir tracks the sequence space of one direction of a connection, after
+// "Real Stateful TCP Packet Filtering in IP Filter" by Guido van Rooij.
+type tcpDir struct {
+	// Highest sequence number sent, plus one.
+	end uint32
+	// Highest sequence number the peer lets this side send, plus one.
+	maxEnd uint32
+	// Largest window advertised by this side, scaled.
+	maxWin uint32
+	scale  uint8
+	// Window scale option sent in the SYN, negative when absent.
+	wscale int8
+	fin    bool
+}
+
+// tcpConn follows the flags and sequence numbers of a tcp connection, the
+// original direction being 0 and the reply one 1.
+type tcpConn struct {
+	state TCPState
+	dirs  [2]tcpDir
+}
+
+// seqLess compares sequence numbers modulo 2^32.
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func seqMax(a, b uint32) uint32 {
+	if seqLess(a, b) {
+		return b
+	}
+	return a
+}
+
+// start starts following a connection from its first segment, which must be
+// a bare SYN.
+func (t *tcpConn) start(seg packet.TCPSegment) bool {
+	if seg.Flags&(packet.TCPFlagSYN|packet.TCPFlagACK|packet.TCPFlagRST|packet.TCPFlagFIN) != packet.TCPFlagSYN {
+		return false
+	}
+	end := seg.Seq + 1 + uint32(seg.DataLen)
+	*t = tcpConn{state: TCPSynSent}
+	t.dirs[0] = tcpDir{end: end, maxEnd: end, maxWin: max32(uint32(seg.Window), 1), wscale: seg.WScale}
+	return true
+}
+
+// pickup follows a connection learnt in the state from a peer. The sequence
+// numbers of each side are unknown, and not checked, until it sends a
+// segment.
+func (t *tcpConn) pickup(state TCPState, scales [2]uint8) {
+	*t = tcpConn{state: state}
+	for i := range t.dirs {
+		t.dirs[i].scale, t.dirs[i].wscale = scales[i], -1
+	}
+}
+
+// update follows a segment sent in the direction, returning false when it is
+// invalid, in which case the connection is left unchanged.
+func (t *tcpConn) update(seg packet.TCPSegment, dir int) bool {
+	switch t.state {
+	case TCPSynSent:
+		return t.synSent(seg, dir)
+	case TCPClosed:
+		return false
+	}
+
+	s, r := &t.dirs[dir], &t.dirs[1-dir]
+	if seg.Has(packet.TCPFlagSYN) {
+		// Only retransmitted SYN-ACKs are expected once established.
+		return dir == 1 && seg.Has(packet.TCPFlagACK) && seg.Seq+1+uint32(seg.DataLen) == s.end
+	}
+	end := seg.Seq + uint32(seg.DataLen)
+	if seg.Has(packet.TCPFlagFIN) {
+		end++
+	}
+	win := uint32(seg.Window) << s.scale
+	switch {
+	case s.maxWin == 0:
+		// First segment of a side of a picked up connection.
+		s.end, s.maxEnd, s.maxWin = end, end+r.maxWin, max32(win, 1)
+	case r.maxWin != 0 && !t.inWindow(seg, s, r):
+		return false
+	}
+
+	s.end = seqMax(s.end, end)
+	s.maxWin = max32(s.maxWin, win)
+	if seg.Has(packet.TCPFlagACK) {
+		r.maxEnd = seqMax(r.maxEnd, seg.Ack+max32(win, 1))
+	}
+
+	switch {
+	case seg.Has(packet.TCPFlagRST):
+		t.state = TCPClosed
+	case seg.Has(packet.TCPFlagFIN):
+		s.fin = true
+		t.state = TCPFinWait
+		if r.fin {
+			t.state = TCPTimeWait
+		}
+	}
+	return true
+}
+
+// synSent expects retransmitted SYNs from the original side and the SYN-ACK
+// or a reset acknowledging the SYN from the reply side.
+func (t *tcpConn) synSent(seg packet.TCPSegment, dir int) bool {
+	orig := &t.dirs[0]
+	if dir == 0 {
+		return seg.Flags&(packet.TCPFlagSYN|packet.TCPFlagACK|packet.TCPFlagRST) == packet.TCPFlagSYN
+	}
+	// The SYN of picked up connections is unknown.
+	if !seg.Has(packet.TCPFlagACK) || (orig.maxWin != 0 && seg.Ack != orig.end) {
+		return false
+	}
+	if seg.Has(packet.TCPFlagRST) {
+		t.state = TCPClosed
+		return true
+	}
+	if !seg.Has(packet.TCPFlagSYN) {
+		return false
+	}
+
+	reply := &t.dirs[1]
+	*reply = tcpDir{end: seg.Seq + 1 + uint32(seg.DataLen), wscale: seg.WScale}
+	if orig.wscale >= 0 && reply.wscale >= 0 {
+		orig.scale, reply.scale = uint8(orig.wscale), uint8(reply.wscale)
+	}
+	// Windows of SYN segments are never scaled.
+	reply.maxWin = max32(uint32(seg.Window), 1)
+	reply.maxEnd = reply.end + orig.maxWin
+	orig.maxEnd = seg.Ack + reply.maxWin
+	t.state = TCPEstablished
+	return true
+}
+
+// inWindow checks the segment sent by s to r is within the window r
+// advertised and acknowledges data r may have sent.
+func (t *tcpConn) inWindow(seg packet.TCPSegment, s, r *tcpDir) bool {
+	end := seg.Seq + uint32(seg.DataLen)
+	if seg.Has(packet.TCPFlagFIN) {
+		end++
+	}
+	if seqLess(s.maxEnd, end) || seqLess(seg.Seq, s.end-r.maxWin) {
+		return false
+	}
+	if seg.Has(packet.TCPFlagACK) {
+		if seqLess(r.end, seg.Ack) || seqLess(seg.Ack, r.end-max32(s.maxWin, minAckWindow)) {
+			return false
+		}
+	}
+	return true
+}
+
+func max32(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
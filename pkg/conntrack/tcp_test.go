@@ -0,0 +1,157 @@
+package conntrack
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/devs"
+	"github.com/mazdakn/uproxy/pkg/packet"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ack    = packet.TCPFlagACK
+	synAck = packet.TCPFlagSYN | packet.TCPFlagACK
+	finAck = packet.TCPFlagFIN | packet.TCPFlagACK
+	rstAck = packet.TCPFlagRST | packet.TCPFlagACK
+)
+
+// handshake tracks the flow of testPacket from its SYN between the devices
+// and completes the handshake, the client starting at sequence 1001 and the
+// server at 5001.
+func handshake(c *ConnTable, in, out devs.NetIO) {
+	c.Track(testPacket(unix.IPPROTO_TCP, false), in, out)
+	Expect(c.Inspect(testPacket(unix.IPPROTO_TCP, true), out).State).To(Equal(packet.CTEstablished))
+	Expect(c.Inspect(tcpPacket(false, ack, 1001, 5001, 1000, 0), in).State).To(Equal(packet.CTEstablished))
+}
+
+func tcpState(c *ConnTable) TCPState {
+	conn, ok := c.Lookup(testPacket(unix.IPPROTO_TCP, false))
+	Expect(ok).To(BeTrue())
+	return conn.TCPState()
+}
+
+func TestTCPStates(t *testing.T) {
+	RegisterTestingT(t)
+	c := New()
+	in, out := &testDevice{}, &testDevice{}
+	var now time.Duration
+	c.now = func() time.Duration { return now }
+
+	// Flows start with a SYN, retransmitted until the SYN-ACK.
+	Expect(c.Inspect(tcpPacket(false, ack, 1001, 5001, 1000, 0), in).State).To(Equal(packet.CTInvalid))
+	c.Track(tcpPacket(false, ack, 1001, 5001, 1000, 0), in, out)
+	Expect(c.Len()).To(BeZero())
+	c.Track(testPacket(unix.IPPROTO_TCP, false), in, out)
+	Expect(tcpState(c)).To(Equal(TCPSynSent))
+	Expect(c.Inspect(testPacket(unix.IPPROTO_TCP, false), in).State).To(Equal(packet.CTNew))
+	Expect(c.Inspect(tcpPacket(true, synAck, 5000, 77, 1000, 0), out).State).To(Equal(packet.CTInvalid))
+	Expect(c.Inspect(tcpPacket(false, ack, 1001, 5001, 1000, 0), in).State).To(Equal(packet.CTInvalid))
+
+	Expect(c.Inspect(testPacket(unix.IPPROTO_TCP, true), out).State).To(Equal(packet.CTEstablished))
+	Expect(tcpState(c)).To(Equal(TCPEstablished))
+	Expect(c.Inspect(testPacket(unix.IPPROTO_TCP, true), out).State).To(Equal(packet.CTEstablished))
+	Expect(c.Inspect(tcpPacket(false, ack, 1001, 5001, 1000, 100), in).State).To(Equal(packet.CTEstablished))
+	Expect(c.Inspect(tcpPacket(true, ack, 5001, 1101, 1000, 0), out).State).To(Equal(packet.CTEstablished))
+
+	// Established flows time out with the tcp timeout, closing ones sooner.
+	now += DefaultTCPTimeWaitTimeout + time.Second
+	Expect(c.Inspect(tcpPacket(false, finAck, 1101, 5001, 1000, 0), in).State).To(Equal(packet.CTEstablished))
+	Expect(tcpState(c)).To(Equal(TCPFinWait))
+	Expect(c.Inspect(tcpPacket(true, finAck, 5001, 1102, 1000, 0), out).State).To(Equal(packet.CTEstablished))
+	Expect(tcpState(c)).To(Equal(TCPTimeWait))
+	Expect(c.Inspect(tcpPacket(false, ack, 1102, 5002, 1000, 0), in).State).To(Equal(packet.CTEstablished))
+	now += DefaultTCPTimeWaitTimeout + time.Second
+	Expect(c.Sweep()).To(Equal(1))
+
+	// Resets close the flow, which a new SYN reopens.
+	handshake(c, in, out)
+	Expect(c.Inspect(tcpPacket(true, rstAck, 5001, 1001, 0, 0), out).State).To(Equal(packet.CTEstablished))
+	Expect(tcpState(c)).To(Equal(TCPClosed))
+	Expect(c.Inspect(tcpPacket(false, ack, 1001, 5001, 1000, 0), in).State).To(Equal(packet.CTInvalid))
+	Expect(c.Inspect(testPacket(unix.IPPROTO_TCP, false), in)).To(Equal(Inspection{State: packet.CTNew}))
+	Expect(c.Len()).To(BeZero())
+
+	handshake(c, in, out)
+	now += DefaultTCPClosedTimeout + time.Second
+	Expect(c.Sweep()).To(BeZero())
+	Expect(c.Inspect(tcpPacket(false, packet.TCPFlagRST, 1001, 0, 0, 0), in).State).To(Equal(packet.CTEstablished))
+	now += DefaultTCPClosedTimeout + time.Second
+	Expect(c.Sweep()).To(Equal(1))
+}
+
+func TestTCPWindow(t *testing.T) {
+	RegisterTestingT(t)
+	c := New()
+	in, out := &testDevice{}, &testDevice{}
+	handshake(c, in, out)
+
+	// The server advertised a window of 1000 bytes.
+	Expect(c.Inspect(tcpPacket(false, ack, 1001, 5001, 1000, 1000), in).State).To(Equal(packet.CTEstablished))
+	Expect(c.Inspect(tcpPacket(false, ack, 2001, 5001, 1000, 1), in).State).To(Equal(packet.CTInvalid))
+	Expect(c.Inspect(tcpPacket(false, ack, 1001, 5001, 1000, 1000), in).State).To(Equal(packet.CTEstablished), "retransmission")
+	Expect(c.Inspect(tcpPacket(false, ack, 1<<31, 5001, 1000, 10), in).State).To(Equal(packet.CTInvalid), "too old")
+
+	// Acknowledging data the server did not send is invalid.
+	Expect(c.Inspect(tcpPacket(false, ack, 2001, 6000, 1000, 0), in).State).To(Equal(packet.CTInvalid))
+
+	// The window moves with acknowledgements.
+	Expect(c.Inspect(tcpPacket(true, ack, 5001, 2001, 3000, 0), out).State).To(Equal(packet.CTEstablished))
+	Expect(c.Inspect(tcpPacket(false, ack, 2001, 5001, 1000, 3000), in).State).To(Equal(packet.CTEstablished))
+	Expect(tcpState(c)).To(Equal(TCPEstablished))
+
+	// Invalid segments leave the flow as it was.
+	Expect(c.Inspect(tcpPacket(false, packet.TCPFlagSYN, 9, 0, 1000, 0), in).State).To(Equal(packet.CTInvalid))
+	Expect(c.Inspect(tcpPacket(false, packet.TCPFlagRST, 99999, 0, 0, 0), in).State).To(Equal(packet.CTInvalid))
+	Expect(tcpState(c)).To(Equal(TCPEstablished))
+}
+
+func TestWindowScale(t *testing.T) {
+	RegisterTestingT(t)
+	syn := testPacket(unix.IPPROTO_TCP, false)
+	seg, ok := syn.TCPSegment()
+	Expect(ok).To(BeTrue())
+	seg.WScale = 7
+	var conn tcpConn
+	Expect(conn.start(seg)).To(BeTrue())
+
+	seg, _ = testPacket(unix.IPPROTO_TCP, true).TCPSegment()
+	seg.WScale = 2
+	Expect(conn.update(seg, 1)).To(BeTrue())
+	Expect(conn.dirs[0].scale).To(BeEquivalentTo(7))
+	Expect(conn.dirs[1].scale).To(BeEquivalentTo(2))
+
+	// The server window of 1000 is scaled to 4000 bytes.
+	seg, _ = tcpPacket(true, ack, 5001, 1001, 1000, 0).TCPSegment()
+	Expect(conn.update(seg, 1)).To(BeTrue())
+	seg, _ = tcpPacket(false, ack, 1001, 5001, 1000, 3500).TCPSegment()
+	Expect(conn.update(seg, 0)).To(BeTrue())
+}
+
+func TestTCPPickup(t *testing.T) {
+	RegisterTestingT(t)
+	c := New()
+	in, out := &testDevice{}, &testDevice{}
+	key := testPacket(unix.IPPROTO_TCP, false).FlowKey()
+	c.Import(Entry{Key: key, InDev: in, OutDev: out, State: packet.CTEstablished, TCPState: TCPEstablished, WindowScale: [2]uint8{0, 2}})
+
+	// Each side is followed from its first segment.
+	Expect(c.Inspect(tcpPacket(false, ack, 70000, 90000, 1000, 100), in).State).To(Equal(packet.CTEstablished))
+	Expect(c.Inspect(tcpPacket(false, ack, 70100, 90000, 1000, 100), in).State).To(Equal(packet.CTEstablished))
+	Expect(c.Inspect(tcpPacket(true, ack, 90000, 70200, 1000, 50), out).State).To(Equal(packet.CTEstablished))
+	Expect(c.Inspect(tcpPacket(true, ack, 90050, 70200, 1000, 900), out).State).To(Equal(packet.CTEstablished))
+	Expect(c.Inspect(tcpPacket(false, ack, 70200, 90950, 1000, 3000), in).State).To(Equal(packet.CTEstablished), "scaled window")
+
+	// Then their windows are checked.
+	Expect(c.Inspect(tcpPacket(false, ack, 80000, 90950, 1000, 0), in).State).To(Equal(packet.CTInvalid))
+	Expect(c.Inspect(tcpPacket(true, ack, 90950, 70200, 1000, 1100), out).State).To(Equal(packet.CTInvalid))
+	Expect(tcpState(c)).To(Equal(TCPEstablished))
+
+	// Flows picked up before their SYN-ACK accept it whatever it acknowledges.
+	c.Flush(Filter{})
+	c.Import(Entry{Key: key, InDev: in, OutDev: out, State: packet.CTNew, TCPState: TCPSynSent})
+	Expect(c.Inspect(tcpPacket(true, synAck, 5000, 1234, 1000, 0), out).State).To(Equal(packet.CTEstablished))
+	Expect(c.Inspect(tcpPacket(false, ack, 1234, 5001, 1000, 10), in).State).To(Equal(packet.CTEstablished))
+	Expect(tcpState(c)).To(Equal(TCPEstablished))
+}
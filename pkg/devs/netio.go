@@ -1,15 +1,9 @@
 package devs
 
-import "github.com/mazdakn/uproxy/pkg/packet"
+import (
+	"time"
 
-const (
-	NetIO_Drop = iota
-	NetIO_UDPServer
-	NetIO_Local
-	NetIO_Proxy
-
-	NetIO_Max
-	NetIO_Error
+	"github.com/mazdakn/uproxy/pkg/packet"
 )
 
 type NetIO interface {
@@ -21,3 +15,49 @@ type NetIO interface {
 	Ingress() chan<- *packet.Packet
 	Egress() <-chan *packet.Packet
 }
+
+// Reader is a NetIO backed by a socket or file descriptor packets can be
+// read from. The engine runs a loop moving packets from Read to Received.
+type Reader interface {
+	NetIO
+
+	Received() chan<- *packet.Packet
+	Read(pkt *packet.Packet, deadline time.Time) (int, error)
+}
+
+// Writer is a NetIO packets can be written to. The engine runs a loop moving
+// packets from Pending to Write.
+type Writer interface {
+	NetIO
+
+	Pending() <-chan *packet.Packet
+	Write(pkt *packet.Packet, deadline time.Time) (int, error)
+}
+
+// BatchReader is a Reader able to read several packets in one call. Every
+// packet in a batch carries its own metadata.
+type BatchReader interface {
+	Reader
+
+	BatchSize() int
+	ReadBatch(pkts []*packet.Packet, deadline time.Time) (int, error)
+}
+
+// BatchWriter is a Writer able to write several packets in one call. Every
+// packet in a batch is sent according to its own metadata.
+type BatchWriter interface {
+	Writer
+
+	BatchSize() int
+	WriteBatch(pkts []*packet.Packet, deadline time.Time) (int, error)
+}
+
+// MultiQueue is a NetIO made of several queues, each of them run by the
+// engine as a device of its own. Packets of a flow are always steered to the
+// same queue to keep them in order.
+type MultiQueue interface {
+	NetIO
+
+	NumQueues() int
+	Queue(i int) NetIO
+}
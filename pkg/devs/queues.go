@@ -0,0 +1,35 @@
+package devs
+
+import "github.com/mazdakn/uproxy/pkg/packet"
+
+// Queues holds the pair of channels connecting a device to the engine.
+// Ingress carries packets the engine wants written to the device, egress
+// carries packets read from the device towards the engine.
+type Queues struct {
+	ingress, egress chan *packet.Packet
+}
+
+func NewQueues(capacity int) Queues {
+	return Queues{
+		ingress: make(chan *packet.Packet, capacity),
+		egress:  make(chan *packet.Packet, capacity),
+	}
+}
+
+func (q Queues) Ingress() chan<- *packet.Packet {
+	return q.ingress
+}
+
+func (q Queues) Egress() <-chan *packet.Packet {
+	return q.egress
+}
+
+// Pending returns the device side of ingress, drained by the writer loop.
+func (q Queues) Pending() <-chan *packet.Packet {
+	return q.ingress
+}
+
+// Received returns the device side of egress, filled by the reader loop.
+func (q Queues) Received() chan<- *packet.Packet {
+	return q.egress
+}
@@ -0,0 +1,149 @@
+package devs
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+)
+
+// Factory creates a device from its configuration. The index identifies the
+// device in the registry and is recorded in the metadata of the packets it
+// reads.
+type Factory func(conf config.Device, index uint8) (NetIO, error)
+
+var factories = map[string]Factory{}
+
+// Register makes a device type available to registries. It is meant to be
+// called from init functions and panics on duplicate types.
+func Register(typ string, factory Factory) {
+	if _, exists := factories[typ]; exists {
+		panic(fmt.Sprintf("device type %v already registered", typ))
+	}
+	factories[typ] = factory
+}
+
+type entry struct {
+	name string
+	typ  string
+	dev  NetIO
+}
+
+// Registry holds the named devices of an engine. Devices are identified on
+// the hot path by their index.
+type Registry struct {
+	entries []entry
+	names   map[string]uint8
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		names: make(map[string]uint8),
+	}
+}
+
+// Create builds every configured device with the factory of its type.
+func (r *Registry) Create(confs []config.Device) error {
+	for _, conf := range confs {
+		factory, ok := factories[conf.Type]
+		if !ok {
+			return fmt.Errorf("unknown type %q for device %q", conf.Type, conf.Name)
+		}
+		if err := r.checkName(conf.Name); err != nil {
+			return err
+		}
+		dev, err := factory(conf, uint8(len(r.entries)))
+		if err != nil {
+			return fmt.Errorf("failed to create device %q - err: %w", conf.Name, err)
+		}
+		r.Add(conf.Name, conf.Type, dev)
+	}
+	return nil
+}
+
+func (r *Registry) checkName(name string) error {
+	if name == "" {
+		return fmt.Errorf("device name is required")
+	}
+	if _, exists := r.names[name]; exists {
+		return fmt.Errorf("duplicate device name %q", name)
+	}
+	if len(r.entries) > math.MaxUint8 {
+		return fmt.Errorf("too many devices, at most %v are supported", math.MaxUint8+1)
+	}
+	return nil
+}
+
+// Add registers an already created device and returns its index.
+func (r *Registry) Add(name, typ string, dev NetIO) uint8 {
+	index := uint8(len(r.entries))
+	r.entries = append(r.entries, entry{name: name, typ: typ, dev: dev})
+	r.names[name] = index
+	return index
+}
+
+// Device returns the device at the index, or nil if there is none.
+func (r *Registry) Device(index uint8) NetIO {
+	if int(index) >= len(r.entries) {
+		return nil
+	}
+	return r.entries[index].dev
+}
+
+func (r *Registry) Name(index uint8) string {
+	if int(index) >= len(r.entries) {
+		return ""
+	}
+	return r.entries[index].name
+}
+
+// NameOf returns the name of the device, or "" if it is not registered.
+func (r *Registry) NameOf(dev NetIO) string {
+	for _, e := range r.entries {
+		if e.dev != nil && e.dev == dev {
+			return e.name
+		}
+	}
+	return ""
+}
+
+func (r *Registry) Len() int {
+	return len(r.entries)
+}
+
+// Remove drops the device at the index, for instance after it failed to
+// start. The index is not reused.
+func (r *Registry) Remove(index uint8) {
+	r.entries[index].dev = nil
+}
+
+// Resolve returns the index of the device a policy refers to. A named device
+// must exist and, if typ is set, be of that type. Without a name, there must
+// be exactly one device of type typ.
+func (r *Registry) Resolve(name, typ string) (uint8, error) {
+	if name != "" {
+		index, ok := r.names[name]
+		if !ok {
+			return 0, fmt.Errorf("device %q does not exist", name)
+		}
+		if typ != "" && r.entries[index].typ != typ {
+			return 0, fmt.Errorf("device %q is of type %v, expected %v", name, r.entries[index].typ, typ)
+		}
+		return index, nil
+	}
+
+	found := -1
+	for i, e := range r.entries {
+		if e.typ != typ {
+			continue
+		}
+		if found >= 0 {
+			return 0, fmt.Errorf("several devices of type %v, a device name is required", typ)
+		}
+		found = i
+	}
+	if found < 0 {
+		return 0, fmt.Errorf("no device of type %v", typ)
+	}
+	return uint8(found), nil
+}
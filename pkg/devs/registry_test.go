@@ -0,0 +1,63 @@
+package devs
+
+import (
+	"testing"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	. "github.com/onsi/gomega"
+)
+
+type nullDevice struct {
+	Queues
+}
+
+func (n *nullDevice) Start() error { return nil }
+func (n *nullDevice) Stop() error  { return nil }
+func (n *nullDevice) Name() string { return "null" }
+
+func init() {
+	Register("null", func(_ config.Device, _ uint8) (NetIO, error) {
+		return &nullDevice{Queues: NewQueues(1)}, nil
+	})
+}
+
+func TestRegistryCreate(t *testing.T) {
+	RegisterTestingT(t)
+	r := NewRegistry()
+	Expect(r.Create([]config.Device{
+		{Name: "a", Type: "null"},
+		{Name: "b", Type: "null"},
+	})).To(Succeed())
+	Expect(r.Len()).To(Equal(2))
+	Expect(r.Name(1)).To(Equal("b"))
+	Expect(r.Device(2)).To(BeNil())
+
+	Expect(r.Create([]config.Device{{Name: "a", Type: "null"}})).To(MatchError(ContainSubstring("duplicate")))
+	Expect(r.Create([]config.Device{{Name: "c", Type: "bogus"}})).To(MatchError(ContainSubstring("unknown type")))
+	Expect(r.Create([]config.Device{{Type: "null"}})).To(MatchError(ContainSubstring("name is required")))
+}
+
+func TestRegistryResolve(t *testing.T) {
+	RegisterTestingT(t)
+	r := NewRegistry()
+	r.Add("udp1", config.DeviceUDP, &nullDevice{})
+	r.Add("udp2", config.DeviceUDP, &nullDevice{})
+	r.Add("local", config.DeviceTun, &nullDevice{})
+
+	index, err := r.Resolve("udp2", config.DeviceUDP)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(index).To(BeEquivalentTo(1))
+
+	index, err = r.Resolve("", config.DeviceTun)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(index).To(BeEquivalentTo(2))
+
+	_, err = r.Resolve("", config.DeviceUDP)
+	Expect(err).To(MatchError(ContainSubstring("several devices")))
+	_, err = r.Resolve("", config.DeviceDrop)
+	Expect(err).To(MatchError(ContainSubstring("no device")))
+	_, err = r.Resolve("missing", "")
+	Expect(err).To(MatchError(ContainSubstring("does not exist")))
+	_, err = r.Resolve("local", config.DeviceUDP)
+	Expect(err).To(MatchError(ContainSubstring("expected udp")))
+}
@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// adminHandler returns the handler of the admin http server, which reports
+// the engine status as json. Tracked flows are listed by GET /conntrack,
+// removed by DELETE /conntrack and their changes streamed as json lines by
+// /conntrack/events, all taking filter query parameters.
+func (e *engine) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status/health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, e.HealthStatus())
+	})
+	mux.HandleFunc("/stats/policies", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, e.PolicyStats())
+	})
+	mux.HandleFunc("/conntrack", e.serveConntrack)
+	mux.HandleFunc("/conntrack/events", e.serveConntrackEvents)
+	return mux
+}
+
+// Size of the event buffer of every /conntrack/events client.
+const connEventBuffer = 1024
+
+func (e *engine) serveConntrack(w http.ResponseWriter, r *http.Request) {
+	f, err := e.connFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, e.ConnEntries(f))
+	case http.MethodDelete:
+		writeJSON(w, map[string]int{"flushed": e.conntrack.Flush(f)})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveConntrackEvents streams the events of the flows the query selects
+// until the client goes away or the server shuts down. Events are dropped
+// when the client does not keep up.
+func (e *engine) serveConntrackEvents(w http.ResponseWriter, r *http.Request) {
+	f, err := e.connFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	events, cancel := e.conntrack.Subscribe(connEventBuffer)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-events:
+			if !f.Match(ev.Entry) {
+				continue
+			}
+			if err := enc.Encode(ConnEvent{Type: ev.Type.String(), Flow: newConnEntry(ev.Entry, e.devices)}); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.WithError(err).Error("Failed to write admin response")
+	}
+}
+
+// serveAdmin runs the admin http server on the listener until the context
+// is cancelled.
+func (e *engine) serveAdmin(ctx context.Context, lis net.Listener, wg *sync.WaitGroup) {
+	defer wg.Done()
+	srv := &http.Server{
+		Handler:           e.adminHandler(),
+		ReadHeaderTimeout: ioTimeout,
+		// Ends event streams on shutdown.
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	logrus.Infof("Serving admin api on %v", lis.Addr())
+	if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logrus.WithError(err).Error("Admin api stopped")
+	}
+}
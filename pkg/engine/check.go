@@ -0,0 +1,27 @@
+package engine
+
+import (
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/devs"
+)
+
+// compileConfig creates the devices of the config, without starting them,
+// and compiles its policies.
+func compileConfig(conf *config.Config) (*devs.Registry, *PolicyTable, error) {
+	devices := devs.NewRegistry()
+	if err := devices.Create(conf.DeviceConfigs()); err != nil {
+		return nil, nil, err
+	}
+	table := newPolicyTable()
+	if err := table.ParseConfig(conf, devices); err != nil {
+		return nil, nil, err
+	}
+	return devices, table, nil
+}
+
+// CheckConfig compiles the config the way Run does without starting
+// anything, catching what validation cannot see, like missing set files.
+func CheckConfig(conf *config.Config) error {
+	_, _, err := compileConfig(conf)
+	return err
+}
@@ -0,0 +1,103 @@
+package engine
+
+import (
+	"github.com/mazdakn/uproxy/pkg/packet"
+	"golang.org/x/sys/unix"
+)
+
+// ruleSet holds the indexes, in configured order, of the policies sharing a
+// destination and source prefix. Policies matching a protocol and a list of
+// single destination ports are bucketed under each of them, the others are
+// kept in rest.
+type ruleSet struct {
+	ports map[uint32][]int32
+	rest  []int32
+}
+
+func portKey(proto byte, port uint16) uint32 {
+	return uint32(proto)<<16 | uint32(port)
+}
+
+// match returns the index of the first policy of the set matching the
+// packet, if lower than best, or best otherwise.
+func (r *ruleSet) match(policies []Policy, pkt *packet.Packet, key uint32, best int32) int32 {
+	if r.ports != nil {
+		best = firstMatch(r.ports[key], policies, pkt, best)
+	}
+	return firstMatch(r.rest, policies, pkt, best)
+}
+
+func firstMatch(indexes []int32, policies []Policy, pkt *packet.Packet, best int32) int32 {
+	for _, i := range indexes {
+		if i >= best {
+			break
+		}
+		if policies[i].Match(pkt) {
+			return i
+		}
+	}
+	return best
+}
+
+// srcLevel is the second level of the classifier, looking up source
+// prefixes among the policies of a destination prefix.
+type srcLevel struct {
+	src prefixTrie[ruleSet]
+}
+
+// classifier finds the first matching policy with a trie on destination
+// prefixes, each node holding a trie on source prefixes whose nodes bucket
+// policies by protocol and port. Every prefix containing the packet
+// addresses is visited and the lowest matching index wins, so the result is
+// the same as scanning the policies in order.
+type classifier struct {
+	policies []Policy
+	dst      prefixTrie[srcLevel]
+}
+
+func newClassifier(policies []Policy) *classifier {
+	c := &classifier{policies: policies}
+	for i := range policies {
+		p := &policies[i]
+		dstKey, dstLen := prefixFromNet(p.DstNet)
+		srcKey, srcLen := prefixFromNet(p.SrcNet)
+		rules := c.dst.insert(dstKey, dstLen).src.insert(srcKey, srcLen)
+		if ports, ok := p.DstPorts.single(); ok {
+			if rules.ports == nil {
+				rules.ports = make(map[uint32][]int32)
+			}
+			for _, port := range ports {
+				key := portKey(p.Proto, port)
+				rules.ports[key] = append(rules.ports[key], int32(i))
+			}
+			continue
+		}
+		rules.rest = append(rules.rest, int32(i))
+	}
+	return c
+}
+
+func (c *classifier) Match(pkt *packet.Packet) *Policy {
+	if len(c.policies) == 0 {
+		return nil
+	}
+	var key uint32
+	if proto := pkt.Protocol(); proto == unix.IPPROTO_TCP || proto == unix.IPPROTO_UDP {
+		key = portKey(proto, pkt.DstPort())
+	}
+	srcKey := keyFromIP(pkt.SrcAddr())
+	best := int32(len(c.policies))
+
+	c.dst.walk(keyFromIP(pkt.DstAddr()), func(level *srcLevel) bool {
+		level.src.walk(srcKey, func(rules *ruleSet) bool {
+			best = rules.match(c.policies, pkt, key, best)
+			return true
+		})
+		return true
+	})
+
+	if int(best) == len(c.policies) {
+		return nil
+	}
+	return &c.policies[best]
+}
@@ -0,0 +1,31 @@
+package engine
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/packet"
+)
+
+type connection struct {
+	Conn       net.Conn
+	lastActive time.Time
+}
+
+type Connections struct {
+	lock  sync.Mutex
+	conns map[packet.FlowKey]*connection
+}
+
+func newConnections() *Connections {
+	return &Connections{
+		conns: make(map[packet.FlowKey]*connection),
+	}
+}
+
+func (c *Connections) Lookup(pkt *packet.Packet) *connection {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.conns[pkt.FlowKey()]
+}
@@ -0,0 +1,203 @@
+package engine
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/conntrack"
+	"github.com/mazdakn/uproxy/pkg/devs"
+	"github.com/mazdakn/uproxy/pkg/packet"
+	"github.com/sirupsen/logrus"
+)
+
+// setupConntrack applies the configured idle timeouts and maximum number of
+// entries to the conntrack table, sets how often it is swept and how it is
+// synced with a peer.
+func (e *engine) setupConntrack() error {
+	e.sweepInterval = conntrack.DefaultSweepInterval
+	e.ctSync = nil
+	if e.conf.Conntrack == nil {
+		return nil
+	}
+	for name, value := range e.conf.Conntrack.Timeouts {
+		var proto byte
+		if !strings.EqualFold(name, "other") {
+			var err error
+			proto, err = parseProto(name)
+			if err != nil {
+				return fmt.Errorf("invalid conntrack timeout protocol %q - err: %w", name, err)
+			}
+		}
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid conntrack timeout %q for %v", value, name)
+		}
+		e.conntrack.SetTimeout(proto, timeout)
+	}
+	if max := e.conf.Conntrack.MaxEntries; max != 0 {
+		if max < 0 {
+			return fmt.Errorf("invalid conntrack max entries %v", max)
+		}
+		e.conntrack.SetMaxEntries(max)
+	}
+	if value := e.conf.Conntrack.SweepInterval; value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("invalid conntrack sweep interval %q", value)
+		}
+		e.sweepInterval = interval
+	}
+	var err error
+	e.ctSync, err = newSyncer(e.conf.Conntrack.Sync)
+	return err
+}
+
+// routeTracked inspects the packet in the conntrack table, setting its
+// state. It returns the device the packet is sent back to if it is a reply
+// of a flow tracked by a stateful policy, setting its endpoint, and false
+// for invalid packets of tracked flows, which are dropped. Packets only
+// count as replies when they come in on the device and from the endpoint
+// the flow went out to, others going through the policies.
+func (e *engine) routeTracked(pkt *packet.Packet) (devs.NetIO, bool) {
+	in := e.conntrack.Inspect(pkt, e.devices.Device(pkt.Meta.SrcIndex))
+	pkt.Meta.CTState = in.State
+	if in.Tracked && in.State == packet.CTInvalid {
+		if logrus.IsLevelEnabled(logrus.DebugLevel) {
+			logrus.Debugf("Dropping invalid packet %v of flow in state %v", pkt, in.Conn.TCPState())
+		}
+		return nil, false
+	}
+	if !in.Reply {
+		return nil, true
+	}
+	pkt.Meta.Endpoint = in.Conn.InEndpoint
+	if logrus.IsLevelEnabled(logrus.DebugLevel) {
+		logrus.Debugf("Sending reply %v back to %v via endpoint %v", pkt, in.Conn.InDev.Name(), pkt.Meta.Endpoint)
+	}
+	return in.Conn.InDev, true
+}
+
+// ConnEntry is a tracked flow as reported by the admin api.
+type ConnEntry struct {
+	Proto string         `json:"proto"`
+	Src   netip.AddrPort `json:"src"`
+	Dst   netip.AddrPort `json:"dst"`
+	// Devices the flow comes from and goes to.
+	InDev  string `json:"inDev"`
+	OutDev string `json:"outDev"`
+	// Endpoint replies are sent to, when InDev is a udp device.
+	Endpoint     string        `json:"endpoint,omitempty"`
+	Packets      uint64        `json:"packets"`
+	Bytes        uint64        `json:"bytes"`
+	ReplyPackets uint64        `json:"replyPackets"`
+	ReplyBytes   uint64        `json:"replyBytes"`
+	Age          time.Duration `json:"age"`
+	Idle         time.Duration `json:"idle"`
+	State        string        `json:"state"`
+	// Empty for flows other than tcp.
+	TCPState string `json:"tcpState,omitempty"`
+	// Set for flows learnt from the sync peer that saw no packet here.
+	Synced bool `json:"synced,omitempty"`
+}
+
+// newConnEntry reports the flow, naming its devices as configured.
+func newConnEntry(e conntrack.Entry, devices *devs.Registry) ConnEntry {
+	entry := ConnEntry{
+		Proto:        e.Key.ProtoName(),
+		Src:          e.Key.SrcAddrPort(),
+		Dst:          e.Key.DstAddrPort(),
+		InDev:        devices.NameOf(e.InDev),
+		OutDev:       devices.NameOf(e.OutDev),
+		Packets:      e.Packets[0],
+		Bytes:        e.Bytes[0],
+		ReplyPackets: e.Packets[1],
+		ReplyBytes:   e.Bytes[1],
+		Age:          e.Age,
+		Idle:         e.Idle,
+		State:        e.State.String(),
+		Synced:       e.Synced,
+	}
+	if e.InEndpoint.IsValid() {
+		entry.Endpoint = e.InEndpoint.String()
+	}
+	if e.TCPState != conntrack.TCPNone {
+		entry.TCPState = e.TCPState.String()
+	}
+	return entry
+}
+
+// ConnEvent is a change of a tracked flow as streamed by the admin api.
+type ConnEvent struct {
+	// NEW, UPDATE or DESTROY.
+	Type string    `json:"type"`
+	Flow ConnEntry `json:"flow"`
+}
+
+// ConnEntries returns the tracked flows the filter selects, oldest first.
+func (e *engine) ConnEntries(f conntrack.Filter) []ConnEntry {
+	entries := []ConnEntry{}
+	e.conntrack.Range(func(entry conntrack.Entry) bool {
+		if f.Match(entry) {
+			entries = append(entries, newConnEntry(entry, e.devices))
+		}
+		return true
+	})
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Age > entries[j].Age })
+	return entries
+}
+
+// connFilter parses the flows selected by the query parameters proto, src,
+// dst, sport, dport and dev, addresses being either single ones or
+// prefixes, and dev the name of a device.
+func (e *engine) connFilter(query url.Values) (conntrack.Filter, error) {
+	var f conntrack.Filter
+	var err error
+	if f.Proto, err = parseProto(query.Get("proto")); err != nil {
+		return f, err
+	}
+	for _, p := range []struct {
+		name   string
+		prefix *netip.Prefix
+	}{{"src", &f.Src}, {"dst", &f.Dst}} {
+		value := query.Get(p.name)
+		if value == "" {
+			continue
+		}
+		if *p.prefix, err = netip.ParsePrefix(value); err == nil {
+			*p.prefix = p.prefix.Masked()
+			continue
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return f, fmt.Errorf("invalid %v address %q", p.name, value)
+		}
+		*p.prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	for _, p := range []struct {
+		name string
+		port *uint16
+	}{{"sport", &f.SrcPort}, {"dport", &f.DstPort}} {
+		value := query.Get(p.name)
+		if value == "" {
+			continue
+		}
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return f, fmt.Errorf("invalid %v %q", p.name, value)
+		}
+		*p.port = uint16(port)
+	}
+	if name := query.Get("dev"); name != "" {
+		index, err := e.devices.Resolve(name, "")
+		if err != nil {
+			return f, err
+		}
+		f.Dev = e.devices.Device(index)
+	}
+	return f, nil
+}
@@ -0,0 +1,233 @@
+package engine
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/devs"
+	"github.com/mazdakn/uproxy/pkg/packet"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+// testReply returns the reply to testIPv4UDP, from 10.0.0.2:80 to
+// 10.0.0.1:1234.
+func testReply() []byte {
+	data := testIPv4UDP()
+	copy(data[12:16], testIPv4UDP()[16:20])
+	copy(data[16:20], testIPv4UDP()[12:16])
+	copy(data[20:22], testIPv4UDP()[22:24])
+	copy(data[22:24], testIPv4UDP()[20:22])
+	return data
+}
+
+func TestRouteStateful(t *testing.T) {
+	RegisterTestingT(t)
+	e := New(&config.Config{MaxBufferSize: 1600})
+	e.devices = testRegistry()
+	local := &memDevice{Queues: devs.NewQueues(queueCapacity)}
+	localIndex := e.devices.Add("local", config.DeviceTun, local)
+	otherIndex := e.devices.Add("other", config.DeviceTun, &memDevice{Queues: devs.NewQueues(queueCapacity)})
+	drop := e.devices.Device(0)
+	tunnel := e.devices.Device(1)
+
+	policies := newPolicyTable()
+	Expect(policies.ParseConfig(&config.Config{Policies: []config.Policy{
+		{SrcAddr: "10.0.0.1/32", Action: "route=127.0.0.1:9000", Device: "tunnel", Stateful: true},
+		{DstAddr: "0.0.0.0/0", Action: "drop"},
+	}}, e.devices)).To(Succeed())
+	e.storePolicies(policies)
+	routeReply := func(index uint8, origin string) devs.NetIO {
+		reply := testPacket(testReply())
+		reply.Meta.SrcIndex = index
+		if origin != "" {
+			reply.Meta.Origin = netip.MustParseAddrPort(origin)
+		}
+		return e.route(reply)
+	}
+
+	// Replies are dropped until the flow is seen.
+	Expect(routeReply(1, "127.0.0.1:9000")).To(BeIdenticalTo(drop))
+
+	pkt := testPacket(testIPv4UDP())
+	pkt.Meta.SrcIndex = localIndex
+	Expect(e.route(pkt)).To(BeIdenticalTo(tunnel))
+
+	// Replies only come from where the flow was sent, others going
+	// through the policies.
+	Expect(routeReply(otherIndex, "")).To(BeIdenticalTo(drop))
+	Expect(routeReply(1, "127.0.0.1:9001")).To(BeIdenticalTo(drop))
+	reply := testPacket(testReply())
+	reply.Meta.SrcIndex = 1
+	reply.Meta.Origin = netip.MustParseAddrPort("127.0.0.1:9000")
+	Expect(e.route(reply)).To(BeIdenticalTo(local))
+	Expect(reply.Meta.Endpoint).To(BeNil())
+
+	// Other flows are not let in.
+	data := testReply()
+	data[21] = 81
+	other := testPacket(data)
+	Expect(e.route(other)).To(BeIdenticalTo(drop))
+}
+
+// testTCP returns a tcp segment from 10.0.0.1:1234 to 10.0.0.2:80, or the
+// other way around when reply is set, with a window of 1000 bytes.
+func testTCP(reply bool, flags byte, seq, ack uint32) []byte {
+	data := make([]byte, 40)
+	copy(data, testIPv4UDP())
+	if reply {
+		copy(data, testReply())
+	}
+	data[3] = 40
+	data[9] = unix.IPPROTO_TCP
+	binary.BigEndian.PutUint32(data[24:28], seq)
+	binary.BigEndian.PutUint32(data[28:32], ack)
+	data[32] = 5 << 4
+	data[33] = flags
+	binary.BigEndian.PutUint16(data[34:36], 1000)
+	return data
+}
+
+func TestRouteCTState(t *testing.T) {
+	RegisterTestingT(t)
+	e := New(&config.Config{MaxBufferSize: 1600})
+	e.devices = testRegistry()
+	local := &memDevice{Queues: devs.NewQueues(queueCapacity)}
+	localIndex := e.devices.Add("local", config.DeviceTun, local)
+	drop := e.devices.Device(0)
+	tunnel := e.devices.Device(1)
+
+	policies := newPolicyTable()
+	Expect(policies.ParseConfig(&config.Config{Policies: []config.Policy{
+		{Name: "egress", SrcAddr: "10.0.0.1/32", CTState: "new", Action: "route=127.0.0.1:9000", Device: "tunnel", Stateful: true},
+		{Name: "invalid", CTState: "invalid", Action: "reject"},
+	}}, e.devices)).To(Succeed())
+	e.storePolicies(policies)
+	route := func(data []byte, index uint8) devs.NetIO {
+		pkt := testPacket(data)
+		pkt.Meta.SrcIndex = index
+		if index == 1 {
+			pkt.Meta.Origin = netip.MustParseAddrPort("127.0.0.1:9000")
+		}
+		return e.route(pkt)
+	}
+
+	// Flows start with a SYN, segments of untracked flows are invalid.
+	Expect(route(testTCP(false, packet.TCPFlagACK, 1001, 5001), localIndex)).To(BeIdenticalTo(drop))
+	Expect(route(testTCP(false, packet.TCPFlagSYN, 1000, 0), localIndex)).To(BeIdenticalTo(tunnel))
+	Expect(route(testTCP(true, packet.TCPFlagSYN|packet.TCPFlagACK, 5000, 1001), 1)).To(BeIdenticalTo(local))
+	Expect(route(testTCP(false, packet.TCPFlagACK, 1001, 5001), localIndex)).To(BeIdenticalTo(drop),
+		"established packets only match policies with ctstate established")
+
+	// Segments out of the window of a tracked flow are discarded.
+	Expect(route(testTCP(true, packet.TCPFlagACK, 9000, 1001), 1)).To(BeNil())
+	Expect(route(testTCP(true, packet.TCPFlagACK, 5001, 1001), 1)).To(BeIdenticalTo(local))
+
+	pkt := testPacket(testTCP(false, packet.TCPFlagACK, 1001, 5001))
+	pkt.Meta.CTState = packet.CTEstablished
+	Expect(policies.policies[0].explain(pkt)).To(Equal("conntrack state established not in new"))
+}
+
+func TestSetupConntrack(t *testing.T) {
+	RegisterTestingT(t)
+	e := New(&config.Config{Conntrack: &config.Conntrack{
+		Timeouts:      map[string]string{"udp": "10s", "other": "1m"},
+		MaxEntries:    1000,
+		SweepInterval: "1s",
+	}})
+	Expect(e.setupConntrack()).To(Succeed())
+	Expect(e.sweepInterval).To(Equal(time.Second))
+	Expect(New(&config.Config{}).setupConntrack()).To(Succeed())
+
+	for _, timeouts := range []map[string]string{{"sctpx": "10s"}, {"udp": "-1s"}, {"tcp": "x"}} {
+		e := New(&config.Config{Conntrack: &config.Conntrack{Timeouts: timeouts}})
+		Expect(e.setupConntrack()).NotTo(Succeed(), "%v", timeouts)
+	}
+	for _, conf := range []config.Conntrack{{MaxEntries: -1}, {SweepInterval: "0s"}} {
+		Expect(New(&config.Config{Conntrack: &conf}).setupConntrack()).NotTo(Succeed(), "%+v", conf)
+	}
+}
+
+func TestConntrackAdmin(t *testing.T) {
+	RegisterTestingT(t)
+	e := New(&config.Config{MaxBufferSize: 1600})
+	e.devices = testRegistry()
+	local := &memDevice{Queues: devs.NewQueues(queueCapacity)}
+	localIndex := e.devices.Add("local", config.DeviceTun, local)
+	policies := newPolicyTable()
+	Expect(policies.ParseConfig(&config.Config{Policies: []config.Policy{
+		{SrcAddr: "10.0.0.1/32", Action: "route=127.0.0.1:9000", Device: "tunnel", Stateful: true},
+	}}, e.devices)).To(Succeed())
+	e.storePolicies(policies)
+
+	srv := httptest.NewServer(e.adminHandler())
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+"/conntrack/events?proto=udp", nil)
+	Expect(err).NotTo(HaveOccurred())
+	resp, err := http.DefaultClient.Do(req)
+	Expect(err).NotTo(HaveOccurred())
+	defer resp.Body.Close()
+	stream := json.NewDecoder(resp.Body)
+
+	route := func(data []byte, index uint8) {
+		pkt := testPacket(data)
+		pkt.Meta.SrcIndex = index
+		if index == 1 {
+			pkt.Meta.Origin = netip.MustParseAddrPort("127.0.0.1:9000")
+		}
+		Expect(e.route(pkt)).NotTo(BeNil())
+	}
+	route(testTCP(false, packet.TCPFlagSYN, 1000, 0), localIndex)
+	route(testIPv4UDP(), localIndex)
+	route(testReply(), 1)
+
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.adminHandler().ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+	var entries []ConnEntry
+	Expect(json.Unmarshal(serve("GET", "/conntrack").Body.Bytes(), &entries)).To(Succeed())
+	Expect(entries).To(HaveLen(2))
+	entries = nil
+	Expect(json.Unmarshal(serve("GET", "/conntrack?proto=udp&src=10.0.0.0/8&dport=80&dev=local").Body.Bytes(), &entries)).To(Succeed())
+	Expect(entries).To(HaveLen(1))
+	Expect(entries[0].Src.String()).To(Equal("10.0.0.1:1234"))
+	Expect(entries[0].Dst.String()).To(Equal("10.0.0.2:80"))
+	Expect(entries[0].InDev).To(Equal("local"))
+	Expect(entries[0].OutDev).To(Equal("tunnel"))
+	Expect(entries[0].Packets).To(BeEquivalentTo(1))
+	Expect(entries[0].ReplyPackets).To(BeEquivalentTo(1))
+	Expect(entries[0].ReplyBytes).To(BeEquivalentTo(28))
+	Expect(entries[0].State).To(Equal("established"))
+	Expect(entries[0].TCPState).To(BeEmpty())
+
+	Expect(serve("GET", "/conntrack?src=nowhere").Code).To(Equal(http.StatusBadRequest))
+	Expect(serve("GET", "/conntrack?dev=nowhere").Code).To(Equal(http.StatusBadRequest))
+	Expect(serve("POST", "/conntrack").Code).To(Equal(http.StatusMethodNotAllowed))
+	var flushed map[string]int
+	Expect(json.Unmarshal(serve("DELETE", "/conntrack?proto=tcp").Body.Bytes(), &flushed)).To(Succeed())
+	Expect(flushed).To(Equal(map[string]int{"flushed": 1}))
+	Expect(e.conntrack.Len()).To(Equal(1))
+
+	// The tcp flow is filtered out of the stream.
+	var ev ConnEvent
+	for _, want := range []string{"NEW", "UPDATE"} {
+		Expect(stream.Decode(&ev)).To(Succeed())
+		Expect(ev.Type).To(Equal(want))
+		Expect(ev.Flow.Proto).To(Equal("udp"))
+	}
+	Expect(ev.Flow.State).To(Equal("established"))
+	serve("DELETE", "/conntrack")
+	Expect(stream.Decode(&ev)).To(Succeed())
+	Expect(ev.Type).To(Equal("DESTROY"))
+}
@@ -0,0 +1,30 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/devs"
+	"github.com/mazdakn/uproxy/pkg/tun"
+)
+
+func init() {
+	devs.Register(config.DeviceUDP, func(conf config.Device, index uint8) (devs.NetIO, error) {
+		if conf.Address == "" {
+			return nil, fmt.Errorf("udp device requires an address")
+		}
+		return newUDPServer(conf, index), nil
+	})
+	devs.Register(config.DeviceTun, func(conf config.Device, index uint8) (devs.NetIO, error) {
+		if conf.Tun == nil {
+			return nil, fmt.Errorf("tun device requires a tun section")
+		}
+		return tun.New(conf.Tun, index), nil
+	})
+	devs.Register(config.DeviceDrop, func(_ config.Device, _ uint8) (devs.NetIO, error) {
+		return newDrop(), nil
+	})
+	devs.Register(config.DeviceProxy, func(_ config.Device, _ uint8) (devs.NetIO, error) {
+		return newProxy(), nil
+	})
+}
@@ -4,18 +4,19 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/mazdakn/uproxy/pkg/devs"
 	"github.com/mazdakn/uproxy/pkg/packet"
 )
 
 type dropDevice struct {
-	counter         atomic.Uint64
-	ingress, egress chan *packet.Packet
+	counter atomic.Uint64
+
+	devs.Queues
 }
 
 func newDrop() *dropDevice {
 	return &dropDevice{
-		ingress: make(chan *packet.Packet, queueCapacity),
-		egress:  make(chan *packet.Packet, queueCapacity),
+		Queues: devs.NewQueues(queueCapacity),
 	}
 }
 
@@ -31,18 +32,6 @@ func (d *dropDevice) Name() string {
 	return "drop"
 }
 
-func (d *dropDevice) Ingress() chan<- *packet.Packet {
-	return d.ingress
-}
-
-func (d *dropDevice) Egress() <-chan *packet.Packet {
-	return d.egress
-}
-
-func (d *dropDevice) Read(_ *packet.Packet, _ time.Time) (int, error) {
-	panic("drop device should never be read")
-}
-
 func (d *dropDevice) Write(pkt *packet.Packet, _ time.Time) (int, error) {
 	d.counter.Add(1)
 	return pkt.Len(), nil
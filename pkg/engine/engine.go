@@ -2,86 +2,183 @@ package engine
 
 import (
 	"context"
+	"fmt"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/conntrack"
 	"github.com/mazdakn/uproxy/pkg/devs"
 	"github.com/mazdakn/uproxy/pkg/packet"
-	"github.com/mazdakn/uproxy/pkg/tun"
 	"github.com/sirupsen/logrus"
 )
 
 type engine struct {
-	conf     *config.Config
-	devices  []devs.NetIO
-	policies *PolicyTable
+	// Config of the running engine, its policies being those of the last
+	// reload and its devices those it was started with.
+	conf    *config.Config
+	devices *devs.Registry
+	// Devices of the config file as last loaded, so that reloads warn once
+	// about each change of devices.
+	fileDevices []config.Device
+	policies    atomic.Pointer[PolicyTable]
+	pool        *packet.Pool
+	// Flows of stateful policies, swept every sweepInterval.
+	conntrack     *conntrack.ConnTable
+	sweepInterval time.Duration
+	// Syncs the flows with a peer, nil when not configured.
+	ctSync *syncer
+	// Nil when health checks are disabled.
+	health *healthChecker
 }
 
 func New(conf *config.Config) *engine {
-	return &engine{
-		conf:     conf,
-		policies: newPolicyTable(),
-		devices:  make([]devs.NetIO, devs.NetIO_Max),
+	e := &engine{
+		conf:        conf,
+		devices:     devs.NewRegistry(),
+		fileDevices: conf.DeviceConfigs(),
+		pool:        packet.NewPool(conf.MaxBufferSize),
+		conntrack:   conntrack.New(),
 	}
+	e.policies.Store(newPolicyTable())
+	return e
 }
 
 func (e *engine) Run() error {
 	logrus.Info("Starting the engine")
 	ctx, cancelFunc := setupSignals()
 	defer cancelFunc()
+	// SIGHUP would kill the process until it is handled, so it is caught
+	// before starting and reloads once started.
+	sighup, stopReload := setupReload()
+	defer stopReload()
 
 	defer e.cleanup()
 
-	err := e.policies.ParseConfig(e.conf)
+	err := e.devices.Create(e.conf.DeviceConfigs())
 	if err != nil {
 		return err
 	}
 
+	policies := newPolicyTable()
+	err = policies.ParseConfig(e.conf, e.devices)
+	if err != nil {
+		return err
+	}
+	if err := e.setupConntrack(); err != nil {
+		return err
+	}
+	e.health, err = newHealthChecker(e.conf.HealthCheck)
+	if err != nil {
+		return err
+	}
+	e.storePolicies(policies)
+
+	var admin net.Listener
+	if e.conf.Admin != "" {
+		admin, err = net.Listen("tcp", e.conf.Admin)
+		if err != nil {
+			return fmt.Errorf("failed to listen for admin api on %v - err: %w", e.conf.Admin, err)
+		}
+	}
+	if e.ctSync != nil {
+		if err := e.ctSync.open(e.conntrack, e.devices); err != nil {
+			return err
+		}
+	}
+
 	e.startDevices()
 	logrus.Info("Started the engine")
 
 	var wg sync.WaitGroup
+	wg.Add(1)
+	go e.handleReloads(ctx, &wg, sighup)
+	wg.Add(1)
+	go e.conntrack.Run(ctx, &wg, e.sweepInterval)
+	if e.ctSync != nil {
+		e.ctSync.start(ctx, &wg)
+	}
+	if e.health != nil {
+		wg.Add(1)
+		go e.health.run(ctx, &wg, e.sendProbe)
+	}
+	if admin != nil {
+		wg.Add(1)
+		go e.serveAdmin(ctx, admin, &wg)
+	}
 	e.runAndWait(ctx, &wg)
 	return nil
 }
 
-func (e *engine) runAndWait(ctx context.Context, wg *sync.WaitGroup) {
-	udpDev := e.devices[devs.NetIO_UDPServer]
-	if udpDev != nil {
-		wg.Add(1)
-		go e.handleDevice(ctx, udpDev, wg)
+// storePolicies makes the table the one used to route packets, linking its
+// route endpoints to their health state and its unchanged policies to their
+// counters first.
+func (e *engine) storePolicies(policies *PolicyTable) *PolicyTable {
+	if e.health != nil {
+		e.health.attach(policies)
 	}
+	policies.inheritCounters(e.policies.Load())
+	return e.policies.Swap(policies)
+}
 
-	tunDev := e.devices[devs.NetIO_Local]
-	if tunDev != nil {
-		wg.Add(1)
-		go e.handleDevice(ctx, tunDev, wg)
+func (e *engine) runAndWait(ctx context.Context, wg *sync.WaitGroup) {
+	for i := 0; i < e.devices.Len(); i++ {
+		dev := e.devices.Device(uint8(i))
+		if dev == nil {
+			continue
+		}
+		if mq, ok := dev.(devs.MultiQueue); ok {
+			for i := 0; i < mq.NumQueues(); i++ {
+				e.runDevice(ctx, mq.Queue(i), wg)
+			}
+			continue
+		}
+		e.runDevice(ctx, dev, wg)
 	}
 
 	wg.Wait()
 }
 
-func (e engine) startDevices() {
-	e.devices[devs.NetIO_Drop] = newDrop()
-	e.devices[devs.NetIO_UDPServer] = newUDPServer(e.conf, devs.NetIO_UDPServer)
-	e.devices[devs.NetIO_Local] = tun.New(e.conf, devs.NetIO_Local)
-
-	for i, dev := range e.devices {
-		if dev == nil {
-			logrus.Debugf("no device found at index %v", i)
-			continue
+// runDevice starts the goroutines reading from, handling packets of and
+// writing to the device, depending on what the device supports.
+func (e *engine) runDevice(ctx context.Context, dev devs.NetIO, wg *sync.WaitGroup) {
+	if reader, ok := dev.(devs.Reader); ok {
+		wg.Add(2)
+		if batch, ok := dev.(devs.BatchReader); ok && batch.BatchSize() > 1 {
+			go e.readDeviceBatch(ctx, batch, wg)
+		} else {
+			go e.readDevice(ctx, reader, wg)
+		}
+		go e.handleDevice(ctx, dev, wg)
+	}
+	if writer, ok := dev.(devs.Writer); ok {
+		wg.Add(1)
+		if batch, ok := dev.(devs.BatchWriter); ok && batch.BatchSize() > 1 {
+			go e.writeDeviceBatch(ctx, batch, wg)
+		} else {
+			go e.writeDevice(ctx, writer, wg)
 		}
+	}
+}
+
+func (e *engine) startDevices() {
+	for i := 0; i < e.devices.Len(); i++ {
+		dev := e.devices.Device(uint8(i))
 		err := dev.Start()
 		if err != nil {
-			logrus.WithError(err).Warnf("failed to start device %v", dev.Name())
+			logrus.WithError(err).Warnf("failed to start device %v (%v)", e.devices.Name(uint8(i)), dev.Name())
+			e.devices.Remove(uint8(i))
 			continue
 		}
-		logrus.Infof("Successfully started %v", dev.Name())
+		logrus.Infof("Successfully started %v (%v)", e.devices.Name(uint8(i)), dev.Name())
 	}
 }
 
 func (e *engine) cleanup() {
-	for _, dev := range e.devices {
+	for i := 0; i < e.devices.Len(); i++ {
+		dev := e.devices.Device(uint8(i))
 		if dev == nil {
 			continue
 		}
@@ -95,40 +192,92 @@ func (e *engine) cleanup() {
 func (e *engine) handleDevice(ctx context.Context, dev devs.NetIO, wg *sync.WaitGroup) {
 	defer wg.Done()
 	name := dev.Name()
-	pkt := packet.New(e.conf.MaxBufferSize)
 	egressChan := dev.Egress()
-	logrus.Infof("Started goroutine reading from %v", name)
+	logrus.Infof("Started goroutine handling packets from %v", name)
 
 	for {
-		if ctx.Err() != nil {
-			logrus.Infof("Stopped goroutine reading from %v", name)
+		var pkt *packet.Packet
+		select {
+		case <-ctx.Done():
+			logrus.Infof("Stopped goroutine handling packets from %v", name)
 			return
+		case pkt = <-egressChan:
 		}
 
-		pkt.Reset()
-		pkt := <-egressChan
-
-		policy := e.policies.Match(pkt)
-		if policy == nil {
-			logrus.Warnf("not policy found")
+		outDev := e.route(pkt)
+		if outDev == nil {
+			e.pool.Put(pkt)
 			continue
 		}
 
-		outDevIdx := policy.Action
-		outDev := e.devices[outDevIdx]
-		if outDev == nil {
-			logrus.Warnf("target device at index %v not available", outDevIdx)
-			continue
+		select {
+		case ingress(outDev, pkt) <- pkt:
+		case <-ctx.Done():
+			e.pool.Put(pkt)
+			logrus.Infof("Stopped goroutine handling packets from %v", name)
+			return
+		}
+	}
+}
+
+// route matches the packet against the policy table and returns the device
+// it should be sent to, or nil if the packet is to be discarded. Replies of
+// flows tracked by stateful policies skip the table, and their invalid
+// packets are discarded.
+func (e *engine) route(pkt *packet.Packet) devs.NetIO {
+	policies := e.policies.Load()
+	if policies.stateful {
+		dev, valid := e.routeTracked(pkt)
+		if !valid {
+			return nil
+		}
+		if dev != nil {
+			return dev
 		}
-		outDevName := outDev.Name()
-		logrus.Infof("Sending packet to %v via endpoint %v", policy.Endpoint, outDevName)
+	}
+	policy := policies.Match(pkt)
+	if policy == nil {
+		if logrus.IsLevelEnabled(logrus.DebugLevel) {
+			logrus.Debugf("No policy matched packet %v, discarding it", pkt)
+		}
+		return nil
+	}
 
-		if policy.Endpoint != nil {
-			pkt.Meta.Endpoint = policy.Endpoint
+	now := time.Now()
+	if policy.counters != nil {
+		policy.counters.hit(pkt, now)
+	}
+	index := policy.Device
+	if policy.Limit != nil && !policy.Limit.allow(pkt, now) {
+		index = policy.LimitDrop
+	}
+	outDev := e.devices.Device(index)
+	if outDev == nil {
+		logrus.Warnf("target device %v not available", e.devices.Name(index))
+		return nil
+	}
+	if policy.Route != nil && index == policy.Device {
+		pkt.Meta.Endpoint = policy.Route.pick(pkt.FlowHash())
+	}
+	if policy.Action == ActionReject && index == policy.Device {
+		e.reject(pkt)
+	}
+	if policy.Stateful && index == policy.Device {
+		if inDev := e.devices.Device(pkt.Meta.SrcIndex); inDev != nil {
+			e.conntrack.Track(pkt, inDev, outDev)
 		}
+	}
+	if logrus.IsLevelEnabled(logrus.DebugLevel) {
+		logrus.Debugf("Sending packet %v to %v via endpoint %v (policy %v)", pkt, outDev.Name(), pkt.Meta.Endpoint, policy.Source)
+	}
+	return outDev
+}
 
-		// Write Packet
-		outDev.Ingress() <- pkt
-		logrus.Infof("Sent packet %v via %v", pkt, outDevName)
+// ingress returns the channel the packet should be sent to on the device. On
+// multi-queue devices the queue is chosen by flow hash.
+func ingress(dev devs.NetIO, pkt *packet.Packet) chan<- *packet.Packet {
+	if mq, ok := dev.(devs.MultiQueue); ok && mq.NumQueues() > 1 {
+		return mq.Queue(int(pkt.FlowHash() % uint32(mq.NumQueues()))).Ingress()
 	}
+	return dev.Ingress()
 }
@@ -0,0 +1,55 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/mazdakn/uproxy/pkg/devs"
+	"github.com/mazdakn/uproxy/pkg/packet"
+	. "github.com/onsi/gomega"
+)
+
+type multiQueueDevice struct {
+	queues []*memDevice
+}
+
+func (m *multiQueueDevice) Start() error { return nil }
+func (m *multiQueueDevice) Stop() error  { return nil }
+func (m *multiQueueDevice) Name() string { return "tun://multi" }
+
+func (m *multiQueueDevice) Ingress() chan<- *packet.Packet { return m.queues[0].Ingress() }
+func (m *multiQueueDevice) Egress() <-chan *packet.Packet  { return m.queues[0].Egress() }
+
+func (m *multiQueueDevice) NumQueues() int         { return len(m.queues) }
+func (m *multiQueueDevice) Queue(i int) devs.NetIO { return m.queues[i] }
+
+func testPacket(data []byte) *packet.Packet {
+	pkt := packet.New(len(data))
+	pkt.Size = copy(pkt.Bytes, data)
+	if err := pkt.Parse(); err != nil {
+		panic(err)
+	}
+	return pkt
+}
+
+func TestIngressSteering(t *testing.T) {
+	RegisterTestingT(t)
+	dev := &multiQueueDevice{}
+	for i := 0; i < 4; i++ {
+		dev.queues = append(dev.queues, &memDevice{Queues: devs.NewQueues(queueCapacity)})
+	}
+
+	data := testIPv4UDP()
+	pkt := testPacket(data)
+	first := ingress(dev, pkt)
+	Expect(ingress(dev, testPacket(data))).To(Equal(first))
+
+	// Walk the source port until the flow lands on another queue.
+	other := false
+	for port := byte(1); port < 64 && !other; port++ {
+		data[21] = port
+		other = ingress(dev, testPacket(data)) != first
+	}
+	Expect(other).To(BeTrue())
+
+	Expect(testing.AllocsPerRun(100, func() { ingress(dev, pkt) })).To(BeZero())
+}
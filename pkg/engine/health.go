@@ -0,0 +1,233 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/devs"
+	"github.com/mazdakn/uproxy/pkg/packet"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHealthFailures = 3
+)
+
+type healthKey struct {
+	device uint8
+	addr   netip.AddrPort
+}
+
+func newHealthKey(device uint8, addr netip.AddrPort) healthKey {
+	return healthKey{device: device, addr: netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())}
+}
+
+// endpointHealth is the state of a route endpoint probed through a device.
+type endpointHealth struct {
+	key     healthKey
+	addr    *net.UDPAddr
+	up      atomic.Bool
+	replied atomic.Bool
+	// Sequence number of the last probe sent, the only one whose reply
+	// counts.
+	expected atomic.Uint64
+	// Only accessed by the health checker goroutine.
+	misses int
+	seq    uint64
+}
+
+// EndpointStatus is the health of an endpoint as reported by the status API.
+type EndpointStatus struct {
+	Device   string `json:"device"`
+	Endpoint string `json:"endpoint"`
+	Up       bool   `json:"up"`
+}
+
+// healthChecker probes every route endpoint at each interval, marking it
+// down after a number of consecutive probes went unanswered and up again
+// as soon as one is answered.
+type healthChecker struct {
+	interval time.Duration
+	failures int
+
+	lock      sync.Mutex
+	endpoints map[healthKey]*endpointHealth
+}
+
+func newHealthChecker(conf *config.HealthCheck) (*healthChecker, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(conf.Interval)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid health check interval %q", conf.Interval)
+	}
+	failures := conf.Failures
+	if failures <= 0 {
+		failures = defaultHealthFailures
+	}
+	return &healthChecker{
+		interval:  interval,
+		failures:  failures,
+		endpoints: make(map[healthKey]*endpointHealth),
+	}, nil
+}
+
+// attach links the endpoints of the routes of the table to their health
+// state. State is kept for endpoints already known, endpoints no longer
+// used by any policy stop being probed.
+func (c *healthChecker) attach(t *PolicyTable) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	endpoints := make(map[healthKey]*endpointHealth)
+	for _, p := range t.all() {
+		if p.Route == nil {
+			continue
+		}
+		for _, eps := range [][]endpoint{p.Route.endpoints, p.Route.backups} {
+			for j := range eps {
+				key := newHealthKey(p.Device, eps[j].addr.AddrPort())
+				h, ok := endpoints[key]
+				if !ok {
+					h, ok = c.endpoints[key]
+				}
+				if !ok {
+					h = &endpointHealth{key: key, addr: eps[j].addr}
+					h.up.Store(true)
+				}
+				endpoints[key] = h
+				eps[j].health = h
+			}
+		}
+	}
+	c.endpoints = endpoints
+}
+
+// run probes the endpoints until the context is cancelled. Probes are handed
+// to send, which returns false when they could not be queued.
+func (c *healthChecker) run(ctx context.Context, wg *sync.WaitGroup, send func(*endpointHealth) bool) {
+	defer wg.Done()
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.tick(send)
+		}
+	}
+}
+
+// tick evaluates the replies to the previous probes and sends new ones.
+func (c *healthChecker) tick(send func(*endpointHealth) bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, h := range c.endpoints {
+		if h.seq > 0 {
+			if h.replied.Swap(false) {
+				h.misses = 0
+				if !h.up.Swap(true) {
+					logrus.Infof("Endpoint %v is up", h.addr)
+				}
+			} else {
+				h.misses++
+				if h.misses >= c.failures && h.up.Swap(false) {
+					logrus.Warnf("Endpoint %v is down after %v unanswered probes", h.addr, h.misses)
+				}
+			}
+		}
+		h.seq++
+		h.expected.Store(h.seq)
+		if !send(h) {
+			logrus.Debugf("Failed to queue probe for %v", h.addr)
+		}
+	}
+}
+
+// handleReply records a reply from the endpoint to its last probe. Late
+// replies to earlier probes are ignored.
+func (c *healthChecker) handleReply(device uint8, origin netip.AddrPort, seq uint64) {
+	c.lock.Lock()
+	h := c.endpoints[newHealthKey(device, origin)]
+	c.lock.Unlock()
+	if h != nil && seq != 0 && h.expected.Load() == seq {
+		h.replied.Store(true)
+	}
+}
+
+func (c *healthChecker) status(deviceName func(uint8) string) []EndpointStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	statuses := make([]EndpointStatus, 0, len(c.endpoints))
+	for _, h := range c.endpoints {
+		statuses = append(statuses, EndpointStatus{
+			Device:   deviceName(h.key.device),
+			Endpoint: h.addr.String(),
+			Up:       h.up.Load(),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Device != statuses[j].Device {
+			return statuses[i].Device < statuses[j].Device
+		}
+		return statuses[i].Endpoint < statuses[j].Endpoint
+	})
+	return statuses
+}
+
+// sendProbe queues a probe request for the endpoint on its device without
+// blocking.
+func (e *engine) sendProbe(h *endpointHealth) bool {
+	dev := e.devices.Device(h.key.device)
+	if dev == nil {
+		return false
+	}
+	pkt := e.pool.Get()
+	pkt.SetProbe(packet.ProbeRequest, h.seq)
+	pkt.Meta.Endpoint = h.addr
+	select {
+	case dev.Ingress() <- pkt:
+		return true
+	default:
+		e.pool.Put(pkt)
+		return false
+	}
+}
+
+// handleProbe answers probe requests from peers and records the replies to
+// our own probes. It takes ownership of the packet.
+func (e *engine) handleProbe(dev devs.NetIO, pkt *packet.Packet) {
+	switch packet.ProbeType(pkt.Bytes) {
+	case packet.ProbeRequest:
+		pkt.SetProbe(packet.ProbeReply, packet.ProbeSeq(pkt.Bytes))
+		pkt.Meta.Endpoint = net.UDPAddrFromAddrPort(pkt.Meta.Origin)
+		select {
+		case dev.Ingress() <- pkt:
+			return
+		default:
+		}
+	case packet.ProbeReply:
+		if e.health != nil {
+			e.health.handleReply(pkt.Meta.SrcIndex, pkt.Meta.Origin, packet.ProbeSeq(pkt.Bytes))
+		}
+	}
+	e.pool.Put(pkt)
+}
+
+// HealthStatus returns the health of every probed endpoint.
+func (e *engine) HealthStatus() []EndpointStatus {
+	if e.health == nil {
+		return nil
+	}
+	return e.health.status(e.devices.Name)
+}
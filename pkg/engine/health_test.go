@@ -0,0 +1,181 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/packet"
+	. "github.com/onsi/gomega"
+)
+
+func TestRouteFailover(t *testing.T) {
+	RegisterTestingT(t)
+	r, err := parseRoute("10.0.0.1:1,10.0.0.2:1")
+	Expect(err).NotTo(HaveOccurred())
+	Expect(r.setBackups("10.0.0.3:1")).To(Succeed())
+	health := make([]*endpointHealth, 3)
+	for i, ep := range []*endpoint{&r.endpoints[0], &r.endpoints[1], &r.backups[0]} {
+		health[i] = &endpointHealth{}
+		health[i].up.Store(true)
+		ep.health = health[i]
+	}
+
+	health[0].up.Store(false)
+	for hash := uint32(0); hash < 1000; hash++ {
+		Expect(r.pick(hash).String()).To(Equal("10.0.0.2:1"))
+	}
+	health[1].up.Store(false)
+	Expect(r.pick(1).String()).To(Equal("10.0.0.3:1"))
+	// With everything down, flows stay on the primary endpoints.
+	health[2].up.Store(false)
+	Expect(r.pick(1).String()).NotTo(Equal("10.0.0.3:1"))
+	health[0].up.Store(true)
+	Expect(r.pick(1).String()).To(Equal("10.0.0.1:1"))
+}
+
+// echoPeer stands in for a remote uproxy, answering probes until closed.
+func echoPeer() *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	Expect(err).NotTo(HaveOccurred())
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if packet.IsProbe(buf[:n]) && packet.ProbeType(buf) == packet.ProbeRequest {
+				buf[3] = packet.ProbeReply
+				conn.WriteToUDP(buf[:n], addr)
+			}
+		}
+	}()
+	return conn
+}
+
+func TestHealthCheck(t *testing.T) {
+	RegisterTestingT(t)
+	alive := echoPeer()
+	defer alive.Close()
+	dead := echoPeer()
+	deadAddr := dead.LocalAddr().String()
+	dead.Close()
+
+	e := New(&config.Config{MaxBufferSize: 1600})
+	srv := newUDPServer(config.Device{Address: "127.0.0.1:0"}, 0)
+	Expect(srv.Start()).To(Succeed())
+	defer srv.Stop()
+	e.devices.Add("tunnel", config.DeviceUDP, srv)
+
+	var err error
+	e.health, err = newHealthChecker(&config.HealthCheck{Interval: "20ms", Failures: 2})
+	Expect(err).NotTo(HaveOccurred())
+	policies := newPolicyTable()
+	Expect(policies.ParseConfig(&config.Config{Policies: []config.Policy{
+		{DstAddr: "0.0.0.0/0", Action: "route=" + deadAddr, Backup: alive.LocalAddr().String()},
+	}}, e.devices)).To(Succeed())
+	e.storePolicies(policies)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go e.readDevice(ctx, srv, &wg)
+	go e.writeDevice(ctx, srv, &wg)
+	go e.health.run(ctx, &wg, e.sendProbe)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	route := policies.policies[0].Route
+	Eventually(func() string {
+		return route.pick(1).String()
+	}, 2*time.Second, 10*time.Millisecond).Should(Equal(alive.LocalAddr().String()))
+	Expect(e.HealthStatus()).To(ConsistOf(
+		EndpointStatus{Device: "tunnel", Endpoint: deadAddr, Up: false},
+		EndpointStatus{Device: "tunnel", Endpoint: alive.LocalAddr().String(), Up: true},
+	))
+
+	rec := httptest.NewRecorder()
+	e.adminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/status/health", nil))
+	var statuses []EndpointStatus
+	Expect(json.Unmarshal(rec.Body.Bytes(), &statuses)).To(Succeed())
+	Expect(statuses).To(Equal(e.HealthStatus()))
+
+	// State is kept for endpoints still in use after a reload.
+	reloaded := newPolicyTable()
+	Expect(reloaded.ParseConfig(&config.Config{Policies: []config.Policy{
+		{DstAddr: "10.0.0.0/8", Action: "route=" + deadAddr},
+	}}, e.devices)).To(Succeed())
+	e.storePolicies(reloaded)
+	Expect(e.HealthStatus()).To(Equal([]EndpointStatus{{Device: "tunnel", Endpoint: deadAddr, Up: false}}))
+}
+
+func TestHealthReplySeq(t *testing.T) {
+	RegisterTestingT(t)
+	c, err := newHealthChecker(&config.HealthCheck{Interval: "1s", Failures: 1})
+	Expect(err).NotTo(HaveOccurred())
+	registry := testRegistry()
+	policies := newPolicyTable()
+	Expect(policies.ParseConfig(&config.Config{Policies: []config.Policy{
+		{DstAddr: "0.0.0.0/0", Action: "route=10.0.0.1:9000", Device: "tunnel"},
+	}}, registry)).To(Succeed())
+	c.attach(policies)
+	h := policies.policies[0].Route.endpoints[0].health
+	origin := netip.MustParseAddrPort("10.0.0.1:9000")
+	send := func(*endpointHealth) bool { return true }
+
+	// Replies to earlier probes, or to none, do not count.
+	c.tick(send)
+	c.tick(send)
+	Expect(h.up.Load()).To(BeFalse())
+	c.handleReply(h.key.device, origin, 1)
+	c.handleReply(h.key.device, origin, 0)
+	c.handleReply(h.key.device, origin, 3)
+	c.tick(send)
+	Expect(h.up.Load()).To(BeFalse())
+	c.handleReply(h.key.device, origin, 3)
+	c.tick(send)
+	Expect(h.up.Load()).To(BeTrue())
+}
+
+func TestAnswerProbe(t *testing.T) {
+	RegisterTestingT(t)
+	e := New(&config.Config{MaxBufferSize: 1600})
+	srv := newUDPServer(config.Device{Address: "127.0.0.1:0"}, 0)
+	Expect(srv.Start()).To(Succeed())
+	defer srv.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go e.readDevice(ctx, srv, &wg)
+	go e.writeDevice(ctx, srv, &wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	Expect(err).NotTo(HaveOccurred())
+	defer peer.Close()
+	probe := packet.New(64)
+	probe.SetProbe(packet.ProbeRequest, 42)
+	_, err = peer.WriteToUDP(probe.Bytes, srv.conn.LocalAddr().(*net.UDPAddr))
+	Expect(err).NotTo(HaveOccurred())
+
+	buf := make([]byte, 64)
+	Expect(peer.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+	n, _, err := peer.ReadFromUDP(buf)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(packet.IsProbe(buf[:n])).To(BeTrue())
+	Expect(packet.ProbeType(buf)).To(Equal(packet.ProbeReply))
+	Expect(packet.ProbeSeq(buf)).To(BeEquivalentTo(42))
+}
@@ -0,0 +1,146 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/packet"
+	"golang.org/x/sys/unix"
+)
+
+type portRange struct {
+	lo, hi uint16
+}
+
+// portRanges matches a port against a list of inclusive ranges, a nil list
+// matching any port.
+type portRanges []portRange
+
+func (r portRanges) contains(port uint16) bool {
+	for _, pr := range r {
+		if port >= pr.lo && port <= pr.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// single returns the ports of the list if it is made of single ports only.
+func (r portRanges) single() ([]uint16, bool) {
+	ports := make([]uint16, 0, len(r))
+	for _, pr := range r {
+		if pr.lo != pr.hi {
+			return nil, false
+		}
+		ports = append(ports, pr.lo)
+	}
+	return ports, len(ports) > 0
+}
+
+// icmpMatch matches an icmp or icmpv6 type, and code unless it is negative.
+type icmpMatch struct {
+	Type uint8
+	Code int16
+}
+
+func (m *icmpMatch) match(pkt *packet.Packet) bool {
+	typ, code, ok := pkt.ICMPTypeCode()
+	if !ok || typ != m.Type {
+		return false
+	}
+	return m.Code < 0 || int16(code) == m.Code
+}
+
+// policyMatch parses the protocol, port, icmp and conntrack state criteria
+// of the policy.
+// All protocols given, directly or through ports, must agree.
+func policyMatch(p config.Policy, rPolicy *Policy) error {
+	proto, err := parseProto(p.Proto)
+	if err != nil {
+		return err
+	}
+	srcProto, srcPorts, err := policyProtoPort(p.SrcPort)
+	if err != nil {
+		return fmt.Errorf("invalid source port %q - err: %w", p.SrcPort, err)
+	}
+	dstProto, dstPorts, err := policyProtoPort(p.DstPort)
+	if err != nil {
+		return fmt.Errorf("invalid destination port %q - err: %w", p.DstPort, err)
+	}
+	for _, other := range []byte{srcProto, dstProto} {
+		if other == 0 {
+			continue
+		}
+		if proto != 0 && proto != other {
+			return fmt.Errorf("conflicting protocols %v and %v",
+				packet.ProtoToString(proto), packet.ProtoToString(other))
+		}
+		proto = other
+	}
+
+	rPolicy.Proto = proto
+	rPolicy.SrcPorts = srcPorts
+	rPolicy.DstPorts = dstPorts
+	if p.ICMP != "" {
+		if proto != unix.IPPROTO_ICMP && proto != unix.IPPROTO_ICMPV6 {
+			return fmt.Errorf("icmp match %q requires proto icmp or icmpv6", p.ICMP)
+		}
+		rPolicy.ICMP, err = parseICMP(p.ICMP)
+		if err != nil {
+			return fmt.Errorf("invalid icmp match %q - err: %w", p.ICMP, err)
+		}
+	}
+	rPolicy.CTStates, err = parseCTState(p.CTState)
+	if err != nil {
+		return fmt.Errorf("invalid ctstate match %q - err: %w", p.CTState, err)
+	}
+	return nil
+}
+
+// parseProto accepts a protocol name or number, empty meaning any.
+func parseProto(proto string) (byte, error) {
+	return config.ParseProto(proto)
+}
+
+// policyProtoPort parses ports of the form tcp:80,443,8000-8100, empty
+// meaning any protocol and port.
+func policyProtoPort(port string) (byte, portRanges, error) {
+	proto, ranges, err := config.ParsePorts(port)
+	if err != nil || ranges == nil {
+		return proto, nil, err
+	}
+	prs := make(portRanges, len(ranges))
+	for i, r := range ranges {
+		prs[i] = portRange{lo: r.Lo, hi: r.Hi}
+	}
+	return proto, prs, nil
+}
+
+// parseICMP parses an icmp type with an optional code, like 3 or 3/4.
+func parseICMP(icmp string) (*icmpMatch, error) {
+	typ, code, err := config.ParseICMP(icmp)
+	if err != nil {
+		return nil, err
+	}
+	return &icmpMatch{Type: typ, Code: code}, nil
+}
+
+// parseCTState parses a list of conntrack states into a mask of the
+// packet.CTState values matched.
+func parseCTState(states string) (uint8, error) {
+	mask, err := config.ParseCTState(states)
+	if err != nil {
+		return 0, err
+	}
+	var ctStates uint8
+	for bit, state := range map[uint8]packet.CTState{
+		config.CTStateNew:         packet.CTNew,
+		config.CTStateEstablished: packet.CTEstablished,
+		config.CTStateInvalid:     packet.CTInvalid,
+	} {
+		if mask&bit != 0 {
+			ctStates |= 1 << state
+		}
+	}
+	return ctStates, nil
+}
@@ -3,13 +3,13 @@ package engine
 import (
 	"fmt"
 	"net"
-	"strconv"
+	"sort"
 	"strings"
 
 	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/devs"
 	"github.com/mazdakn/uproxy/pkg/packet"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/sys/unix"
 )
 
 type Action string
@@ -19,20 +19,41 @@ const (
 	ActionProxy Action = "proxy"
 	ActionRoute Action = "route"
 	ActionLocal Action = "local"
+	// Reject drops packets like drop, and answers them with a tcp reset or
+	// an icmp unreachable.
+	ActionReject Action = "reject"
 )
 
 type Policy struct {
 	SrcNet *net.IPNet
 	DstNet *net.IPNet
+	SrcSet *setMatch
+	DstSet *setMatch
 
-	Proto   byte
-	DstPort uint16
+	Proto    byte
+	SrcPorts portRanges
+	DstPorts portRanges
+	ICMP     *icmpMatch
+	// Mask of the conntrack states matched, by 1<<packet.CTState, 0
+	// matching any state.
+	CTStates uint8
 
-	Action   uint8
-	Endpoint *net.UDPAddr
+	Action Action
+	Device uint8
+	Route  *route
+	// Packets over the limit go to the drop device, nil means no limit.
+	Limit     *rateLimiter
+	LimitDrop uint8
+	// Flows matched by stateful policies are tracked to let replies in.
+	Stateful bool
+
+	counters *policyCounters
+
+	// Configuration the policy was compiled from.
+	Source config.Policy
 }
 
-func (p Policy) Match(pkt *packet.Packet) bool {
+func (p *Policy) Match(pkt *packet.Packet) bool {
 	if p.DstNet != nil && !p.DstNet.Contains(pkt.DstAddr()) {
 		return false
 	}
@@ -42,117 +63,260 @@ func (p Policy) Match(pkt *packet.Packet) bool {
 	if p.Proto != 0 && p.Proto != pkt.Protocol() {
 		return false
 	}
-	if p.DstPort != 0 && p.DstPort != pkt.DstPort() {
+	if p.DstPorts != nil && !p.DstPorts.contains(pkt.DstPort()) {
+		return false
+	}
+	if p.SrcPorts != nil && !p.SrcPorts.contains(pkt.SrcPort()) {
+		return false
+	}
+	if p.ICMP != nil && !p.ICMP.match(pkt) {
 		return false
 	}
-	return true
+	if p.CTStates != 0 && p.CTStates&(1<<pkt.Meta.CTState) == 0 {
+		return false
+	}
+	return p.matchSets(pkt)
 }
 
 type PolicyTable struct {
-	policies []Policy
+	policies   []Policy
+	classifier *classifier
+	// Set when any policy is stateful or matches conntrack states, packets
+	// are only inspected by conntrack then.
+	stateful bool
+	// Matches packets no policy matched, nil when there is no default
+	// action and no drop device.
+	defaultPolicy *Policy
 }
 
 func newPolicyTable() *PolicyTable {
 	return &PolicyTable{}
 }
 
-func (t *PolicyTable) ParseConfig(conf *config.Config) error {
-	for _, p := range conf.Policies {
-		if p.SrcAddr == "" && p.DstAddr == "" && p.DstPort == "" {
-			logrus.Errorf("No match provided: %v - Skipping.", p)
-			continue
-		}
-		if p.Action == "" {
-			logrus.Errorf("No action provided: %v - Skipping.", p)
-			continue
-		}
+// ParseConfig compiles the configured policies, ordered by priority then in
+// configured order, and the default action. Every policy must refer to a
+// device of the registry. Invalid policies fail the whole table, unless the
+// config is lenient, in which case they are skipped, and an invalid default
+// action falls back to dropping the packets no policy matches.
+func (t *PolicyTable) ParseConfig(conf *config.Config, devices *devs.Registry) error {
+	sets, err := compileSets(conf)
+	if err != nil {
+		return err
+	}
 
-		var err error
-		var rPolicy Policy
-		rPolicy.Action, rPolicy.Endpoint, err = policyAction(p.Action)
+	for _, p := range conf.Policies {
+		rPolicy, err := compilePolicy(p, sets, devices)
 		if err != nil {
-			logrus.WithError(err).Errorf("Error parsing action: %v - Skipping", p.Action)
-			continue
-		}
-		if p.SrcAddr != "" {
-			_, rPolicy.SrcNet, err = net.ParseCIDR(p.SrcAddr)
-			if err != nil {
-				logrus.WithError(err).Errorf("Invalid source cidr %v - Skipping", p.SrcAddr)
-				continue
-			}
-		}
-		if p.DstAddr != "" {
-			_, rPolicy.DstNet, err = net.ParseCIDR(p.DstAddr)
-			if err != nil {
-				logrus.WithError(err).Errorf("Invalid destination cidr %v - Skipping", p.DstAddr)
-				continue
+			if !conf.Lenient {
+				return fmt.Errorf("invalid policy %v - err: %w", p, err)
 			}
+			logrus.WithError(err).Errorf("Invalid policy %v - Skipping", p)
+			continue
 		}
-		rPolicy.Proto, rPolicy.DstPort = policyProtoPort(p.DstPort)
-
 		logrus.Debugf("Adding policy %#v", rPolicy)
 		t.policies = append(t.policies, rPolicy)
+		t.stateful = t.stateful || rPolicy.Stateful || rPolicy.CTStates != 0
 	}
+	sort.SliceStable(t.policies, func(i, j int) bool {
+		return t.policies[i].Source.Priority < t.policies[j].Source.Priority
+	})
 
+	t.defaultPolicy, err = compileDefault(conf, devices)
+	if err != nil {
+		if !conf.Lenient {
+			return err
+		}
+		logrus.WithError(err).Errorf("Invalid default action %v - Dropping unmatched packets", conf.DefaultAction)
+	}
+	t.compile()
 	return nil
 }
 
-func (p PolicyTable) Match(pkt *packet.Packet) *Policy {
-	logrus.Debugf("Looking up packet %v", pkt)
-	for _, p := range p.policies {
-		if p.Match(pkt) {
-			return &p
+// compileDefault compiles the default action into a policy matching any
+// packet. Without a default action packets are sent to the drop device, or
+// discarded if there is none.
+func compileDefault(conf *config.Config, devices *devs.Registry) (*Policy, error) {
+	action := conf.DefaultAction
+	if action == "" {
+		action = string(ActionDrop)
+	}
+	p := &Policy{
+		Source:   config.Policy{Name: config.DefaultPolicyName, Action: action},
+		counters: &policyCounters{},
+	}
+	var err error
+	p.Action, p.Route, err = policyAction(action)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default action - err: %w", err)
+	}
+	p.Device, err = devices.Resolve("", actionDeviceType(p.Action))
+	if err != nil {
+		if conf.DefaultAction == "" {
+			return nil, nil
 		}
+		return nil, fmt.Errorf("invalid device for default action - err: %w", err)
 	}
-	return nil
+	return p, nil
 }
 
-func policyAction(action string) (uint8, *net.UDPAddr, error) {
-	// Need to handle route action separately
-	if strings.HasPrefix(action, string(ActionRoute)) {
-		addr := strings.TrimLeft(action, "route=")
-		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+// all returns the policies followed by the default one.
+func (t *PolicyTable) all() []*Policy {
+	all := make([]*Policy, 0, len(t.policies)+1)
+	for i := range t.policies {
+		all = append(all, &t.policies[i])
+	}
+	if t.defaultPolicy != nil {
+		all = append(all, t.defaultPolicy)
+	}
+	return all
+}
+
+func compilePolicy(p config.Policy, sets map[string]*addrSet, devices *devs.Registry) (Policy, error) {
+	rPolicy := Policy{Source: p, Stateful: p.Stateful, counters: &policyCounters{}}
+	if p.SrcAddr == "" && p.DstAddr == "" && p.SrcSet == "" && p.DstSet == "" &&
+		p.SrcPort == "" && p.DstPort == "" && p.Proto == "" && p.CTState == "" {
+		return rPolicy, fmt.Errorf("no match provided")
+	}
+	if p.Action == "" {
+		return rPolicy, fmt.Errorf("no action provided")
+	}
+
+	var err error
+	rPolicy.Action, rPolicy.Route, err = policyAction(p.Action)
+	if err != nil {
+		return rPolicy, err
+	}
+	if p.Backup != "" {
+		if rPolicy.Route == nil {
+			return rPolicy, fmt.Errorf("backup endpoints need a route action")
+		}
+		if err := rPolicy.Route.setBackups(p.Backup); err != nil {
+			return rPolicy, fmt.Errorf("invalid backup - err: %w", err)
+		}
+	}
+	rPolicy.Device, err = devices.Resolve(p.Device, actionDeviceType(rPolicy.Action))
+	if err != nil {
+		return rPolicy, fmt.Errorf("invalid device - err: %w", err)
+	}
+	if p.RateLimit != (config.RateLimit{}) {
+		rPolicy.Limit, err = newRateLimiter(p.RateLimit)
+		if err != nil {
+			return rPolicy, fmt.Errorf("invalid rate limit - err: %w", err)
+		}
+		rPolicy.LimitDrop, err = devices.Resolve("", config.DeviceDrop)
 		if err != nil {
-			return 0, nil, err
+			return rPolicy, fmt.Errorf("no drop device for rate limit - err: %w", err)
 		}
-		return NetIO_UDPServer, udpAddr, nil
 	}
+	if p.SrcAddr != "" {
+		_, rPolicy.SrcNet, err = net.ParseCIDR(p.SrcAddr)
+		if err != nil {
+			return rPolicy, fmt.Errorf("invalid source cidr - err: %w", err)
+		}
+	}
+	if p.DstAddr != "" {
+		_, rPolicy.DstNet, err = net.ParseCIDR(p.DstAddr)
+		if err != nil {
+			return rPolicy, fmt.Errorf("invalid destination cidr - err: %w", err)
+		}
+	}
+	err = policyMatch(p, &rPolicy)
+	if err != nil {
+		return rPolicy, fmt.Errorf("invalid match - err: %w", err)
+	}
+	rPolicy.SrcSet, err = policySet(p.SrcSet, sets)
+	if err != nil {
+		return rPolicy, fmt.Errorf("invalid source set - err: %w", err)
+	}
+	rPolicy.DstSet, err = policySet(p.DstSet, sets)
+	if err != nil {
+		return rPolicy, fmt.Errorf("invalid destination set - err: %w", err)
+	}
+	return rPolicy, nil
+}
 
-	switch Action(action) {
-	case ActionDrop:
-		return NetIO_Drop, nil, nil
-	case ActionLocal:
-		// TODO: need to check this somewhere else
-		/*if e.tunDev == nil {
-			return nil, nil, fmt.Errorf("local device not available")
-		}*/
-		return NetIO_Local, nil, nil
-	case ActionProxy:
-		return NetIO_Proxy, nil, nil
+// compile builds the classifier used to match packets from the policies.
+func (t *PolicyTable) compile() {
+	t.classifier = newClassifier(t.policies)
+}
+
+// diffPolicies returns the configured policies present in the new table but
+// not in the old one, and the other way around.
+func diffPolicies(old, new *PolicyTable) ([]config.Policy, []config.Policy) {
+	oldSet := make(map[config.Policy]bool, len(old.policies))
+	for _, p := range old.policies {
+		oldSet[p.Source] = true
 	}
-	return 0, nil, fmt.Errorf("failed to parse action %v", action)
+	newSet := make(map[config.Policy]bool, len(new.policies))
+	for _, p := range new.policies {
+		newSet[p.Source] = true
+	}
+
+	var added, removed []config.Policy
+	for _, p := range new.policies {
+		if !oldSet[p.Source] {
+			added = append(added, p.Source)
+		}
+	}
+	for _, p := range old.policies {
+		if !newSet[p.Source] {
+			removed = append(removed, p.Source)
+		}
+	}
+	return added, removed
 }
 
-func policyProtoPort(port string) (byte, uint16) {
-	if strings.HasPrefix(port, "udp:") {
-		return unix.IPPROTO_UDP, strToPort(strings.TrimLeft(port, "udp:"))
+func (t *PolicyTable) Match(pkt *packet.Packet) *Policy {
+	if logrus.IsLevelEnabled(logrus.DebugLevel) {
+		logrus.Debugf("Looking up packet %v", pkt)
 	}
-	if strings.HasPrefix(port, "tcp:") {
-		return unix.IPPROTO_TCP, strToPort(strings.TrimLeft(port, "tcp:"))
+	if t.classifier != nil {
+		if p := t.classifier.Match(pkt); p != nil {
+			return p
+		}
 	}
-	return 0, 0
+	return t.defaultPolicy
 }
 
-func strToPort(p string) uint16 {
-	if p == "" {
-		return 0
+// matchLinear scans the policies in order, it is the reference the
+// classifier is checked against.
+func (t *PolicyTable) matchLinear(pkt *packet.Packet) *Policy {
+	for i := range t.policies {
+		if t.policies[i].Match(pkt) {
+			return &t.policies[i]
+		}
 	}
-	pInt, err := strconv.Atoi(p)
-	if err != nil {
-		return 0
+	return t.defaultPolicy
+}
+
+func policyAction(action string) (Action, *route, error) {
+	// Need to handle route action separately
+	if strings.HasPrefix(action, string(ActionRoute)) {
+		r, err := parseRoute(strings.TrimPrefix(action, "route="))
+		if err != nil {
+			return "", nil, err
+		}
+		return ActionRoute, r, nil
 	}
-	if pInt <= 0 || pInt > 65535 {
-		return 0
+
+	switch Action(action) {
+	case ActionDrop, ActionLocal, ActionProxy, ActionReject:
+		return Action(action), nil, nil
+	}
+	return "", nil, fmt.Errorf("failed to parse action %v", action)
+}
+
+// actionDeviceType returns the type of device packets matching a policy
+// with the action are sent to.
+func actionDeviceType(action Action) string {
+	switch action {
+	case ActionRoute:
+		return config.DeviceUDP
+	case ActionLocal:
+		return config.DeviceTun
+	case ActionProxy:
+		return config.DeviceProxy
+	default:
+		return config.DeviceDrop
 	}
-	return uint16(pInt)
 }
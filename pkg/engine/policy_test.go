@@ -0,0 +1,280 @@
+package engine
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/devs"
+	"github.com/mazdakn/uproxy/pkg/packet"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+func testRegistry() *devs.Registry {
+	r := devs.NewRegistry()
+	r.Add("drop", config.DeviceDrop, newDrop())
+	r.Add("tunnel", config.DeviceUDP, newUDPServer(config.Device{}, 1))
+	r.Add("backup", config.DeviceUDP, newUDPServer(config.Device{}, 2))
+	return r
+}
+
+func TestParseConfigDevices(t *testing.T) {
+	RegisterTestingT(t)
+	table := newPolicyTable()
+	Expect(table.ParseConfig(&config.Config{Policies: []config.Policy{
+		{DstAddr: "10.0.0.0/8", Action: "route=127.0.0.1:9000", Device: "backup"},
+		{DstAddr: "0.0.0.0/0", Action: "drop"},
+	}}, testRegistry())).To(Succeed())
+	Expect(table.policies).To(HaveLen(2))
+	Expect(table.policies[0].Device).To(BeEquivalentTo(2))
+	Expect(table.policies[1].Device).To(BeEquivalentTo(0))
+
+	for _, p := range []config.Policy{
+		{DstAddr: "10.0.0.0/8", Action: "route=127.0.0.1:9000"},
+		{DstAddr: "10.0.0.0/8", Action: "route=127.0.0.1:9000", Device: "missing"},
+		{DstAddr: "10.0.0.0/8", Action: "local"},
+	} {
+		err := newPolicyTable().ParseConfig(&config.Config{Policies: []config.Policy{p}}, testRegistry())
+		Expect(err).To(HaveOccurred())
+	}
+}
+
+func compiledTable(policies ...Policy) *PolicyTable {
+	t := &PolicyTable{policies: policies}
+	t.compile()
+	return t
+}
+
+// randomPolicies returns count policies on /8 to /32 destination prefixes
+// of 10.0.0.0/8, some with a source prefix or a destination port.
+func randomPolicies(rnd *rand.Rand, count int) []Policy {
+	policies := make([]Policy, count)
+	for i := range policies {
+		p := &policies[i]
+		ip := net.IPv4(10, byte(rnd.Intn(4)), byte(rnd.Intn(256)), byte(rnd.Intn(256)))
+		p.DstNet = &net.IPNet{IP: ip.Mask(net.CIDRMask(8+rnd.Intn(25), 32)), Mask: net.CIDRMask(8+rnd.Intn(25), 32)}
+		p.DstNet.IP = p.DstNet.IP.Mask(p.DstNet.Mask)
+		if rnd.Intn(4) == 0 {
+			p.SrcNet = &net.IPNet{IP: net.IPv4(192, 168, byte(rnd.Intn(4)), 0), Mask: net.CIDRMask(24, 32)}
+		}
+		if rnd.Intn(2) == 0 {
+			p.Proto = unix.IPPROTO_UDP
+			switch rnd.Intn(3) {
+			case 0:
+				port := uint16(rnd.Intn(4))
+				p.DstPorts = portRanges{{port, port}}
+			case 1:
+				p.DstPorts = portRanges{{1, 2}}
+			}
+		}
+	}
+	return policies
+}
+
+func randomPacket(rnd *rand.Rand) *packet.Packet {
+	data := testIPv4UDP()
+	copy(data[12:16], []byte{192, 168, byte(rnd.Intn(4)), byte(rnd.Intn(256))})
+	copy(data[16:20], []byte{10, byte(rnd.Intn(4)), byte(rnd.Intn(256)), byte(rnd.Intn(256))})
+	data[23] = byte(rnd.Intn(4))
+	return testPacket(data)
+}
+
+func TestClassifierMatchesLinear(t *testing.T) {
+	RegisterTestingT(t)
+	rnd := rand.New(rand.NewSource(1))
+	for _, count := range []int{0, 1, 10, 1000} {
+		table := compiledTable(randomPolicies(rnd, count)...)
+		for i := 0; i < 2000; i++ {
+			pkt := randomPacket(rnd)
+			Expect(table.Match(pkt)).To(BeIdenticalTo(table.matchLinear(pkt)))
+		}
+	}
+}
+
+func TestClassifierOrder(t *testing.T) {
+	RegisterTestingT(t)
+	_, wide, _ := net.ParseCIDR("10.0.0.0/8")
+	_, narrow, _ := net.ParseCIDR("10.0.0.2/32")
+	table := compiledTable(
+		Policy{DstNet: wide, Proto: unix.IPPROTO_UDP, DstPorts: portRanges{{80, 80}}, Action: ActionDrop},
+		Policy{DstNet: narrow, Action: ActionLocal},
+		Policy{Action: ActionProxy},
+	)
+	pkt := testPacket(testIPv4UDP())
+	Expect(table.Match(pkt).Action).To(Equal(ActionDrop))
+
+	data := testIPv4UDP()
+	data[23] = 81
+	Expect(table.Match(testPacket(data)).Action).To(Equal(ActionLocal))
+	data[19] = 3
+	Expect(table.Match(testPacket(data)).Action).To(Equal(ActionProxy))
+	Expect(testing.AllocsPerRun(100, func() { table.Match(pkt) })).To(BeZero())
+}
+
+// benchPolicies returns count policies on distinct /32 destinations of
+// 10.0.0.0/8 followed by a catch-all, so packets match policies spread over
+// the whole table.
+func benchPolicies(count int) []Policy {
+	policies := make([]Policy, count, count+1)
+	for i := range policies {
+		ip := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+		policies[i].DstNet = &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+		if i%2 == 0 {
+			policies[i].Proto = unix.IPPROTO_UDP
+			policies[i].DstPorts = portRanges{{80, 80}}
+		}
+	}
+	return append(policies, Policy{Action: ActionDrop})
+}
+
+func BenchmarkMatch(b *testing.B) {
+	for _, count := range []int{10, 1000, 100000} {
+		rnd := rand.New(rand.NewSource(1))
+		table := compiledTable(benchPolicies(count)...)
+		pkts := make([]*packet.Packet, 1024)
+		for i := range pkts {
+			n := rnd.Intn(count)
+			data := testIPv4UDP()
+			copy(data[16:20], []byte{10, byte(n >> 16), byte(n >> 8), byte(n)})
+			pkts[i] = testPacket(data)
+		}
+		b.Run(fmt.Sprintf("linear/%v", count), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				table.matchLinear(pkts[i%len(pkts)])
+			}
+		})
+		b.Run(fmt.Sprintf("classifier/%v", count), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				table.Match(pkts[i%len(pkts)])
+			}
+		})
+	}
+}
+
+func TestPolicyMatchCriteria(t *testing.T) {
+	RegisterTestingT(t)
+	parse := func(p config.Policy) (*Policy, error) {
+		var rPolicy Policy
+		err := policyMatch(p, &rPolicy)
+		return &rPolicy, err
+	}
+
+	p, err := parse(config.Policy{DstPort: "udp:70-79,80", SrcPort: "udp:1234"})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(p.Proto).To(BeEquivalentTo(unix.IPPROTO_UDP))
+	Expect(p.DstPorts).To(Equal(portRanges{{70, 79}, {80, 80}}))
+	pkt := testPacket(testIPv4UDP())
+	Expect(p.Match(pkt)).To(BeTrue())
+
+	p, err = parse(config.Policy{DstPort: "udp:81-90", SrcPort: "udp:1234"})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(p.Match(pkt)).To(BeFalse())
+	p, err = parse(config.Policy{SrcPort: "udp:1235"})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(p.Match(pkt)).To(BeFalse())
+
+	p, err = parse(config.Policy{Proto: "udp"})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(p.Match(pkt)).To(BeTrue())
+	p, err = parse(config.Policy{Proto: "tcp"})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(p.Match(pkt)).To(BeFalse())
+
+	// Echo request
+	data := testIPv4UDP()
+	data[9] = unix.IPPROTO_ICMP
+	data[20], data[21] = 8, 0
+	icmp := testPacket(data)
+	p, err = parse(config.Policy{Proto: "icmp", ICMP: "8"})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(p.Match(icmp)).To(BeTrue())
+	p, err = parse(config.Policy{Proto: "icmp", ICMP: "8/1"})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(p.Match(icmp)).To(BeFalse())
+	Expect(p.Match(pkt)).To(BeFalse())
+
+	for _, bad := range []config.Policy{
+		{DstPort: "8080"},
+		{DstPort: "tcp:"},
+		{DstPort: "tcp:abc"},
+		{DstPort: "tcp:0"},
+		{DstPort: "tcp:65536"},
+		{DstPort: "tcp:90-80"},
+		{DstPort: "icmp:1"},
+		{DstPort: "tcp:80", SrcPort: "udp:53"},
+		{DstPort: "tcp:80", Proto: "udp"},
+		{Proto: "bogus"},
+		{Proto: "tcp", ICMP: "8"},
+		{Proto: "icmp", ICMP: "256"},
+		{Proto: "icmp", ICMP: "8/x"},
+	} {
+		_, err := parse(bad)
+		Expect(err).To(HaveOccurred(), "%+v", bad)
+	}
+}
+
+func TestPolicyPriorityAndDefault(t *testing.T) {
+	RegisterTestingT(t)
+	registry := testRegistry()
+	table := newPolicyTable()
+	Expect(table.ParseConfig(&config.Config{
+		DefaultAction: "route=127.0.0.1:9000",
+		Policies: []config.Policy{
+			{Name: "wide", DstAddr: "10.0.0.0/8", Action: "drop"},
+			{Name: "corp-egress", Priority: -1, DstAddr: "10.0.0.0/24", Action: "route=127.0.0.1:9001", Device: "tunnel"},
+			{Name: "late", Priority: 10, DstAddr: "10.0.0.0/24", Action: "drop"},
+			{Name: "narrow", DstAddr: "10.0.0.2/32", Action: "drop"},
+		},
+	}, registry)).NotTo(Succeed(), "the default route is ambiguous with two udp devices")
+
+	registry = devs.NewRegistry()
+	registry.Add("drop", config.DeviceDrop, newDrop())
+	registry.Add("tunnel", config.DeviceUDP, newUDPServer(config.Device{}, 1))
+	table = newPolicyTable()
+	Expect(table.ParseConfig(&config.Config{
+		DefaultAction: "route=127.0.0.1:9000",
+		Policies: []config.Policy{
+			{Name: "wide", DstAddr: "10.0.0.0/8", Action: "drop"},
+			{Name: "corp-egress", Priority: -1, DstAddr: "10.0.0.0/24", Action: "route=127.0.0.1:9001"},
+			{Name: "late", Priority: 10, DstAddr: "10.0.0.0/24", Action: "drop"},
+			{Name: "narrow", DstAddr: "10.0.0.2/32", Action: "drop"},
+		},
+	}, registry)).To(Succeed())
+	var names []string
+	for _, stats := range table.Stats() {
+		names = append(names, stats.Name)
+	}
+	Expect(names).To(Equal([]string{"corp-egress", "wide", "narrow", "late", config.DefaultPolicyName}))
+
+	Expect(table.Match(testPacket(testIPv4UDP())).Source.Name).To(Equal("corp-egress"))
+	data := testIPv4UDP()
+	data[16] = 8
+	policy := table.Match(testPacket(data))
+	Expect(policy.Source.Name).To(Equal(config.DefaultPolicyName))
+	Expect(policy.Route.String()).To(Equal("127.0.0.1:9000@1"))
+}
+
+func TestPolicyLenientDefault(t *testing.T) {
+	RegisterTestingT(t)
+	for _, action := range []string{"bogus", "route=127.0.0.1:9000"} {
+		conf := &config.Config{
+			DefaultAction: action,
+			Policies:      []config.Policy{{Name: "narrow", DstAddr: "10.0.0.2/32", Action: "drop"}},
+		}
+		// testRegistry has two udp devices, so the default route is ambiguous.
+		Expect(newPolicyTable().ParseConfig(conf, testRegistry())).NotTo(Succeed(), action)
+
+		conf.Lenient = true
+		table := newPolicyTable()
+		Expect(table.ParseConfig(conf, testRegistry())).To(Succeed(), action)
+		Expect(table.Stats()).To(HaveLen(1))
+		data := testIPv4UDP()
+		data[16] = 8
+		Expect(table.Match(testPacket(data))).To(BeNil())
+	}
+}
@@ -4,20 +4,21 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/mazdakn/uproxy/pkg/devs"
 	"github.com/mazdakn/uproxy/pkg/packet"
 	"golang.org/x/sys/unix"
 )
 
 type proxyDevice struct {
-	connections     *Connections
-	ingress, egress chan *packet.Packet
+	connections *Connections
+
+	devs.Queues
 }
 
 func newProxy() *proxyDevice {
 	return &proxyDevice{
 		connections: newConnections(),
-		ingress:     make(chan *packet.Packet, queueCapacity),
-		egress:      make(chan *packet.Packet, queueCapacity),
+		Queues:      devs.NewQueues(queueCapacity),
 	}
 }
 
@@ -34,18 +35,6 @@ func (p *proxyDevice) Name() string {
 	return "proxy"
 }
 
-func (p proxyDevice) IngressChan() chan<- *packet.Packet {
-	return p.ingress
-}
-
-func (p proxyDevice) EgressChan() <-chan *packet.Packet {
-	return p.egress
-}
-
-func (p *proxyDevice) Read(_ *packet.Packet, _ time.Time) (int, error) {
-	panic("proxy device should never be read")
-}
-
 func (p *proxyDevice) Write(pkt *packet.Packet, _ time.Time) (int, error) {
 	if !protocolSupported(pkt.Protocol()) {
 		return 0, fmt.Errorf("protocol %v not supported", packet.ProtoToString(pkt.Protocol()))
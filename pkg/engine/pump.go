@@ -0,0 +1,214 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/devs"
+	"github.com/mazdakn/uproxy/pkg/packet"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Deadline of a single read or write. It also bounds how long a reader
+	// takes to notice the context has been cancelled.
+	ioTimeout = time.Second
+)
+
+// readDevice reads packets from the device, parses them and hands them to
+// the engine through the device egress channel. Ownership of every packet
+// sent on the channel passes to the receiver.
+func (e *engine) readDevice(ctx context.Context, dev devs.Reader, wg *sync.WaitGroup) {
+	defer wg.Done()
+	name := dev.Name()
+	received := dev.Received()
+	logrus.Infof("Started goroutine reading packets from %v", name)
+
+	for {
+		if ctx.Err() != nil {
+			logrus.Infof("Stopped goroutine reading packets from %v", name)
+			return
+		}
+
+		pkt := e.pool.Get()
+		err := e.receive(dev, pkt)
+		if err == errProbe {
+			e.handleProbe(dev, pkt)
+			continue
+		}
+		if err != nil {
+			e.pool.Put(pkt)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				continue
+			}
+			if errors.Is(err, os.ErrClosed) || errors.Is(err, net.ErrClosed) {
+				logrus.Infof("Stopped goroutine reading packets from closed %v", name)
+				return
+			}
+			logrus.WithError(err).Errorf("Failed to read packet from %v", name)
+			continue
+		}
+
+		select {
+		case received <- pkt:
+		case <-ctx.Done():
+			e.pool.Put(pkt)
+			logrus.Infof("Stopped goroutine reading packets from %v", name)
+			return
+		}
+	}
+}
+
+// errProbe is returned by receive for probes, which are not parsed.
+var errProbe = errors.New("received probe")
+
+// receive reads a single packet from the device and parses it.
+func (e *engine) receive(dev devs.Reader, pkt *packet.Packet) error {
+	n, err := dev.Read(pkt, time.Now().Add(ioTimeout))
+	if err != nil {
+		return err
+	}
+	pkt.Size = n
+	if packet.IsProbe(pkt.Bytes[:n]) {
+		return errProbe
+	}
+	return pkt.Parse()
+}
+
+// writeDevice drains the device ingress channel and writes each packet to
+// the device.
+func (e *engine) writeDevice(ctx context.Context, dev devs.Writer, wg *sync.WaitGroup) {
+	defer wg.Done()
+	name := dev.Name()
+	pending := dev.Pending()
+	logrus.Infof("Started goroutine writing packets to %v", name)
+
+	for {
+		select {
+		case <-ctx.Done():
+			logrus.Infof("Stopped goroutine writing packets to %v", name)
+			return
+		case pkt := <-pending:
+			e.transmit(dev, pkt)
+		}
+	}
+}
+
+// transmit writes the packet to the device and returns it to the pool once
+// the write has completed.
+func (e *engine) transmit(dev devs.Writer, pkt *packet.Packet) {
+	_, err := dev.Write(pkt, time.Now().Add(ioTimeout))
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to write packet %v to %v", pkt, dev.Name())
+	}
+	e.pool.Put(pkt)
+}
+
+// readDeviceBatch is the batched version of readDevice. Pool buffers left
+// unused by a short read are kept for the next one. Packets of a batch are
+// handed to the engine one by one, as each of them is routed on its own and
+// may go to a different device.
+func (e *engine) readDeviceBatch(ctx context.Context, dev devs.BatchReader, wg *sync.WaitGroup) {
+	defer wg.Done()
+	name := dev.Name()
+	received := dev.Received()
+	pkts := make([]*packet.Packet, dev.BatchSize())
+	for i := range pkts {
+		pkts[i] = e.pool.Get()
+	}
+	defer func() {
+		for _, pkt := range pkts {
+			e.pool.Put(pkt)
+		}
+	}()
+	logrus.Infof("Started goroutine reading batches of %v packets from %v", len(pkts), name)
+
+	for {
+		if ctx.Err() != nil {
+			logrus.Infof("Stopped goroutine reading packets from %v", name)
+			return
+		}
+
+		n, err := dev.ReadBatch(pkts, time.Now().Add(ioTimeout))
+		for i := 0; i < n; i++ {
+			pkt := pkts[i]
+			pkts[i] = e.pool.Get()
+			if packet.IsProbe(pkt.Bytes[:pkt.Size]) {
+				e.handleProbe(dev, pkt)
+				continue
+			}
+			if err := pkt.Parse(); err != nil {
+				logrus.WithError(err).Debugf("Failed to parse packet from %v", name)
+				e.pool.Put(pkt)
+				continue
+			}
+			select {
+			case received <- pkt:
+			case <-ctx.Done():
+				e.pool.Put(pkt)
+				logrus.Infof("Stopped goroutine reading packets from %v", name)
+				return
+			}
+		}
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				continue
+			}
+			if errors.Is(err, os.ErrClosed) || errors.Is(err, net.ErrClosed) {
+				logrus.Infof("Stopped goroutine reading packets from closed %v", name)
+				return
+			}
+			logrus.WithError(err).Errorf("Failed to read packets from %v", name)
+		}
+	}
+}
+
+// writeDeviceBatch is the batched version of writeDevice. It blocks for the
+// first packet and then takes whatever else is already pending, up to the
+// device batch size, without waiting. Batches are thus rebuilt from the
+// packets queued while the previous one was written: they fill up under
+// load and shrink to single packets when idle, adding no latency.
+func (e *engine) writeDeviceBatch(ctx context.Context, dev devs.BatchWriter, wg *sync.WaitGroup) {
+	defer wg.Done()
+	name := dev.Name()
+	pending := dev.Pending()
+	pkts := make([]*packet.Packet, 0, dev.BatchSize())
+	logrus.Infof("Started goroutine writing batches of %v packets to %v", cap(pkts), name)
+
+	for {
+		select {
+		case <-ctx.Done():
+			logrus.Infof("Stopped goroutine writing packets to %v", name)
+			return
+		case pkt := <-pending:
+			pkts = append(pkts[:0], pkt)
+		}
+	drain:
+		for len(pkts) < cap(pkts) {
+			select {
+			case pkt := <-pending:
+				pkts = append(pkts, pkt)
+			default:
+				break drain
+			}
+		}
+		e.transmitBatch(dev, pkts)
+	}
+}
+
+// transmitBatch writes the packets to the device and returns all of them to
+// the pool, whether they were written or not.
+func (e *engine) transmitBatch(dev devs.BatchWriter, pkts []*packet.Packet) {
+	n, err := dev.WriteBatch(pkts, time.Now().Add(ioTimeout))
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to write %v of %v packets to %v", len(pkts)-n, len(pkts), dev.Name())
+	}
+	for i, pkt := range pkts {
+		e.pool.Put(pkt)
+		pkts[i] = nil
+	}
+}
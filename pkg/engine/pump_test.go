@@ -0,0 +1,357 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/devs"
+	"github.com/mazdakn/uproxy/pkg/packet"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+// testIPv4UDP returns a minimal IPv4/UDP datagram from 10.0.0.1:1234 to
+// 10.0.0.2:80.
+func testIPv4UDP() []byte {
+	b := make([]byte, 28)
+	b[0] = 0x45
+	b[3] = 28
+	b[8] = 64
+	b[9] = unix.IPPROTO_UDP
+	copy(b[12:16], net.IPv4(10, 0, 0, 1).To4())
+	copy(b[16:20], net.IPv4(10, 0, 0, 2).To4())
+	b[20], b[21] = 0x04, 0xd2
+	b[22], b[23] = 0x00, 0x50
+	b[25] = 8
+	return b
+}
+
+func TestUDPServerPumps(t *testing.T) {
+	RegisterTestingT(t)
+	e := New(&config.Config{MaxBufferSize: 1600})
+	srv := newUDPServer(config.Device{Address: "127.0.0.1:0"}, 0)
+	Expect(srv.Start()).To(Succeed())
+	defer srv.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go e.readDevice(ctx, srv, &wg)
+	go e.writeDevice(ctx, srv, &wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	Expect(err).NotTo(HaveOccurred())
+	defer peer.Close()
+
+	_, err = peer.WriteToUDP(testIPv4UDP(), srv.conn.LocalAddr().(*net.UDPAddr))
+	Expect(err).NotTo(HaveOccurred())
+
+	pkt := <-srv.Egress()
+	Expect(pkt.Len()).To(Equal(28))
+	Expect(pkt.Protocol()).To(BeEquivalentTo(unix.IPPROTO_UDP))
+	Expect(pkt.DstPort()).To(BeEquivalentTo(80))
+	Expect(int(pkt.Meta.Origin.Port())).To(Equal(peer.LocalAddr().(*net.UDPAddr).Port))
+
+	pkt.Meta.Endpoint = peer.LocalAddr().(*net.UDPAddr)
+	srv.Ingress() <- pkt
+
+	buf := make([]byte, 1600)
+	Expect(peer.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+	n, _, err := peer.ReadFromUDP(buf)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(buf[:n]).To(Equal(testIPv4UDP()))
+}
+
+func TestUDPServerBatchPumps(t *testing.T) {
+	RegisterTestingT(t)
+	e := New(&config.Config{MaxBufferSize: 1600})
+	srv := newUDPServer(config.Device{Address: "127.0.0.1:0", BatchSize: 8}, 0)
+	Expect(srv.Start()).To(Succeed())
+	defer srv.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go e.readDeviceBatch(ctx, srv, &wg)
+	go e.writeDeviceBatch(ctx, srv, &wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	Expect(err).NotTo(HaveOccurred())
+	defer peer.Close()
+	peerAddr := peer.LocalAddr().(*net.UDPAddr)
+
+	const count = 3
+	for i := 0; i < count; i++ {
+		_, err = peer.WriteToUDP(testIPv4UDP(), srv.conn.LocalAddr().(*net.UDPAddr))
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	for i := 0; i < count; i++ {
+		pkt := <-srv.Egress()
+		Expect(pkt.Len()).To(Equal(28))
+		Expect(int(pkt.Meta.Origin.Port())).To(Equal(peerAddr.Port))
+		pkt.Meta.Endpoint = peerAddr
+		srv.Ingress() <- pkt
+	}
+
+	buf := make([]byte, 1600)
+	for i := 0; i < count; i++ {
+		Expect(peer.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+		n, _, err := peer.ReadFromUDP(buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(buf[:n]).To(Equal(testIPv4UDP()))
+	}
+}
+
+func TestUDPServerWriteBatchDrops(t *testing.T) {
+	RegisterTestingT(t)
+	srv := newUDPServer(config.Device{Address: "127.0.0.1:0", BatchSize: 8}, 0)
+	Expect(srv.Start()).To(Succeed())
+	defer srv.Stop()
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	Expect(err).NotTo(HaveOccurred())
+	defer peer.Close()
+
+	// Packets without an endpoint, or that cannot be sent, do not hold back
+	// the others.
+	pkts := make([]*packet.Packet, 5)
+	for i := range pkts {
+		pkts[i] = testPacket(testIPv4UDP())
+		pkts[i].Bytes[27] = byte(i)
+		pkts[i].Meta.Endpoint = peer.LocalAddr().(*net.UDPAddr)
+	}
+	pkts[1].Meta.Endpoint = nil
+	pkts[3].Meta.Endpoint = &net.UDPAddr{IP: net.IPv6loopback, Port: 9}
+	n, err := srv.WriteBatch(pkts, time.Now().Add(time.Second))
+	Expect(err).To(MatchError(ContainSubstring("dropped 2 of 5 packets")))
+	Expect(n).To(Equal(3))
+
+	buf := make([]byte, 1600)
+	for _, want := range []byte{0, 2, 4} {
+		Expect(peer.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+		n, _, err := peer.ReadFromUDP(buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(buf[n-1]).To(Equal(want))
+	}
+}
+
+// batchCounter counts the batches read from and written to a udp server.
+type batchCounter struct {
+	*udpServer
+	reads, read     atomic.Int64
+	writes, written atomic.Int64
+}
+
+func (c *batchCounter) ReadBatch(pkts []*packet.Packet, deadline time.Time) (int, error) {
+	n, err := c.udpServer.ReadBatch(pkts, deadline)
+	if n > 0 {
+		c.reads.Add(1)
+		c.read.Add(int64(n))
+	}
+	return n, err
+}
+
+func (c *batchCounter) WriteBatch(pkts []*packet.Packet, deadline time.Time) (int, error) {
+	c.writes.Add(1)
+	c.written.Add(int64(len(pkts)))
+	return c.udpServer.WriteBatch(pkts, deadline)
+}
+
+func TestWriteDeviceBatchFills(t *testing.T) {
+	RegisterTestingT(t)
+	e := New(&config.Config{MaxBufferSize: 1600})
+	srv := newUDPServer(config.Device{Address: "127.0.0.1:0", BatchSize: 16}, 0)
+	Expect(srv.Start()).To(Succeed())
+	defer srv.Stop()
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	Expect(err).NotTo(HaveOccurred())
+	defer peer.Close()
+
+	// Packets queued while the writer is busy go out in full batches.
+	for i := 0; i < 20; i++ {
+		pkt := testPacket(testIPv4UDP())
+		pkt.Meta.Endpoint = peer.LocalAddr().(*net.UDPAddr)
+		srv.Ingress() <- pkt
+	}
+	counter := &batchCounter{udpServer: srv}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go e.writeDeviceBatch(ctx, counter, &wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	Eventually(counter.written.Load).Should(BeEquivalentTo(20))
+	Expect(counter.writes.Load()).To(BeEquivalentTo(2))
+}
+
+// BenchmarkForwardUDPBatches forwards udp datagrams between two batched udp
+// servers through the engine, and reports the batch sizes reached.
+func BenchmarkForwardUDPBatches(b *testing.B) {
+	e := New(&config.Config{MaxBufferSize: 1600})
+	var servers [2]*batchCounter
+	for i := range servers {
+		srv := newUDPServer(config.Device{Address: "127.0.0.1:0", BatchSize: 32}, uint8(i))
+		if err := srv.Start(); err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { srv.Stop() })
+		servers[i] = &batchCounter{udpServer: srv}
+		e.devices.Add(fmt.Sprintf("udp%v", i), config.DeviceUDP, srv)
+	}
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sink.Close()
+	e.policies.Store(compiledTable(Policy{
+		Action: ActionRoute,
+		Device: 1,
+		Route:  &route{endpoints: []endpoint{{addr: sink.LocalAddr().(*net.UDPAddr), weight: 1}}},
+	}))
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer peer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	wg.Add(3)
+	go e.readDeviceBatch(ctx, servers[0], &wg)
+	go e.handleDevice(ctx, servers[0].udpServer, &wg)
+	go e.writeDeviceBatch(ctx, servers[1], &wg)
+	go func() {
+		buf := make([]byte, 1600)
+		for {
+			if _, _, err := sink.ReadFromUDP(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	data := testIPv4UDP()
+	dst := servers[0].conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := peer.WriteToUDPAddrPort(data, dst); err != nil {
+			b.Fatal(err)
+		}
+	}
+	// Wait for the packets still on their way, some may have been lost.
+	for written := int64(-1); written != servers[1].written.Load(); {
+		written = servers[1].written.Load()
+		time.Sleep(50 * time.Millisecond)
+	}
+	b.StopTimer()
+	if reads := servers[0].reads.Load(); reads > 0 {
+		b.ReportMetric(float64(servers[0].read.Load())/float64(reads), "pkts/read")
+	}
+	if writes := servers[1].writes.Load(); writes > 0 {
+		b.ReportMetric(float64(servers[1].written.Load())/float64(writes), "pkts/write")
+	}
+}
+
+// memDevice stands in for a tun device, returning the same packet on every
+// read and discarding every write.
+type memDevice struct {
+	data []byte
+	devs.Queues
+}
+
+func (m *memDevice) Start() error { return nil }
+func (m *memDevice) Stop() error  { return nil }
+func (m *memDevice) Name() string { return "tun://mem" }
+
+func (m *memDevice) Read(pkt *packet.Packet, _ time.Time) (int, error) {
+	return copy(pkt.Bytes, m.data), nil
+}
+
+func (m *memDevice) Write(pkt *packet.Packet, _ time.Time) (int, error) {
+	return pkt.Len(), nil
+}
+
+func setupBenchEngine(b *testing.B) (*engine, *udpServer, *memDevice, *net.UDPConn) {
+	e := New(&config.Config{MaxBufferSize: 1600})
+	srv := newUDPServer(config.Device{Address: "127.0.0.1:0"}, 0)
+	if err := srv.Start(); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { srv.Stop() })
+	tunDev := &memDevice{data: testIPv4UDP(), Queues: devs.NewQueues(queueCapacity)}
+	e.devices.Add("tunnel", config.DeviceUDP, srv)
+	e.devices.Add("local", config.DeviceTun, tunDev)
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { peer.Close() })
+	return e, srv, tunDev, peer
+}
+
+func BenchmarkForwardUDPToTun(b *testing.B) {
+	e, srv, tunDev, peer := setupBenchEngine(b)
+	e.policies.Store(compiledTable(Policy{Action: ActionLocal, Device: 1}))
+	data := testIPv4UDP()
+	dst := srv.conn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := peer.WriteToUDPAddrPort(data, dst); err != nil {
+			b.Fatal(err)
+		}
+		pkt := e.pool.Get()
+		if err := e.receive(srv, pkt); err != nil {
+			b.Fatal(err)
+		}
+		if e.route(pkt) != tunDev {
+			b.Fatal("packet not routed to tun")
+		}
+		e.transmit(tunDev, pkt)
+	}
+}
+
+func BenchmarkForwardTunToUDP(b *testing.B) {
+	e, srv, tunDev, peer := setupBenchEngine(b)
+	e.policies.Store(compiledTable(Policy{
+		Action: ActionRoute,
+		Device: 0,
+		Route:  &route{endpoints: []endpoint{{addr: peer.LocalAddr().(*net.UDPAddr), weight: 1}}},
+	}))
+	buf := make([]byte, 1600)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pkt := e.pool.Get()
+		if err := e.receive(tunDev, pkt); err != nil {
+			b.Fatal(err)
+		}
+		if e.route(pkt) != srv {
+			b.Fatal("packet not routed to udp server")
+		}
+		e.transmit(srv, pkt)
+		if _, _, err := peer.ReadFromUDPAddrPort(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package engine
+
+import (
+	"container/list"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/packet"
+)
+
+const (
+	defaultMaxSources = 65536
+)
+
+// tokenBucket holds up to burst tokens, refilled at rate tokens per second.
+// Every packet allowed takes one.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) allow(now time.Time, rate, burst float64) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type sourceBucket struct {
+	addr netip.Addr
+	tokenBucket
+}
+
+// rateLimiter enforces a rate on the packets of a policy, with a single
+// bucket or one per source address. Source buckets are kept in least
+// recently used order, evicting the oldest when there are too many. Buckets
+// idle long enough to be full again are evicted as well, as they are no
+// different from a new one.
+type rateLimiter struct {
+	rate, burst float64
+	// Time taken by an empty bucket to fill up.
+	fill time.Duration
+
+	lock       sync.Mutex
+	bucket     tokenBucket
+	perSource  bool
+	maxSources int
+	sources    map[netip.Addr]*list.Element
+	lru        *list.List
+}
+
+func newRateLimiter(conf config.RateLimit) (*rateLimiter, error) {
+	if conf.Rate <= 0 {
+		return nil, fmt.Errorf("invalid rate %v", conf.Rate)
+	}
+	if conf.Burst < 0 || conf.MaxSources < 0 {
+		return nil, fmt.Errorf("invalid burst %v or max sources %v", conf.Burst, conf.MaxSources)
+	}
+	burst := float64(conf.Burst)
+	if burst == 0 {
+		burst = conf.Rate
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	l := &rateLimiter{
+		rate:       conf.Rate,
+		burst:      burst,
+		fill:       time.Duration(burst / conf.Rate * float64(time.Second)),
+		perSource:  conf.PerSource,
+		maxSources: conf.MaxSources,
+	}
+	l.bucket.tokens = burst
+	if l.perSource {
+		if l.maxSources == 0 {
+			l.maxSources = defaultMaxSources
+		}
+		l.sources = make(map[netip.Addr]*list.Element)
+		l.lru = list.New()
+	}
+	return l, nil
+}
+
+// allow takes a token for the packet, returning false when it is over the
+// limit.
+func (l *rateLimiter) allow(pkt *packet.Packet, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.perSource {
+		return l.bucket.allow(now, l.rate, l.burst)
+	}
+	addr, _ := netip.AddrFromSlice(pkt.SrcAddr())
+	return l.source(addr.Unmap(), now).allow(now, l.rate, l.burst)
+}
+
+// source returns the bucket of the address, creating it if needed.
+func (l *rateLimiter) source(addr netip.Addr, now time.Time) *sourceBucket {
+	l.evictIdle(now)
+	if elem, ok := l.sources[addr]; ok {
+		l.lru.MoveToFront(elem)
+		return elem.Value.(*sourceBucket)
+	}
+	if l.lru.Len() >= l.maxSources {
+		l.remove(l.lru.Back())
+	}
+	b := &sourceBucket{addr: addr, tokenBucket: tokenBucket{tokens: l.burst, last: now}}
+	l.sources[addr] = l.lru.PushFront(b)
+	return b
+}
+
+func (l *rateLimiter) evictIdle(now time.Time) {
+	for elem := l.lru.Back(); elem != nil; elem = l.lru.Back() {
+		if now.Sub(elem.Value.(*sourceBucket).last) < l.fill {
+			return
+		}
+		l.remove(elem)
+	}
+}
+
+func (l *rateLimiter) remove(elem *list.Element) {
+	delete(l.sources, elem.Value.(*sourceBucket).addr)
+	l.lru.Remove(elem)
+}
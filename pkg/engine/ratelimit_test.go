@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/devs"
+	"github.com/mazdakn/uproxy/pkg/packet"
+	. "github.com/onsi/gomega"
+)
+
+// fromSource returns the test packet with the last byte of its source
+// address set.
+func fromSource(last byte) *packet.Packet {
+	data := testIPv4UDP()
+	data[15] = last
+	return testPacket(data)
+}
+
+func TestRateLimit(t *testing.T) {
+	RegisterTestingT(t)
+	l, err := newRateLimiter(config.RateLimit{Rate: 10, Burst: 5})
+	Expect(err).NotTo(HaveOccurred())
+	now := time.Now()
+	pkt := fromSource(1)
+	for i := 0; i < 5; i++ {
+		Expect(l.allow(pkt, now)).To(BeTrue())
+	}
+	Expect(l.allow(pkt, now)).To(BeFalse())
+	// 10 packets per second, one token is back after 100ms.
+	Expect(l.allow(fromSource(2), now.Add(50*time.Millisecond))).To(BeFalse())
+	Expect(l.allow(pkt, now.Add(110*time.Millisecond))).To(BeTrue())
+	Expect(l.allow(pkt, now.Add(110*time.Millisecond))).To(BeFalse())
+
+	for _, bad := range []config.RateLimit{{Rate: -1}, {Burst: 3}, {Rate: 1, Burst: -1}} {
+		_, err := newRateLimiter(bad)
+		Expect(err).To(HaveOccurred(), "%+v", bad)
+	}
+}
+
+func TestRateLimitPerSource(t *testing.T) {
+	RegisterTestingT(t)
+	l, err := newRateLimiter(config.RateLimit{Rate: 1, Burst: 1, PerSource: true, MaxSources: 2})
+	Expect(err).NotTo(HaveOccurred())
+	now := time.Now()
+	Expect(l.allow(fromSource(1), now)).To(BeTrue())
+	Expect(l.allow(fromSource(1), now)).To(BeFalse())
+	Expect(l.allow(fromSource(2), now)).To(BeTrue())
+
+	// The least recently used source makes room for a new one.
+	Expect(l.allow(fromSource(3), now)).To(BeTrue())
+	Expect(l.sources).To(HaveLen(2))
+	Expect(l.allow(fromSource(2), now)).To(BeFalse())
+	Expect(l.allow(fromSource(1), now)).To(BeTrue())
+
+	// Buckets idle long enough to be full are evicted.
+	Expect(l.allow(fromSource(4), now.Add(500*time.Millisecond))).To(BeTrue())
+	Expect(l.sources).To(HaveLen(2))
+	l.evictIdle(now.Add(1200 * time.Millisecond))
+	Expect(l.sources).To(HaveLen(1))
+	l.evictIdle(now.Add(2 * time.Second))
+	Expect(l.sources).To(BeEmpty())
+}
+
+func TestRouteRateLimited(t *testing.T) {
+	RegisterTestingT(t)
+	e := New(&config.Config{MaxBufferSize: 1600})
+	e.devices = testRegistry()
+	local := &memDevice{Queues: devs.NewQueues(queueCapacity)}
+	e.devices.Add("local", config.DeviceTun, local)
+	policies := newPolicyTable()
+	Expect(policies.ParseConfig(&config.Config{Policies: []config.Policy{{
+		DstAddr:   "0.0.0.0/0",
+		Action:    "local",
+		RateLimit: config.RateLimit{Rate: 1, Burst: 2, PerSource: true},
+	}}}, e.devices)).To(Succeed())
+	e.storePolicies(policies)
+
+	drop := e.devices.Device(policies.policies[0].LimitDrop).(*dropDevice)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go e.handleDevice(ctx, local, &wg)
+	go e.writeDevice(ctx, drop, &wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	forward := func(pkts ...*packet.Packet) {
+		for _, pkt := range pkts {
+			local.Received() <- pkt
+		}
+	}
+
+	// The third packet of a source exceeds its burst and is dropped.
+	forward(fromSource(1), fromSource(1), fromSource(1), fromSource(2))
+	Eventually(drop.counter.Load).Should(BeEquivalentTo(1))
+	Eventually(local.Pending()).Should(HaveLen(3))
+
+	// Reloading the policy keeps its buckets.
+	reloaded := newPolicyTable()
+	Expect(reloaded.ParseConfig(&config.Config{Policies: []config.Policy{policies.policies[0].Source}}, e.devices)).To(Succeed())
+	e.storePolicies(reloaded)
+	Expect(reloaded.policies[0].Limit).To(BeIdenticalTo(policies.policies[0].Limit))
+	forward(fromSource(1), fromSource(2))
+	Eventually(drop.counter.Load).Should(BeEquivalentTo(2))
+	Eventually(local.Pending()).Should(HaveLen(4))
+	Consistently(drop.counter.Load).Should(BeEquivalentTo(2))
+}
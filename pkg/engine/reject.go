@@ -0,0 +1,32 @@
+package engine
+
+import (
+	"net"
+
+	"github.com/mazdakn/uproxy/pkg/packet"
+	"github.com/sirupsen/logrus"
+)
+
+// reject sends the reply rejecting the packet back to the device it was
+// read from. The reply is dropped rather than waited for when the device is
+// busy.
+func (e *engine) reject(pkt *packet.Packet) {
+	dev := e.devices.Device(pkt.Meta.SrcIndex)
+	if dev == nil {
+		return
+	}
+	reply := e.pool.Get()
+	if err := reply.BuildReject(pkt); err != nil {
+		logrus.WithError(err).Debug("Not rejecting packet")
+		e.pool.Put(reply)
+		return
+	}
+	if pkt.Meta.Origin.IsValid() {
+		reply.Meta.Endpoint = net.UDPAddrFromAddrPort(pkt.Meta.Origin)
+	}
+	select {
+	case ingress(dev, reply) <- reply:
+	default:
+		e.pool.Put(reply)
+	}
+}
@@ -0,0 +1,34 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/devs"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+func TestRouteReject(t *testing.T) {
+	RegisterTestingT(t)
+	e := New(&config.Config{MaxBufferSize: 1600})
+	e.devices = testRegistry()
+	local := &memDevice{Queues: devs.NewQueues(queueCapacity)}
+	index := e.devices.Add("local", config.DeviceTun, local)
+	policies := newPolicyTable()
+	Expect(policies.ParseConfig(&config.Config{Policies: []config.Policy{
+		{DstAddr: "0.0.0.0/0", Action: "reject"},
+	}}, e.devices)).To(Succeed())
+	e.storePolicies(policies)
+
+	pkt := testPacket(testIPv4UDP())
+	pkt.Meta.SrcIndex = index
+	Expect(e.route(pkt)).To(BeIdenticalTo(e.devices.Device(0)))
+
+	reply := <-local.Pending()
+	Expect(reply.Parse()).To(Succeed())
+	Expect(reply.Protocol()).To(BeEquivalentTo(unix.IPPROTO_ICMP))
+	Expect(reply.DstAddr().String()).To(Equal("10.0.0.1"))
+	typ, code, _ := reply.ICMPTypeCode()
+	Expect([]uint8{typ, code}).To(Equal([]uint8{3, 3}))
+}
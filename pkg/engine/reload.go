@@ -0,0 +1,72 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+// handleReloads reloads the policies every time SIGHUP is received on the
+// channel, SIGHUP received while starting included.
+func (e *engine) handleReloads(ctx context.Context, wg *sync.WaitGroup, sighup <-chan os.Signal) {
+	defer wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+			logrus.Infof("Received SIGHUP, reloading %v", e.conf.File)
+			if err := e.reload(); err != nil {
+				logrus.WithError(err).Error("Rejected config reload, keeping current policies")
+			}
+		}
+	}
+}
+
+// reload re-reads the config file and builds a new policy table from it,
+// which then atomically replaces the one used by the running goroutines.
+// Devices and health check settings are not reloaded, though the config is
+// kept for the next reloads.
+func (e *engine) reload() error {
+	if e.conf.File == "" {
+		return fmt.Errorf("config was not loaded from a file")
+	}
+	conf, err := config.FromFile(e.conf.File)
+	if err != nil {
+		return err
+	}
+	conf.Lenient = e.conf.Lenient
+	if err := conf.Check(); err != nil {
+		return err
+	}
+	policies := newPolicyTable()
+	if err := policies.ParseConfig(conf, e.devices); err != nil {
+		return err
+	}
+	old := e.storePolicies(policies)
+
+	if devices := conf.DeviceConfigs(); !reflect.DeepEqual(devices, e.fileDevices) {
+		if !reflect.DeepEqual(devices, e.conf.DeviceConfigs()) {
+			logrus.Warn("Device changes are ignored on reload, a restart is required to apply them")
+		}
+		e.fileDevices = devices
+	}
+	conf.Devices, conf.Address, conf.BatchSize, conf.Tun = e.conf.Devices, e.conf.Address, e.conf.BatchSize, e.conf.Tun
+	e.conf = conf
+
+	added, removed := diffPolicies(old, policies)
+	for _, p := range added {
+		logrus.Infof("Reload added policy %+v", p)
+	}
+	for _, p := range removed {
+		logrus.Infof("Reload removed policy %+v", p)
+	}
+	logrus.Infof("Reloaded %v policies (%v added, %v removed)", len(policies.policies), len(added), len(removed))
+	return nil
+}
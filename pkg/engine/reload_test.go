@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func writeConfig(path, policies string) {
+	data := "devices:\n  - name: tunnel\n    type: udp\n    address: 127.0.0.1:0\npolicies:\n" + policies
+	Expect(os.WriteFile(path, []byte(data), 0o600)).To(Succeed())
+}
+
+func TestReload(t *testing.T) {
+	RegisterTestingT(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(path, "  - dstAddr: 10.0.0.0/8\n    action: drop\n")
+	conf, err := config.FromFile(path)
+	Expect(err).NotTo(HaveOccurred())
+
+	e := New(conf)
+	Expect(e.devices.Create(conf.DeviceConfigs())).To(Succeed())
+	Expect(e.policies.Load().ParseConfig(conf, e.devices)).To(Succeed())
+	old := e.policies.Load()
+
+	writeConfig(path, "  - dstAddr: 10.0.0.0/8\n    action: drop\n  - dstAddr: 0.0.0.0/0\n    action: route=127.0.0.1:9000\n")
+	Expect(e.reload()).To(Succeed())
+	current := e.policies.Load()
+	Expect(current).NotTo(BeIdenticalTo(old))
+	Expect(current.policies).To(HaveLen(2))
+
+	added, removed := diffPolicies(old, current)
+	Expect(added).To(Equal([]config.Policy{{DstAddr: "0.0.0.0/0", Action: "route=127.0.0.1:9000"}}))
+	Expect(removed).To(BeEmpty())
+
+	// Broken files and unknown devices are rejected, keeping the table.
+	Expect(os.WriteFile(path, []byte("policies: [\n"), 0o600)).To(Succeed())
+	Expect(e.reload()).NotTo(Succeed())
+	writeConfig(path, "  - dstAddr: 0.0.0.0/0\n    action: drop\n    device: missing\n")
+	Expect(e.reload()).NotTo(Succeed())
+	Expect(e.policies.Load()).To(BeIdenticalTo(current))
+}
+
+func TestReloadDeviceChanges(t *testing.T) {
+	RegisterTestingT(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(path, "  - dstAddr: 10.0.0.0/8\n    action: drop\n")
+	conf, err := config.FromFile(path)
+	Expect(err).NotTo(HaveOccurred())
+	e := New(conf)
+	Expect(e.devices.Create(conf.DeviceConfigs())).To(Succeed())
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	warnings := func() int {
+		n := 0
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == logrus.WarnLevel {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Device changes are warned about once, the running devices being kept.
+	data := "devices:\n  - name: tunnel\n    type: udp\n    address: 127.0.0.1:9999\n" +
+		"policies:\n  - dstAddr: 10.0.0.0/8\n    action: drop\n"
+	Expect(os.WriteFile(path, []byte(data), 0o600)).To(Succeed())
+	Expect(e.reload()).To(Succeed())
+	Expect(warnings()).To(Equal(1))
+	Expect(e.reload()).To(Succeed())
+	Expect(warnings()).To(Equal(1))
+	Expect(e.conf.Devices[0].Address).To(Equal("127.0.0.1:0"))
+
+	// Reverting them to the running devices is not warned about.
+	writeConfig(path, "  - dstAddr: 10.0.0.0/8\n    action: drop\n")
+	Expect(e.reload()).To(Succeed())
+	Expect(warnings()).To(Equal(1))
+	Expect(os.WriteFile(path, []byte(data), 0o600)).To(Succeed())
+	Expect(e.reload()).To(Succeed())
+	Expect(warnings()).To(Equal(2))
+}
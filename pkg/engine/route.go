@@ -0,0 +1,149 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+)
+
+type endpoint struct {
+	addr   *net.UDPAddr
+	weight float64
+	seed   uint64
+	// Set when endpoints are health checked, nil endpoints are always up.
+	health *endpointHealth
+}
+
+func (ep *endpoint) up() bool {
+	return ep.health == nil || ep.health.up.Load()
+}
+
+// route spreads flows over weighted endpoints with rendezvous hashing: each
+// flow goes to the endpoint with the highest weighted score for its hash.
+// Flows stick to their endpoint, and adding or removing an endpoint only
+// moves the flows won or lost by that endpoint. Endpoints marked down are
+// skipped, and backups take over when every endpoint is down.
+type route struct {
+	endpoints []endpoint
+	backups   []endpoint
+}
+
+// parseRoute parses a comma separated list of host:port endpoints, each
+// with an optional @weight suffix.
+func parseRoute(spec string) (*route, error) {
+	endpoints, err := parseEndpoints(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &route{endpoints: endpoints}, nil
+}
+
+// setBackups parses the backup endpoints of the route, in the same format
+// as the route itself.
+func (r *route) setBackups(spec string) error {
+	backups, err := parseEndpoints(spec)
+	if err != nil {
+		return err
+	}
+	r.backups = backups
+	return nil
+}
+
+func parseEndpoints(spec string) ([]endpoint, error) {
+	specs, err := config.ParseEndpoints(spec)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := make([]endpoint, 0, len(specs))
+	for _, ep := range specs {
+		udpAddr, err := net.ResolveUDPAddr("udp", ep.Addr)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, endpoint{
+			addr:   udpAddr,
+			weight: float64(ep.Weight),
+			seed:   hashString(udpAddr.String()),
+		})
+	}
+	return endpoints, nil
+}
+
+// pick returns the endpoint of the flow with the given hash. When every
+// endpoint and backup is down, flows keep going to the endpoints they would
+// use if all were up.
+func (r *route) pick(flowHash uint32) *net.UDPAddr {
+	if len(r.endpoints) == 1 && r.endpoints[0].up() {
+		return r.endpoints[0].addr
+	}
+	if best := rendezvous(r.endpoints, flowHash, true); best != nil {
+		return best
+	}
+	if best := rendezvous(r.backups, flowHash, true); best != nil {
+		return best
+	}
+	return rendezvous(r.endpoints, flowHash, false)
+}
+
+// rendezvous returns the endpoint with the highest score for the flow, only
+// considering endpoints that are up when onlyUp is set.
+func rendezvous(endpoints []endpoint, flowHash uint32, onlyUp bool) *net.UDPAddr {
+	var best *net.UDPAddr
+	bestScore := math.Inf(-1)
+	for i := range endpoints {
+		ep := &endpoints[i]
+		if onlyUp && !ep.up() {
+			continue
+		}
+		if score := ep.score(flowHash); score > bestScore {
+			best, bestScore = ep.addr, score
+		}
+	}
+	return best
+}
+
+// score maps the flow hash mixed with the endpoint seed to a uniform value
+// in (0, 1) and weights it so endpoints win in proportion to their weight.
+func (ep *endpoint) score(flowHash uint32) float64 {
+	h := mix64(uint64(flowHash) ^ ep.seed)
+	u := (float64(h>>11) + 1) / (1 << 53)
+	return -ep.weight / math.Log(u)
+}
+
+func (r *route) String() string {
+	s := formatEndpoints(r.endpoints)
+	if len(r.backups) > 0 {
+		s += " backup " + formatEndpoints(r.backups)
+	}
+	return s
+}
+
+func formatEndpoints(endpoints []endpoint) string {
+	items := make([]string, len(endpoints))
+	for i, ep := range endpoints {
+		items[i] = fmt.Sprintf("%v@%v", ep.addr, ep.weight)
+	}
+	return strings.Join(items, ",")
+}
+
+// mix64 is the splitmix64 finalizer.
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+func hashString(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return h
+}
@@ -0,0 +1,49 @@
+package engine
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestParseRoute(t *testing.T) {
+	RegisterTestingT(t)
+	r, err := parseRoute("10.0.0.1:8888@3, 10.0.0.2:8888")
+	Expect(err).NotTo(HaveOccurred())
+	Expect(r.endpoints).To(HaveLen(2))
+	Expect(r.endpoints[0].weight).To(BeEquivalentTo(3))
+	Expect(r.endpoints[1].weight).To(BeEquivalentTo(1))
+	Expect(r.String()).To(Equal("10.0.0.1:8888@3,10.0.0.2:8888@1"))
+
+	for _, bad := range []string{"", "10.0.0.1", "10.0.0.1:8888@0", "10.0.0.1:8888@x"} {
+		_, err := parseRoute(bad)
+		Expect(err).To(HaveOccurred(), bad)
+	}
+}
+
+func TestRouteConsistentHashing(t *testing.T) {
+	RegisterTestingT(t)
+	const flows = 30000
+	all, err := parseRoute("10.0.0.1:1@2,10.0.0.2:1,10.0.0.3:1")
+	Expect(err).NotTo(HaveOccurred())
+	reduced, err := parseRoute("10.0.0.1:1@2,10.0.0.3:1")
+	Expect(err).NotTo(HaveOccurred())
+
+	counts := map[string]int{}
+	for i := uint32(0); i < flows; i++ {
+		hash := i * 2654435761
+		before := all.pick(hash)
+		Expect(all.pick(hash)).To(BeIdenticalTo(before))
+		counts[before.String()]++
+
+		// Only flows of the removed endpoint move.
+		after := reduced.pick(hash)
+		if before.String() != "10.0.0.2:1" {
+			Expect(after.String()).To(Equal(before.String()))
+		}
+	}
+	// The weight 2 endpoint gets about half of the flows.
+	Expect(counts["10.0.0.1:1"]).To(BeNumerically("~", flows/2, flows/20))
+	Expect(counts["10.0.0.2:1"]).To(BeNumerically("~", flows/4, flows/20))
+	Expect(counts["10.0.0.3:1"]).To(BeNumerically("~", flows/4, flows/20))
+}
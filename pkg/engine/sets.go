@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/packet"
+)
+
+// addrSet is a named list of networks compiled into a prefix trie.
+type addrSet struct {
+	name string
+	nets prefixTrie[struct{}]
+	size int
+}
+
+func (s *addrSet) contains(ip net.IP) bool {
+	return s.nets.contains(keyFromIP(ip))
+}
+
+func (s *addrSet) add(cidr string) error {
+	_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		return err
+	}
+	netPrefixes(ipNet, func(key key128, l int) {
+		s.nets.insert(key, l)
+	})
+	s.size++
+	return nil
+}
+
+// setMatch matches an address against a set, or against its complement
+// when negated.
+type setMatch struct {
+	set    *addrSet
+	negate bool
+}
+
+func (m *setMatch) match(ip net.IP) bool {
+	return m.set.contains(ip) != m.negate
+}
+
+// compileSets builds the configured sets. Set files are read relative to the
+// directory of the config file.
+func compileSets(conf *config.Config) (map[string]*addrSet, error) {
+	sets := make(map[string]*addrSet, len(conf.Sets))
+	for _, s := range conf.Sets {
+		if s.Name == "" {
+			return nil, fmt.Errorf("set name is required")
+		}
+		if _, exists := sets[s.Name]; exists {
+			return nil, fmt.Errorf("duplicate set name %q", s.Name)
+		}
+		set := &addrSet{name: s.Name}
+		for _, cidr := range s.CIDRs {
+			if err := set.add(cidr); err != nil {
+				return nil, fmt.Errorf("invalid cidr in set %q - err: %w", s.Name, err)
+			}
+		}
+		if s.File != "" {
+			path := s.File
+			if !filepath.IsAbs(path) && conf.File != "" {
+				path = filepath.Join(filepath.Dir(conf.File), path)
+			}
+			if err := set.load(path); err != nil {
+				return nil, fmt.Errorf("failed to load set %q - err: %w", s.Name, err)
+			}
+		}
+		sets[s.Name] = set
+	}
+	return sets, nil
+}
+
+// load adds the networks listed in the file, one per line. Empty lines and
+// lines starting with # are ignored.
+func (s *addrSet) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err := s.add(text); err != nil {
+			return fmt.Errorf("%v:%v: %w", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// policySet resolves a set reference, a leading ! negating it.
+func policySet(ref string, sets map[string]*addrSet) (*setMatch, error) {
+	if ref == "" {
+		return nil, nil
+	}
+	name, negate := strings.CutPrefix(ref, "!")
+	set, ok := sets[name]
+	if !ok {
+		return nil, fmt.Errorf("set %q does not exist", name)
+	}
+	return &setMatch{set: set, negate: negate}, nil
+}
+
+// matchSets checks the set criteria of the policy.
+func (p *Policy) matchSets(pkt *packet.Packet) bool {
+	if p.DstSet != nil && !p.DstSet.match(pkt.DstAddr()) {
+		return false
+	}
+	if p.SrcSet != nil && !p.SrcSet.match(pkt.SrcAddr()) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	. "github.com/onsi/gomega"
+)
+
+func TestSets(t *testing.T) {
+	RegisterTestingT(t)
+	dir := t.TempDir()
+	Expect(os.WriteFile(filepath.Join(dir, "corp.txt"),
+		[]byte("# corporate networks\n10.0.0.0/24\n\n2001:db8::/32\n"), 0o600)).To(Succeed())
+
+	conf := &config.Config{
+		File: filepath.Join(dir, "config.yaml"),
+		Sets: []config.Set{
+			{Name: "corp-nets", CIDRs: []string{"172.16.0.0/12"}, File: "corp.txt"},
+			{Name: "clients", CIDRs: []string{"10.0.0.1/32"}},
+		},
+		Policies: []config.Policy{
+			{DstSet: "!corp-nets", SrcSet: "clients", Action: "route=127.0.0.1:9000"},
+			{DstSet: "corp-nets", Action: "drop"},
+		},
+	}
+	Expect(newPolicyTable().ParseConfig(conf, testRegistry())).NotTo(Succeed())
+
+	conf.Policies[0].Device = "tunnel"
+	table := newPolicyTable()
+	Expect(table.ParseConfig(conf, testRegistry())).To(Succeed())
+
+	// 10.0.0.1 -> 10.0.0.2 is within corp-nets
+	pkt := testPacket(testIPv4UDP())
+	Expect(table.Match(pkt).Action).To(Equal(ActionDrop))
+
+	data := testIPv4UDP()
+	data[16] = 8
+	Expect(table.Match(testPacket(data)).Action).To(Equal(ActionRoute))
+	data[15] = 2
+	Expect(table.Match(testPacket(data))).To(BeIdenticalTo(table.defaultPolicy))
+
+	// IPv6 networks do not hold IPv4 addresses unless within ::ffff:0:0/96.
+	v6 := &config.Config{
+		Sets:     []config.Set{{Name: "v6", CIDRs: []string{"::/0"}}},
+		Policies: []config.Policy{{DstSet: "v6", Action: "drop"}},
+	}
+	table = newPolicyTable()
+	Expect(table.ParseConfig(v6, testRegistry())).To(Succeed())
+	Expect(table.Match(testPacket(testIPv4UDP()))).To(BeIdenticalTo(table.defaultPolicy))
+	set := &addrSet{}
+	for _, cidr := range []string{"::/8", "2001:db8::/32", "::ffff:10.0.0.0/104"} {
+		Expect(set.add(cidr)).To(Succeed())
+	}
+	for ip, contained := range map[string]bool{
+		"::1":          true,
+		"2001:db8::1":  true,
+		"2001:db9::1":  false,
+		"10.0.0.1":     true,
+		"11.0.0.1":     false,
+		"::ffff:b00:1": false,
+	} {
+		Expect(set.contains(net.ParseIP(ip))).To(Equal(contained), ip)
+	}
+
+	for _, bad := range []config.Config{
+		{Sets: []config.Set{{Name: "a", CIDRs: []string{"10.0.0.0/33"}}}},
+		{Sets: []config.Set{{Name: "a"}, {Name: "a"}}},
+		{Sets: []config.Set{{Name: "a", File: filepath.Join(dir, "missing.txt")}}},
+		{Policies: []config.Policy{{DstSet: "missing", Action: "drop"}}},
+	} {
+		Expect(newPolicyTable().ParseConfig(&bad, testRegistry())).NotTo(Succeed())
+	}
+}
@@ -2,6 +2,7 @@ package engine
 
 import (
 	"context"
+	"os"
 	"os/signal"
 	"syscall"
 )
@@ -9,3 +10,11 @@ import (
 func setupSignals() (context.Context, context.CancelFunc) {
 	return signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 }
+
+// setupReload returns a channel receiving SIGHUP, and the function to stop
+// receiving it.
+func setupReload() (<-chan os.Signal, func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	return ch, func() { signal.Stop(ch) }
+}
@@ -0,0 +1,105 @@
+package engine
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/packet"
+)
+
+const (
+	// Counters are split over stripes picked by flow hash, so goroutines
+	// handling different flows mostly update different cache lines.
+	counterStripes = 16
+)
+
+type counterStripe struct {
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+	lastHit atomic.Int64
+	_       [40]byte
+}
+
+// policyCounters counts the packets and bytes matched by a policy.
+type policyCounters struct {
+	stripes [counterStripes]counterStripe
+}
+
+func (c *policyCounters) hit(pkt *packet.Packet, now time.Time) {
+	s := &c.stripes[pkt.FlowHash()%counterStripes]
+	s.packets.Add(1)
+	s.bytes.Add(uint64(pkt.Len()))
+	s.lastHit.Store(now.UnixNano())
+}
+
+// PolicyStats are the counters of a policy.
+type PolicyStats struct {
+	// Name of the policy, empty for unnamed ones.
+	Name    string        `json:"name"`
+	Policy  config.Policy `json:"policy"`
+	Packets uint64        `json:"packets"`
+	Bytes   uint64        `json:"bytes"`
+	// Zero when the policy never matched.
+	LastHit time.Time `json:"lastHit"`
+}
+
+func (c *policyCounters) stats() PolicyStats {
+	var stats PolicyStats
+	var lastHit int64
+	for i := range c.stripes {
+		s := &c.stripes[i]
+		stats.Packets += s.packets.Load()
+		stats.Bytes += s.bytes.Load()
+		if hit := s.lastHit.Load(); hit > lastHit {
+			lastHit = hit
+		}
+	}
+	if lastHit != 0 {
+		stats.LastHit = time.Unix(0, lastHit)
+	}
+	return stats
+}
+
+// Stats returns the counters of the policies in table order, followed by
+// the counters of the default action.
+func (t *PolicyTable) Stats() []PolicyStats {
+	all := t.all()
+	stats := make([]PolicyStats, len(all))
+	for i, p := range all {
+		if p.counters != nil {
+			stats[i] = p.counters.stats()
+		}
+		stats[i].Name = p.Source.Name
+		stats[i].Policy = p.Source
+	}
+	return stats
+}
+
+// inheritCounters makes the policies of the table found unchanged in the
+// old one keep counting where they left off, and keep the tokens left in
+// their rate limits.
+func (t *PolicyTable) inheritCounters(old *PolicyTable) {
+	previous := make(map[config.Policy][]*Policy, len(old.policies)+1)
+	for _, p := range old.all() {
+		previous[p.Source] = append(previous[p.Source], p)
+	}
+	for _, p := range t.all() {
+		found := previous[p.Source]
+		if len(found) == 0 {
+			continue
+		}
+		if found[0].counters != nil {
+			p.counters = found[0].counters
+		}
+		if found[0].Limit != nil {
+			p.Limit = found[0].Limit
+		}
+		previous[p.Source] = found[1:]
+	}
+}
+
+// PolicyStats returns the counters of the policies in use.
+func (e *engine) PolicyStats() []PolicyStats {
+	return e.policies.Load().Stats()
+}
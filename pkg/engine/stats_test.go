@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	. "github.com/onsi/gomega"
+)
+
+func TestPolicyStats(t *testing.T) {
+	RegisterTestingT(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(path, "  - dstAddr: 10.0.0.0/8\n    action: drop\n  - dstAddr: 0.0.0.0/0\n    action: drop\n")
+	conf, err := config.FromFile(path)
+	Expect(err).NotTo(HaveOccurred())
+	e := New(conf)
+	Expect(e.devices.Create(conf.DeviceConfigs())).To(Succeed())
+	policies := newPolicyTable()
+	Expect(policies.ParseConfig(conf, e.devices)).To(Succeed())
+	e.storePolicies(policies)
+
+	for i := 0; i < 3; i++ {
+		Expect(e.route(testPacket(testIPv4UDP()))).NotTo(BeNil())
+	}
+	stats := e.PolicyStats()
+	Expect(stats).To(HaveLen(3))
+	Expect(stats[2].Name).To(Equal(config.DefaultPolicyName))
+	Expect(stats[0].Policy).To(Equal(conf.Policies[0]))
+	Expect(stats[0].Packets).To(BeEquivalentTo(3))
+	Expect(stats[0].Bytes).To(BeEquivalentTo(3 * 28))
+	Expect(stats[0].LastHit.IsZero()).To(BeFalse())
+	Expect(stats[1].Packets).To(BeZero())
+	Expect(stats[1].LastHit.IsZero()).To(BeTrue())
+
+	// Unchanged policies keep their counters across reloads.
+	writeConfig(path, "  - dstAddr: 10.0.0.0/8\n    action: drop\n  - dstAddr: 10.0.0.0/8\n    action: drop\n")
+	Expect(e.reload()).To(Succeed())
+	Expect(e.route(testPacket(testIPv4UDP()))).NotTo(BeNil())
+	stats = e.PolicyStats()
+	Expect(stats[0].Packets).To(BeEquivalentTo(4))
+	Expect(stats[1].Packets).To(BeZero())
+
+	rec := httptest.NewRecorder()
+	e.adminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/stats/policies", nil))
+	var served []PolicyStats
+	Expect(json.Unmarshal(rec.Body.Bytes(), &served)).To(Succeed())
+	Expect(served).To(HaveLen(3))
+	Expect(served[0].Packets).To(BeEquivalentTo(4))
+}
@@ -0,0 +1,631 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/conntrack"
+	"github.com/mazdakn/uproxy/pkg/devs"
+	"github.com/mazdakn/uproxy/pkg/packet"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Conntrack sync messages each carry a change of a flow. They are framed by
+// their length, so several fit in a datagram and they can be streamed over
+// tcp, and authenticated with the key shared by the peers. All fields are
+// big endian:
+//
+//	length     2 bytes, of the rest of the message
+//	version    1
+//	type       1, the conntrack event type
+//	proto      1
+//	flags      1, syncEstablished, syncEndpoint and syncOutEndpoint
+//	tcp state  1
+//	scales     2, window scales of the original and reply directions
+//	reserved   1
+//	src, dst   16 each, IPv4-mapped for IPv4
+//	ports      2 each
+//	endpoint   18, address and port replies are sent to
+//	out        18, address and port the flow is sent to
+//	packets    8 each way
+//	bytes      8 each way
+//	age, idle  8 each, in nanoseconds
+//	devices    names of the in and out devices, each a byte of length
+//	           followed by the name
+//	mac        32, HMAC-SHA256 of the message up to it
+const (
+	syncVersion  = 1
+	syncFixedLen = 128
+	syncMACLen   = sha256.Size
+
+	syncEstablished = 1 << 0
+	syncEndpoint    = 1 << 1
+	syncOutEndpoint = 1 << 2
+
+	defaultSyncInterval = 10 * time.Second
+	// Messages are batched in datagrams of at most this size, which fits
+	// common paths without fragmentation.
+	maxSyncDatagram = 1400
+	syncEventBuffer = 4096
+)
+
+var (
+	errShortSyncMessage = errors.New("truncated sync message")
+	errSyncMAC          = errors.New("sync message failed authentication")
+)
+
+// syncMessage is a change of a flow, its devices being named.
+type syncMessage struct {
+	typ           conntrack.EventType
+	entry         conntrack.Entry
+	inDev, outDev string
+}
+
+// newSyncMAC returns the hash authenticating the messages with the key.
+func newSyncMAC(key []byte) hash.Hash {
+	return hmac.New(sha256.New, key)
+}
+
+func appendSyncMessage(b []byte, m *syncMessage, mac hash.Hash) []byte {
+	start := len(b)
+	e := &m.entry
+	var flags byte
+	if e.State == packet.CTEstablished {
+		flags |= syncEstablished
+	}
+	if e.InEndpoint.IsValid() {
+		flags |= syncEndpoint
+	}
+	if e.OutEndpoint.IsValid() {
+		flags |= syncOutEndpoint
+	}
+	b = append(b, 0, 0, syncVersion, byte(m.typ), e.Key.Proto, flags, byte(e.TCPState), e.WindowScale[0], e.WindowScale[1], 0)
+	b = append(b, e.Key.Src[:]...)
+	b = append(b, e.Key.Dst[:]...)
+	b = binary.BigEndian.AppendUint16(b, e.Key.SrcPort)
+	b = binary.BigEndian.AppendUint16(b, e.Key.DstPort)
+	for _, ep := range [...]netip.AddrPort{e.InEndpoint, e.OutEndpoint} {
+		var addr [16]byte
+		if ep.IsValid() {
+			addr = ep.Addr().As16()
+		}
+		b = append(b, addr[:]...)
+		b = binary.BigEndian.AppendUint16(b, ep.Port())
+	}
+	for _, v := range [...]uint64{e.Packets[0], e.Packets[1], e.Bytes[0], e.Bytes[1], uint64(e.Age), uint64(e.Idle)} {
+		b = binary.BigEndian.AppendUint64(b, v)
+	}
+	for _, name := range [...]string{m.inDev, m.outDev} {
+		if len(name) > 255 {
+			name = name[:255]
+		}
+		b = append(b, byte(len(name)))
+		b = append(b, name...)
+	}
+	binary.BigEndian.PutUint16(b[start:], uint16(len(b)-start-2+syncMACLen))
+	mac.Reset()
+	mac.Write(b[start:])
+	return mac.Sum(b)
+}
+
+// parseSyncMessage parses the message at the start of b, checking it was
+// authenticated with the key of the hash, and returns the bytes following
+// it.
+func parseSyncMessage(b []byte, mac hash.Hash) (syncMessage, []byte, error) {
+	var m syncMessage
+	if len(b) < 2 {
+		return m, nil, errShortSyncMessage
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n || n < syncFixedLen+2+syncMACLen {
+		return m, nil, errShortSyncMessage
+	}
+	signed, rest := b[:2+n-syncMACLen], b[2+n:]
+	msg := signed[2:]
+	if msg[0] != syncVersion {
+		return m, nil, fmt.Errorf("unsupported sync version %v", msg[0])
+	}
+	mac.Reset()
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), b[len(signed):2+n]) {
+		return m, nil, errSyncMAC
+	}
+
+	m.typ = conntrack.EventType(msg[1])
+	e := &m.entry
+	e.Key.Proto = msg[2]
+	flags := msg[3]
+	e.TCPState = conntrack.TCPState(msg[4])
+	e.WindowScale = [2]uint8{msg[5], msg[6]}
+	copy(e.Key.Src[:], msg[8:24])
+	copy(e.Key.Dst[:], msg[24:40])
+	e.Key.SrcPort = binary.BigEndian.Uint16(msg[40:42])
+	e.Key.DstPort = binary.BigEndian.Uint16(msg[42:44])
+	if flags&syncEndpoint != 0 {
+		e.InEndpoint = parseSyncEndpoint(msg[44:62])
+	}
+	if flags&syncOutEndpoint != 0 {
+		e.OutEndpoint = parseSyncEndpoint(msg[62:80])
+	}
+	var counters [6]uint64
+	for i := range counters {
+		counters[i] = binary.BigEndian.Uint64(msg[80+8*i:])
+	}
+	e.Packets = [2]uint64{counters[0], counters[1]}
+	e.Bytes = [2]uint64{counters[2], counters[3]}
+	e.Age, e.Idle = time.Duration(counters[4]), time.Duration(counters[5])
+	e.State = packet.CTNew
+	if flags&syncEstablished != 0 {
+		e.State = packet.CTEstablished
+	}
+	if err := m.check(); err != nil {
+		return m, nil, err
+	}
+
+	names := msg[syncFixedLen:]
+	for _, name := range []*string{&m.inDev, &m.outDev} {
+		if len(names) == 0 || len(names) < 1+int(names[0]) {
+			return m, nil, errShortSyncMessage
+		}
+		*name = string(names[1 : 1+names[0]])
+		names = names[1+names[0]:]
+	}
+	return m, rest, nil
+}
+
+// check rejects the messages the table could not take: unknown event types
+// and tcp states, and fields the protocol of the flow does not have. Every
+// protocol is tracked, only tcp flows having a tcp state and only tcp and
+// udp ones having ports.
+func (m *syncMessage) check() error {
+	e := &m.entry
+	switch {
+	case !m.typ.Valid():
+		return fmt.Errorf("unknown sync event type %v", byte(m.typ))
+	case !e.TCPState.Valid():
+		return fmt.Errorf("unknown sync tcp state %v", byte(e.TCPState))
+	case (e.Key.Proto == unix.IPPROTO_TCP) != (e.TCPState != conntrack.TCPNone):
+		return fmt.Errorf("sync tcp state %v for protocol %v", e.TCPState, e.Key.Proto)
+	case e.Key.Proto != unix.IPPROTO_TCP && e.Key.Proto != unix.IPPROTO_UDP && (e.Key.SrcPort != 0 || e.Key.DstPort != 0):
+		return fmt.Errorf("sync ports for protocol %v", e.Key.Proto)
+	}
+	return nil
+}
+
+func parseSyncEndpoint(b []byte) netip.AddrPort {
+	addr := netip.AddrFrom16([16]byte(b[:16])).Unmap()
+	return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(b[16:18]))
+}
+
+// syncer streams the changes of the flows tracked here to a peer and
+// applies those the peer streams, so either can take the flows of the
+// other over. Flows learnt from the peer are not streamed back until they
+// see packets here. Devices are identified by name, so both instances must
+// name them alike. Changes are only accepted from the allowed addresses,
+// authenticated with the shared key.
+type syncer struct {
+	protocol string
+	listen   string
+	peer     string
+	allow    []netip.Addr
+	interval time.Duration
+	key      []byte
+
+	table   *conntrack.ConnTable
+	devices *devs.Registry
+	// Receives the changes of the peer, one of them being set when
+	// listening.
+	packetConn net.PacketConn
+	listener   net.Listener
+}
+
+func newSyncer(conf *config.ConntrackSync) (*syncer, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	s := &syncer{protocol: conf.Protocol, listen: conf.Listen, peer: conf.Peer, interval: defaultSyncInterval, key: []byte(conf.Key)}
+	if s.protocol == "" {
+		s.protocol = config.SyncUDP
+	}
+	if s.protocol != config.SyncUDP && s.protocol != config.SyncTCP {
+		return nil, fmt.Errorf("unknown conntrack sync protocol %q", conf.Protocol)
+	}
+	if s.listen == "" && s.peer == "" {
+		return nil, fmt.Errorf("conntrack sync needs a listen or peer address")
+	}
+	if len(s.key) < config.MinSyncKeyLen {
+		return nil, fmt.Errorf("conntrack sync needs a key of at least %v bytes", config.MinSyncKeyLen)
+	}
+	if s.listen != "" {
+		var err error
+		if s.allow, err = allowedPeers(conf); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Interval != "" {
+		interval, err := time.ParseDuration(conf.Interval)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid conntrack sync interval %q", conf.Interval)
+		}
+		s.interval = interval
+	}
+	return s, nil
+}
+
+// allowedPeers returns the addresses changes are accepted from, the allowed
+// one or else those the peer host resolves to.
+func allowedPeers(conf *config.ConntrackSync) ([]netip.Addr, error) {
+	if conf.Allow != "" {
+		addr, err := netip.ParseAddr(conf.Allow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid conntrack sync allowed address %q", conf.Allow)
+		}
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	if conf.Peer == "" {
+		return nil, fmt.Errorf("conntrack sync needs an allowed address to listen without a peer")
+	}
+	host, _, err := net.SplitHostPort(conf.Peer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid conntrack sync peer %q - err: %w", conf.Peer, err)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ioTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve conntrack sync peer %q - err: %w", host, err)
+	}
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	return addrs, nil
+}
+
+// allowed reports whether changes are accepted from the address.
+func (s *syncer) allowed(from net.Addr) bool {
+	var addr netip.Addr
+	switch from := from.(type) {
+	case *net.UDPAddr:
+		addr = from.AddrPort().Addr()
+	case *net.TCPAddr:
+		addr = from.AddrPort().Addr()
+	}
+	addr = addr.Unmap()
+	for _, allow := range s.allow {
+		if addr == allow {
+			return true
+		}
+	}
+	return false
+}
+
+// open starts listening for the changes of the peer, if the syncer does,
+// which apply to the table, devices being looked up in the registry.
+func (s *syncer) open(table *conntrack.ConnTable, devices *devs.Registry) error {
+	s.table, s.devices = table, devices
+	if s.listen == "" {
+		return nil
+	}
+	var err error
+	if s.protocol == config.SyncUDP {
+		s.packetConn, err = net.ListenPacket("udp", s.listen)
+	} else {
+		s.listener, err = net.Listen("tcp", s.listen)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to listen for conntrack sync on %v - err: %w", s.listen, err)
+	}
+	return nil
+}
+
+// addr returns the address the syncer listens on, nil if it does not.
+func (s *syncer) addr() net.Addr {
+	switch {
+	case s.packetConn != nil:
+		return s.packetConn.LocalAddr()
+	case s.listener != nil:
+		return s.listener.Addr()
+	}
+	return nil
+}
+
+// start runs the goroutines sending and receiving changes until the context
+// is cancelled.
+func (s *syncer) start(ctx context.Context, wg *sync.WaitGroup) {
+	if s.peer != "" {
+		wg.Add(1)
+		go s.send(ctx, wg)
+	}
+	switch {
+	case s.packetConn != nil:
+		wg.Add(1)
+		go s.receiveDatagrams(ctx, wg)
+	case s.listener != nil:
+		wg.Add(1)
+		go s.accept(ctx, wg)
+	}
+}
+
+// closeOnDone closes c once the context is cancelled, unblocking its
+// readers, or once the returned function is called.
+func closeOnDone(ctx context.Context, c io.Closer) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// send streams the changes to the peer, connecting again after every
+// interval when the peer cannot be reached. Every flow is sent again over
+// each interval, a shard of the table at a time so the peer is not flooded.
+func (s *syncer) send(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	events, cancel := s.table.Subscribe(syncEventBuffer)
+	defer cancel()
+	pace := s.interval / conntrack.Shards
+	if pace <= 0 {
+		pace = 1
+	}
+	ticker := time.NewTicker(pace)
+	defer ticker.Stop()
+	dialer := net.Dialer{Timeout: ioTimeout}
+
+	for {
+		conn, err := dialer.DialContext(ctx, s.protocol, s.peer)
+		if err == nil {
+			logrus.Infof("Syncing conntrack to %v://%v", s.protocol, s.peer)
+			err = s.stream(ctx, conn, events, ticker.C)
+			conn.Close()
+		}
+		if ctx.Err() != nil {
+			logrus.Infof("Stopped syncing conntrack to %v", s.peer)
+			return
+		}
+		logrus.WithError(err).Warnf("Failed to sync conntrack to %v, retrying in %v", s.peer, s.interval)
+		retry := time.NewTimer(s.interval)
+		select {
+		case <-ctx.Done():
+			retry.Stop()
+			return
+		case <-retry.C:
+		}
+	}
+}
+
+// stream sends the changes of the flows to the peer, and the flows of the
+// next shard at each resync tick, until the context is cancelled or a write
+// fails. Changes queued before are dropped, the flows being sent anyway.
+func (s *syncer) stream(ctx context.Context, conn net.Conn, events <-chan conntrack.Event, resync <-chan time.Time) error {
+	w := &syncWriter{conn: conn, devices: s.devices, mac: newSyncMAC(s.key)}
+	for drained := false; !drained; {
+		select {
+		case <-events:
+		default:
+			drained = true
+		}
+	}
+
+	for shard := 0; ; {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-resync:
+			if err := s.resync(w, shard); err != nil {
+				return err
+			}
+			shard = (shard + 1) % conntrack.Shards
+		case ev := <-events:
+			// Batch the changes already queued.
+			for more := true; more; {
+				if !ev.Entry.Synced {
+					if err := w.add(ev.Type, ev.Entry); err != nil {
+						return err
+					}
+				}
+				select {
+				case ev = <-events:
+				default:
+					more = false
+				}
+			}
+			if err := w.flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// resync sends the flows of the shard tracked here, leaving out those learnt
+// from the peer.
+func (s *syncer) resync(w *syncWriter, shard int) error {
+	var err error
+	s.table.RangeShard(shard, func(e conntrack.Entry) bool {
+		if !e.Synced {
+			err = w.add(conntrack.EventUpdate, e)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+// syncWriter batches messages in writes of at most maxSyncDatagram bytes.
+type syncWriter struct {
+	conn    net.Conn
+	devices *devs.Registry
+	mac     hash.Hash
+	buf     []byte
+}
+
+func (w *syncWriter) add(typ conntrack.EventType, e conntrack.Entry) error {
+	m := syncMessage{typ: typ, entry: e, inDev: w.devices.NameOf(e.InDev), outDev: w.devices.NameOf(e.OutDev)}
+	n := len(w.buf)
+	w.buf = appendSyncMessage(w.buf, &m, w.mac)
+	if len(w.buf) <= maxSyncDatagram || n == 0 {
+		return nil
+	}
+	msg := append([]byte(nil), w.buf[n:]...)
+	w.buf = w.buf[:n]
+	if err := w.flush(); err != nil {
+		return err
+	}
+	w.buf = append(w.buf, msg...)
+	return nil
+}
+
+func (w *syncWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	if err := w.conn.SetWriteDeadline(time.Now().Add(ioTimeout)); err != nil {
+		return err
+	}
+	_, err := w.conn.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// receiveDatagrams applies the changes of the peer received over udp.
+func (s *syncer) receiveDatagrams(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer s.packetConn.Close()
+	defer closeOnDone(ctx, s.packetConn)()
+	logrus.Infof("Receiving conntrack sync on udp://%v", s.packetConn.LocalAddr())
+
+	buf := make([]byte, 1<<16)
+	mac := newSyncMAC(s.key)
+	for {
+		n, from, err := s.packetConn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				logrus.Infof("Stopped receiving conntrack sync on udp://%v", s.packetConn.LocalAddr())
+				return
+			}
+			logrus.WithError(err).Error("Failed to read conntrack sync")
+			continue
+		}
+		if !s.allowed(from) {
+			logrus.Warnf("Ignoring conntrack sync from unknown peer %v", from)
+			continue
+		}
+		for b := buf[:n]; len(b) > 0; {
+			var m syncMessage
+			if m, b, err = parseSyncMessage(b, mac); err != nil {
+				logrus.WithError(err).Warnf("Invalid conntrack sync from %v", from)
+				break
+			}
+			s.apply(&m)
+		}
+	}
+}
+
+// accept applies the changes of the peer streamed over tcp connections.
+func (s *syncer) accept(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer s.listener.Close()
+	defer closeOnDone(ctx, s.listener)()
+	logrus.Infof("Receiving conntrack sync on tcp://%v", s.listener.Addr())
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				logrus.Infof("Stopped receiving conntrack sync on tcp://%v", s.listener.Addr())
+				return
+			}
+			logrus.WithError(err).Error("Failed to accept conntrack sync connection")
+			continue
+		}
+		if !s.allowed(conn.RemoteAddr()) {
+			logrus.Warnf("Refusing conntrack sync from unknown peer %v", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		wg.Add(1)
+		go s.receiveStream(ctx, conn, wg)
+	}
+}
+
+func (s *syncer) receiveStream(ctx context.Context, conn net.Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+
+	r := bufio.NewReader(conn)
+	mac := newSyncMAC(s.key)
+	var buf []byte
+	for {
+		header, err := r.Peek(2)
+		if err == nil {
+			n := 2 + int(binary.BigEndian.Uint16(header))
+			if cap(buf) < n {
+				buf = make([]byte, n)
+			}
+			buf = buf[:n]
+			_, err = io.ReadFull(r, buf)
+		}
+		var m syncMessage
+		if err == nil {
+			m, _, err = parseSyncMessage(buf, mac)
+		}
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, io.EOF) {
+				logrus.WithError(err).Warnf("Conntrack sync from %v failed", conn.RemoteAddr())
+			}
+			return
+		}
+		s.apply(&m)
+	}
+}
+
+// apply records the change of the peer in the table. Flows through devices
+// not found here are ignored.
+func (s *syncer) apply(m *syncMessage) {
+	if m.typ == conntrack.EventDestroy {
+		s.table.Forget(m.entry.Key)
+		return
+	}
+	inDev, outDev := s.device(m.inDev), s.device(m.outDev)
+	if inDev == nil || outDev == nil {
+		if logrus.IsLevelEnabled(logrus.DebugLevel) {
+			logrus.Debugf("Ignoring synced flow %v through unknown devices %q and %q", m.entry.Key, m.inDev, m.outDev)
+		}
+		return
+	}
+	m.entry.InDev, m.entry.OutDev = inDev, outDev
+	s.table.Import(m.entry)
+}
+
+func (s *syncer) device(name string) devs.NetIO {
+	if name == "" {
+		return nil
+	}
+	index, err := s.devices.Resolve(name, "")
+	if err != nil {
+		return nil
+	}
+	return s.devices.Device(index)
+}
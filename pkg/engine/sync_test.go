@@ -0,0 +1,334 @@
+package engine
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/conntrack"
+	"github.com/mazdakn/uproxy/pkg/devs"
+	"github.com/mazdakn/uproxy/pkg/packet"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+func TestSyncMessage(t *testing.T) {
+	RegisterTestingT(t)
+	m := syncMessage{
+		typ: conntrack.EventUpdate,
+		entry: conntrack.Entry{
+			Key:         testPacket(testTCP(false, packet.TCPFlagSYN, 1000, 0)).FlowKey(),
+			InEndpoint:  netip.MustParseAddrPort("192.168.1.1:9999"),
+			OutEndpoint: netip.MustParseAddrPort("[2001:db8::1]:7777"),
+			Packets:     [2]uint64{1, 2},
+			Bytes:       [2]uint64{3, 4},
+			Age:         time.Minute,
+			Idle:        time.Second,
+			State:       packet.CTEstablished,
+			TCPState:    conntrack.TCPFinWait,
+			WindowScale: [2]uint8{7, 2},
+		},
+		inDev:  "local",
+		outDev: "tunnel",
+	}
+	other := m
+	other.typ, other.entry.InEndpoint, other.entry.OutEndpoint, other.entry.State = conntrack.EventDestroy, netip.AddrPort{}, netip.AddrPort{}, packet.CTNew
+	mac := newSyncMAC([]byte(testSyncKey))
+	b := appendSyncMessage(appendSyncMessage(nil, &m, mac), &other, mac)
+
+	parsed, rest, err := parseSyncMessage(b, mac)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(parsed).To(Equal(m))
+	parsed, rest, err = parseSyncMessage(rest, mac)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(parsed).To(Equal(other))
+	Expect(rest).To(BeEmpty())
+
+	for _, n := range []int{0, 1, 20, syncFixedLen + 2, syncFixedLen + 2 + syncMACLen, len(b)/2 - 1} {
+		_, _, err = parseSyncMessage(b[:n], mac)
+		Expect(err).To(MatchError(errShortSyncMessage), "%v bytes", n)
+	}
+
+	// Messages changed on the way or authenticated with another key are
+	// rejected.
+	_, _, err = parseSyncMessage(b, newSyncMAC([]byte("another key, long enough")))
+	Expect(err).To(MatchError(errSyncMAC))
+	for _, i := range []int{3, 50, len(b)/2 - 1} {
+		changed := append([]byte(nil), b...)
+		changed[i]++
+		_, _, err = parseSyncMessage(changed, mac)
+		Expect(err).To(MatchError(errSyncMAC), "byte %v", i)
+	}
+	b[2] = 9
+	_, _, err = parseSyncMessage(b, mac)
+	Expect(err).To(MatchError("unsupported sync version 9"))
+
+	// Messages the table could not take are rejected.
+	for msg, change := range map[string]func(*syncMessage){
+		"unknown sync event type 0":          func(m *syncMessage) { m.typ = 0 },
+		"unknown sync event type 4":          func(m *syncMessage) { m.typ = conntrack.EventDestroy + 1 },
+		"unknown sync tcp state 6":           func(m *syncMessage) { m.entry.TCPState = conntrack.TCPClosed + 1 },
+		"unknown sync tcp state 255":         func(m *syncMessage) { m.entry.TCPState = 255 },
+		"sync tcp state NONE for protocol 6": func(m *syncMessage) { m.entry.TCPState = conntrack.TCPNone },
+		"sync tcp state FIN_WAIT for protocol 17": func(m *syncMessage) {
+			m.entry.Key.Proto = unix.IPPROTO_UDP
+		},
+		"sync ports for protocol 47": func(m *syncMessage) {
+			m.entry.Key.Proto, m.entry.TCPState = unix.IPPROTO_GRE, conntrack.TCPNone
+		},
+	} {
+		bad := m
+		change(&bad)
+		_, _, err = parseSyncMessage(appendSyncMessage(nil, &bad, mac), mac)
+		Expect(err).To(MatchError(msg))
+	}
+	gre := m
+	gre.entry.Key.Proto, gre.entry.Key.SrcPort, gre.entry.Key.DstPort, gre.entry.TCPState = unix.IPPROTO_GRE, 0, 0, conntrack.TCPNone
+	parsed, _, err = parseSyncMessage(appendSyncMessage(nil, &gre, mac), mac)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(parsed).To(Equal(gre))
+}
+
+// testSyncKey is the key the sync engines share.
+const testSyncKey = "0123456789abcdef"
+
+// syncEngine returns an engine routing the flows of 10.0.0.1 from the local
+// device to the tunnel, statefully, and syncing them as configured, with
+// testSyncKey.
+func syncEngine(conf config.ConntrackSync) (*engine, uint8) {
+	conf.Key = testSyncKey
+	e := New(&config.Config{MaxBufferSize: 1600, Conntrack: &config.Conntrack{Sync: &conf}})
+	e.devices = testRegistry()
+	local := &memDevice{Queues: devs.NewQueues(queueCapacity)}
+	localIndex := e.devices.Add("local", config.DeviceTun, local)
+	policies := newPolicyTable()
+	Expect(policies.ParseConfig(&config.Config{Policies: []config.Policy{
+		{SrcAddr: "10.0.0.1/32", Action: "route=127.0.0.1:9000", Device: "tunnel", Stateful: true},
+	}}, e.devices)).To(Succeed())
+	e.storePolicies(policies)
+	Expect(e.setupConntrack()).To(Succeed())
+	Expect(e.ctSync.open(e.conntrack, e.devices)).To(Succeed())
+	return e, localIndex
+}
+
+func syncedEntries(e *engine) []ConnEntry {
+	return e.ConnEntries(conntrack.Filter{})
+}
+
+func TestSync(t *testing.T) {
+	for _, proto := range []string{config.SyncUDP, config.SyncTCP} {
+		t.Run(proto, func(t *testing.T) {
+			RegisterTestingT(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			var wg sync.WaitGroup
+			defer wg.Wait()
+			defer cancel()
+
+			standby, localIndex := syncEngine(config.ConntrackSync{Protocol: proto, Listen: "127.0.0.1:0", Allow: "127.0.0.1"})
+			active, _ := syncEngine(config.ConntrackSync{Protocol: proto, Peer: standby.ctSync.addr().String(), Interval: "50ms"})
+			standby.ctSync.start(ctx, &wg)
+			active.ctSync.start(ctx, &wg)
+			local := standby.devices.Device(localIndex)
+
+			route := func(e *engine, data []byte, index uint8) devs.NetIO {
+				pkt := testPacket(data)
+				pkt.Meta.SrcIndex = index
+				if index == 1 {
+					pkt.Meta.Origin = netip.MustParseAddrPort("127.0.0.1:9000")
+				}
+				return e.route(pkt)
+			}
+			route(active, testTCP(false, packet.TCPFlagSYN, 1000, 0), localIndex)
+			route(active, testTCP(true, packet.TCPFlagSYN|packet.TCPFlagACK, 5000, 1001), 1)
+			route(active, testTCP(false, packet.TCPFlagACK, 1001, 5001), localIndex)
+			udp := testPacket(testIPv4UDP())
+			udp.Meta.SrcIndex = localIndex
+			udp.Meta.Origin = netip.MustParseAddrPort("192.168.1.1:9999")
+			active.route(udp)
+
+			Eventually(func() []ConnEntry { return syncedEntries(standby) }).Should(ConsistOf(
+				And(
+					HaveField("Proto", "tcp"), HaveField("State", "established"), HaveField("TCPState", "ESTABLISHED"),
+					HaveField("InDev", "local"), HaveField("OutDev", "tunnel"), HaveField("Synced", true),
+				),
+				And(HaveField("Proto", "udp"), HaveField("State", "new"), HaveField("Endpoint", "192.168.1.1:9999")),
+			))
+
+			// Flows removed by the active are removed from the standby, which
+			// gets lost flows back at the next resync.
+			active.conntrack.Flush(conntrack.Filter{Proto: unix.IPPROTO_UDP})
+			Eventually(func() []ConnEntry { return syncedEntries(standby) }).Should(HaveLen(1))
+			standby.conntrack.Flush(conntrack.Filter{})
+			Eventually(func() []ConnEntry { return syncedEntries(standby) }).Should(HaveLen(1))
+
+			// The standby takes the tcp flow over, replies from the endpoint
+			// the active sent it to going back to the local device.
+			pkt := testPacket(testTCP(true, packet.TCPFlagACK, 5001, 1001))
+			pkt.Meta.SrcIndex, pkt.Meta.Origin = 1, netip.MustParseAddrPort("127.0.0.1:9001")
+			Expect(standby.route(pkt)).NotTo(BeIdenticalTo(local))
+			Expect(route(standby, testTCP(false, packet.TCPFlagACK, 1001, 5001), localIndex)).To(BeIdenticalTo(standby.devices.Device(1)))
+			Expect(route(standby, testTCP(true, packet.TCPFlagACK, 5001, 1001), 1)).To(BeIdenticalTo(local))
+			Expect(route(standby, testTCP(true, packet.TCPFlagACK, 9000, 1001), 1)).To(BeNil())
+			entries := syncedEntries(standby)
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Synced).To(BeFalse())
+
+			// Flows taken over are no longer removed by the active.
+			active.conntrack.Flush(conntrack.Filter{})
+			Consistently(func() []ConnEntry { return syncedEntries(standby) }, 200*time.Millisecond).Should(HaveLen(1))
+		})
+	}
+}
+
+func TestSyncReconnect(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	// The active keeps trying until the standby listens.
+	standby, localIndex := syncEngine(config.ConntrackSync{Protocol: config.SyncTCP, Listen: "127.0.0.1:0", Allow: "127.0.0.1"})
+	addr := standby.ctSync.addr().String()
+	Expect(standby.ctSync.listener.Close()).To(Succeed())
+	active, _ := syncEngine(config.ConntrackSync{Protocol: config.SyncTCP, Peer: addr, Interval: "20ms"})
+	active.ctSync.start(ctx, &wg)
+	pkt := testPacket(testIPv4UDP())
+	pkt.Meta.SrcIndex = localIndex
+	active.route(pkt)
+	time.Sleep(50 * time.Millisecond)
+
+	standby.ctSync.listen = addr
+	Expect(standby.ctSync.open(standby.conntrack, standby.devices)).To(Succeed())
+	standby.ctSync.start(ctx, &wg)
+	Eventually(func() []ConnEntry { return syncedEntries(standby) }).Should(HaveLen(1))
+}
+
+func TestSyncResyncPace(t *testing.T) {
+	RegisterTestingT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	active, localIndex := syncEngine(config.ConntrackSync{Peer: "127.0.0.1:9991"})
+	for port := 0; port < 256; port++ {
+		data := testIPv4UDP()
+		data[20], data[21] = byte(port>>8), byte(port)
+		pkt := testPacket(data)
+		pkt.Meta.SrcIndex = localIndex
+		active.route(pkt)
+	}
+	Expect(active.conntrack.Len()).To(Equal(256))
+	inShard := 0
+	active.conntrack.RangeShard(0, func(conntrack.Entry) bool {
+		inShard++
+		return true
+	})
+
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	defer peer.Close()
+	conn, err := net.Dial("udp", peer.LocalAddr().String())
+	Expect(err).NotTo(HaveOccurred())
+	defer conn.Close()
+	events, stop := active.conntrack.Subscribe(syncEventBuffer)
+	defer stop()
+	resync := make(chan time.Time)
+	done := make(chan error, 1)
+	go func() { done <- active.ctSync.stream(ctx, conn, events, resync) }()
+
+	received := func() int {
+		n := 0
+		buf := make([]byte, 1<<16)
+		for {
+			Expect(peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))).To(Succeed())
+			size, _, err := peer.ReadFrom(buf)
+			if err != nil {
+				return n
+			}
+			for b := buf[:size]; len(b) > 0; n++ {
+				_, b, err = parseSyncMessage(b, newSyncMAC([]byte(testSyncKey)))
+				Expect(err).NotTo(HaveOccurred())
+			}
+		}
+	}
+	// Each resync tick sends the flows of a single shard.
+	Expect(received()).To(BeZero())
+	resync <- time.Now()
+	Expect(received()).To(Equal(inShard))
+	for i := 1; i < conntrack.Shards; i++ {
+		resync <- time.Now()
+	}
+	Expect(received()).To(Equal(256 - inShard))
+	cancel()
+	Expect(<-done).To(Succeed())
+}
+
+func TestSyncUnknownPeer(t *testing.T) {
+	for _, proto := range []string{config.SyncUDP, config.SyncTCP} {
+		t.Run(proto, func(t *testing.T) {
+			RegisterTestingT(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			var wg sync.WaitGroup
+			defer wg.Wait()
+			defer cancel()
+
+			standby, _ := syncEngine(config.ConntrackSync{Protocol: proto, Listen: "127.0.0.1:0", Allow: "127.0.0.2"})
+			standby.ctSync.start(ctx, &wg)
+			m := syncMessage{
+				typ:    conntrack.EventNew,
+				entry:  conntrack.Entry{Key: testPacket(testIPv4UDP()).FlowKey()},
+				inDev:  "local",
+				outDev: "tunnel",
+			}
+			send := func(from, key string) {
+				dialer := net.Dialer{LocalAddr: &net.UDPAddr{IP: net.ParseIP(from)}}
+				if proto == config.SyncTCP {
+					dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(from)}
+				}
+				conn, err := dialer.Dial(proto, standby.ctSync.addr().String())
+				Expect(err).NotTo(HaveOccurred())
+				defer conn.Close()
+				// Refused tcp connections may fail the write.
+				conn.Write(appendSyncMessage(nil, &m, newSyncMAC([]byte(key))))
+			}
+
+			send("127.0.0.1", testSyncKey)
+			send("127.0.0.2", "fedcba9876543210")
+			Consistently(func() []ConnEntry { return syncedEntries(standby) }, 100*time.Millisecond).Should(BeEmpty())
+			send("127.0.0.2", testSyncKey)
+			Eventually(func() []ConnEntry { return syncedEntries(standby) }).Should(HaveLen(1))
+		})
+	}
+}
+
+func TestNewSyncer(t *testing.T) {
+	RegisterTestingT(t)
+	s, err := newSyncer(&config.ConntrackSync{Peer: "127.0.0.1:9991", Key: testSyncKey})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(s.protocol).To(Equal(config.SyncUDP))
+	Expect(s.interval).To(Equal(defaultSyncInterval))
+	s, err = newSyncer(&config.ConntrackSync{Listen: ":9991", Peer: "[::ffff:10.0.0.2]:9991", Key: testSyncKey})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(s.allow).To(Equal([]netip.Addr{netip.MustParseAddr("10.0.0.2")}))
+	s, err = newSyncer(&config.ConntrackSync{Listen: ":9991", Peer: "10.0.0.2:9991", Allow: "10.0.0.3", Key: testSyncKey})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(s.allow).To(Equal([]netip.Addr{netip.MustParseAddr("10.0.0.3")}))
+	for _, conf := range []config.ConntrackSync{
+		{},
+		{Listen: ":9991"},
+		{Listen: ":9991", Allow: "peer"},
+		{Protocol: "sctp", Peer: "127.0.0.1:9991"},
+		{Peer: "127.0.0.1:9991", Interval: "-1s"},
+		{Peer: "127.0.0.1:9991", Key: "short"},
+	} {
+		if conf.Key == "" {
+			conf.Key = testSyncKey
+		}
+		_, err := newSyncer(&conf)
+		Expect(err).To(HaveOccurred(), "%+v", conf)
+	}
+}
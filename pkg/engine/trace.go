@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/devs"
+	"github.com/mazdakn/uproxy/pkg/packet"
+)
+
+// TraceStep is the outcome of matching the traced packet against a policy.
+type TraceStep struct {
+	Policy  config.Policy
+	Matched bool
+	// Why the policy did not match.
+	Reason string
+}
+
+// TraceResult tells which policy a packet matches, the policies tried
+// before it and where the packet is sent.
+type TraceResult struct {
+	Packet string
+	Steps  []TraceStep
+	// Nil when neither a policy nor the default action matched.
+	Matched  *config.Policy
+	Action   Action
+	Device   string
+	Endpoint string
+}
+
+// Trace compiles the policies of the config and reports how the packet
+// described by the spec is handled. Devices are created but not started,
+// route endpoints are assumed to be up and the packet is taken as starting
+// a new flow.
+func Trace(conf *config.Config, spec packet.Spec) (*TraceResult, error) {
+	devices, table, err := compileConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	pkt := packet.New(conf.MaxBufferSize)
+	if err := pkt.Build(spec); err != nil {
+		return nil, err
+	}
+	if err := pkt.Parse(); err != nil {
+		return nil, err
+	}
+	if table.stateful {
+		pkt.Meta.CTState = packet.CTNew
+	}
+	return table.trace(pkt, devices), nil
+}
+
+// ParseTraceSpec parses the packet to trace from its command line form,
+// with the protocol and icmp match given like in policies.
+func ParseTraceSpec(src, dst, proto string, srcPort, dstPort uint, icmp string) (packet.Spec, error) {
+	var spec packet.Spec
+	var err error
+	if spec.Src, err = netip.ParseAddr(src); err != nil {
+		return spec, fmt.Errorf("invalid source address %q", src)
+	}
+	if spec.Dst, err = netip.ParseAddr(dst); err != nil {
+		return spec, fmt.Errorf("invalid destination address %q", dst)
+	}
+	if srcPort > 65535 || dstPort > 65535 {
+		return spec, fmt.Errorf("invalid ports %v and %v", srcPort, dstPort)
+	}
+	spec.SrcPort, spec.DstPort = uint16(srcPort), uint16(dstPort)
+	if spec.Proto, err = parseProto(proto); err != nil {
+		return spec, err
+	}
+	if icmp != "" {
+		m, err := parseICMP(icmp)
+		if err != nil {
+			return spec, fmt.Errorf("invalid icmp type %q - err: %w", icmp, err)
+		}
+		spec.ICMPType = m.Type
+		if m.Code > 0 {
+			spec.ICMPCode = uint8(m.Code)
+		}
+	}
+	return spec, nil
+}
+
+func (t *PolicyTable) trace(pkt *packet.Packet, devices *devs.Registry) *TraceResult {
+	result := &TraceResult{Packet: pkt.String()}
+	for _, policy := range t.all() {
+		reason := policy.explain(pkt)
+		result.Steps = append(result.Steps, TraceStep{Policy: policy.Source, Matched: reason == "", Reason: reason})
+		if reason != "" {
+			continue
+		}
+		result.Matched = &policy.Source
+		result.Action = policy.Action
+		result.Device = devices.Name(policy.Device)
+		if policy.Route != nil {
+			result.Endpoint = policy.Route.pick(pkt.FlowHash()).String()
+		}
+		break
+	}
+	return result
+}
+
+// explain returns why the policy does not match the packet, or an empty
+// string if it does. It checks the same criteria as Match.
+func (p *Policy) explain(pkt *packet.Packet) string {
+	switch {
+	case p.DstNet != nil && !p.DstNet.Contains(pkt.DstAddr()):
+		return fmt.Sprintf("destination %v not in %v", pkt.DstAddr(), p.DstNet)
+	case p.SrcNet != nil && !p.SrcNet.Contains(pkt.SrcAddr()):
+		return fmt.Sprintf("source %v not in %v", pkt.SrcAddr(), p.SrcNet)
+	case p.Proto != 0 && p.Proto != pkt.Protocol():
+		return fmt.Sprintf("protocol %v is not %v", packet.ProtoToString(pkt.Protocol()), packet.ProtoToString(p.Proto))
+	case p.DstPorts != nil && !p.DstPorts.contains(pkt.DstPort()):
+		return fmt.Sprintf("destination port %v not in %v", pkt.DstPort(), p.Source.DstPort)
+	case p.SrcPorts != nil && !p.SrcPorts.contains(pkt.SrcPort()):
+		return fmt.Sprintf("source port %v not in %v", pkt.SrcPort(), p.Source.SrcPort)
+	case p.ICMP != nil && !p.ICMP.match(pkt):
+		return fmt.Sprintf("icmp type does not match %v", p.Source.ICMP)
+	case p.DstSet != nil && !p.DstSet.match(pkt.DstAddr()):
+		return fmt.Sprintf("destination %v does not match set %v", pkt.DstAddr(), p.Source.DstSet)
+	case p.CTStates != 0 && p.CTStates&(1<<pkt.Meta.CTState) == 0:
+		return fmt.Sprintf("conntrack state %v not in %v", pkt.Meta.CTState, p.Source.CTState)
+	case p.SrcSet != nil && !p.SrcSet.match(pkt.SrcAddr()):
+		return fmt.Sprintf("source %v does not match set %v", pkt.SrcAddr(), p.Source.SrcSet)
+	}
+	return ""
+}
+
+// Write prints the trace in a human readable form.
+func (r *TraceResult) Write(w io.Writer) {
+	fmt.Fprintf(w, "packet: %v\n", r.Packet)
+	for i, step := range r.Steps {
+		if step.Matched {
+			fmt.Fprintf(w, "  #%v %v: matched\n", i, step.Policy)
+		} else {
+			fmt.Fprintf(w, "  #%v %v: %v\n", i, step.Policy, step.Reason)
+		}
+	}
+	if r.Matched == nil {
+		fmt.Fprintln(w, "no policy matched, the packet is dropped")
+		return
+	}
+	fmt.Fprintf(w, "action: %v\ndevice: %v\n", r.Action, r.Device)
+	if r.Endpoint != "" {
+		fmt.Fprintf(w, "endpoint: %v\n", r.Endpoint)
+	}
+}
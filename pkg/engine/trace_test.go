@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mazdakn/uproxy/pkg/config"
+	. "github.com/onsi/gomega"
+)
+
+func TestTrace(t *testing.T) {
+	RegisterTestingT(t)
+	conf := &config.Config{
+		MaxBufferSize: 1600,
+		Devices:       []config.Device{{Name: "tunnel", Type: config.DeviceUDP, Address: "127.0.0.1:0"}},
+		Policies: []config.Policy{
+			{DstAddr: "10.0.0.0/8", Action: "drop"},
+			{DstAddr: "1.2.3.0/24", DstPort: "tcp:80", Action: "drop"},
+			{DstAddr: "1.2.3.0/24", Proto: "tcp", Action: "route=127.0.0.1:9000,127.0.0.2:9000"},
+			{DstAddr: "0.0.0.0/0", Action: "drop"},
+		},
+	}
+	spec, err := ParseTraceSpec("10.0.0.1", "1.2.3.4", "tcp", 1234, 443, "")
+	Expect(err).NotTo(HaveOccurred())
+	result, err := Trace(conf, spec)
+	Expect(err).NotTo(HaveOccurred())
+
+	Expect(result.Steps).To(HaveLen(3))
+	Expect(result.Steps[0].Reason).To(Equal("destination 1.2.3.4 not in 10.0.0.0/8"))
+	Expect(result.Steps[1].Reason).To(Equal("destination port 443 not in tcp:80"))
+	Expect(result.Steps[2].Matched).To(BeTrue())
+	Expect(*result.Matched).To(Equal(conf.Policies[2]))
+	Expect(result.Action).To(Equal(ActionRoute))
+	Expect(result.Device).To(Equal("tunnel"))
+	Expect(result.Endpoint).To(BeElementOf("127.0.0.1:9000", "127.0.0.2:9000"))
+
+	var out bytes.Buffer
+	result.Write(&out)
+	Expect(out.String()).To(ContainSubstring("endpoint: " + result.Endpoint))
+
+	spec, err = ParseTraceSpec("fd00::1", "fd00::2", "icmpv6", 0, 0, "128")
+	Expect(err).NotTo(HaveOccurred())
+	result, err = Trace(conf, spec)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(result.Matched.Name).To(Equal(config.DefaultPolicyName))
+	Expect(result.Device).To(Equal("drop"))
+	Expect(result.Steps[0].Reason).To(Equal("destination fd00::2 not in 10.0.0.0/8"))
+
+	for _, bad := range [][]string{{"x", "1.2.3.4", "tcp", ""}, {"10.0.0.1", "1.2.3.4", "bogus", ""}, {"10.0.0.1", "1.2.3.4", "icmp", "x"}} {
+		_, err := ParseTraceSpec(bad[0], bad[1], bad[2], 0, 0, bad[3])
+		Expect(err).To(HaveOccurred(), "%v", bad)
+	}
+}
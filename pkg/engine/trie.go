@@ -0,0 +1,171 @@
+package engine
+
+import (
+	"math/bits"
+	"net"
+)
+
+// key128 is an address as a 128 bit integer. IPv4 addresses are mapped into
+// ::ffff:0:0/96 so both families share the same tries.
+type key128 struct {
+	hi, lo uint64
+}
+
+func keyFromIP(ip net.IP) key128 {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return key128{}
+	}
+	var k key128
+	for i := 0; i < 8; i++ {
+		k.hi = k.hi<<8 | uint64(ip16[i])
+		k.lo = k.lo<<8 | uint64(ip16[i+8])
+	}
+	return k
+}
+
+// prefixFromNet returns the key and prefix length of the network, nil
+// standing for the zero length prefix matching everything.
+func prefixFromNet(n *net.IPNet) (key128, int) {
+	if n == nil {
+		return key128{}, 0
+	}
+	ones, size := n.Mask.Size()
+	if size == 32 {
+		ones += 96
+	}
+	return keyFromIP(n.IP).mask(ones), ones
+}
+
+// v4Mapped is ::ffff:0:0/96, which IPv4 addresses are mapped into.
+var v4Mapped = key128{lo: 0xffff << 32}
+
+// netPrefixes calls fn with the prefixes covering the addresses of the
+// network. As with net.IPNet.Contains, IPv6 networks only hold IPv4
+// addresses when they are within ::ffff:0:0/96, so those holding all of it
+// are split into the prefixes around it.
+func netPrefixes(n *net.IPNet, fn func(key128, int)) {
+	key, l := prefixFromNet(n)
+	if _, size := n.Mask.Size(); size != 128 || l >= 96 || key != v4Mapped.mask(l) {
+		fn(key, l)
+		return
+	}
+	for i := l; i < 96; i++ {
+		fn(v4Mapped.mask(i+1).flip(i), i+1)
+	}
+}
+
+func (k key128) bit(i int) int {
+	if i < 64 {
+		return int(k.hi>>(63-i)) & 1
+	}
+	return int(k.lo>>(127-i)) & 1
+}
+
+func (k key128) flip(i int) key128 {
+	if i < 64 {
+		k.hi ^= 1 << (63 - i)
+	} else {
+		k.lo ^= 1 << (127 - i)
+	}
+	return k
+}
+
+func (k key128) mask(l int) key128 {
+	switch {
+	case l <= 0:
+		return key128{}
+	case l < 64:
+		return key128{hi: k.hi &^ (^uint64(0) >> l)}
+	case l < 128:
+		return key128{hi: k.hi, lo: k.lo &^ (^uint64(0) >> (l - 64))}
+	}
+	return k
+}
+
+func commonPrefixLen(a, b key128) int {
+	if x := a.hi ^ b.hi; x != 0 {
+		return bits.LeadingZeros64(x)
+	}
+	return 64 + bits.LeadingZeros64(a.lo^b.lo)
+}
+
+type trieNode[T any] struct {
+	key      key128
+	bits     int
+	set      bool
+	value    T
+	children [2]*trieNode[T]
+}
+
+// prefixTrie is a path compressed binary trie mapping prefixes to values.
+type prefixTrie[T any] struct {
+	root *trieNode[T]
+}
+
+// insert returns the value stored for the prefix, adding it if needed.
+func (t *prefixTrie[T]) insert(key key128, l int) *T {
+	key = key.mask(l)
+	link := &t.root
+	for {
+		n := *link
+		if n == nil {
+			n = &trieNode[T]{key: key, bits: l, set: true}
+			*link = n
+			return &n.value
+		}
+		common := commonPrefixLen(n.key, key)
+		if common > n.bits {
+			common = n.bits
+		}
+		if common > l {
+			common = l
+		}
+		if common == n.bits {
+			if l == n.bits {
+				n.set = true
+				return &n.value
+			}
+			link = &n.children[key.bit(n.bits)]
+			continue
+		}
+
+		split := &trieNode[T]{key: key.mask(common), bits: common}
+		split.children[n.key.bit(common)] = n
+		*link = split
+		if common == l {
+			split.set = true
+			return &split.value
+		}
+		leaf := &trieNode[T]{key: key, bits: l, set: true}
+		split.children[key.bit(common)] = leaf
+		return &leaf.value
+	}
+}
+
+// walk calls fn with the values of every prefix containing the key, from
+// the shortest to the longest, until fn returns false.
+func (t *prefixTrie[T]) walk(key key128, fn func(*T) bool) {
+	for n := t.root; n != nil; {
+		if n.bits > 0 && commonPrefixLen(n.key, key) < n.bits {
+			return
+		}
+		if n.set && !fn(&n.value) {
+			return
+		}
+		if n.bits == 128 {
+			return
+		}
+		n = n.children[key.bit(n.bits)]
+	}
+}
+
+// contains reports whether any prefix of the trie contains the key.
+func (t *prefixTrie[T]) contains(key key128) bool {
+	found := false
+	t.walk(key, func(*T) bool {
+		found = true
+		return false
+	})
+	return found
+}
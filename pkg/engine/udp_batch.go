@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/packet"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchConn is satisfied by both ipv4.PacketConn and ipv6.PacketConn, whose
+// messages share the same underlying type.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn *net.UDPConn) batchConn {
+	laddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if ok && laddr.IP.To4() != nil {
+		return ipv4.NewPacketConn(conn)
+	}
+	return ipv6.NewPacketConn(conn)
+}
+
+func newMessages(size int) []ipv4.Message {
+	msgs := make([]ipv4.Message, size)
+	for i := range msgs {
+		msgs[i].Buffers = make([][]byte, 1)
+	}
+	return msgs
+}
+
+func (s *udpServer) BatchSize() int {
+	return s.batchSize
+}
+
+// ReadBatch reads up to len(pkts) datagrams with a single recvmmsg call and
+// returns the number of packets filled. Each packet carries its own origin.
+func (s *udpServer) ReadBatch(pkts []*packet.Packet, deadline time.Time) (int, error) {
+	err := s.conn.SetReadDeadline(deadline)
+	if err != nil {
+		return 0, err
+	}
+	if len(pkts) > len(s.readMsgs) {
+		pkts = pkts[:len(s.readMsgs)]
+	}
+	msgs := s.readMsgs[:len(pkts)]
+	for i := range msgs {
+		msgs[i].Buffers[0] = pkts[i].Bytes
+		msgs[i].Addr = nil
+		msgs[i].N = 0
+	}
+	n, err := s.batch.ReadBatch(msgs, 0)
+	for i := 0; i < n; i++ {
+		pkts[i].Size = msgs[i].N
+		pkts[i].Meta.SrcIndex = s.index
+		if addr, ok := msgs[i].Addr.(*net.UDPAddr); ok {
+			pkts[i].Meta.Origin = addr.AddrPort()
+		}
+		msgs[i].Buffers[0] = nil
+	}
+	return n, err
+}
+
+// WriteBatch sends the packets to their endpoints with as few sendmmsg calls
+// as possible and returns the number of packets written. Packets without an
+// endpoint, or failing to be sent, are dropped without holding back the
+// others, the error reporting the last failure.
+func (s *udpServer) WriteBatch(pkts []*packet.Packet, deadline time.Time) (int, error) {
+	err := s.conn.SetWriteDeadline(deadline)
+	if err != nil {
+		return 0, err
+	}
+	if len(pkts) > len(s.writeMsgs) {
+		pkts = pkts[:len(s.writeMsgs)]
+	}
+	var lastErr error
+	dropped := 0
+	msgs := s.writeMsgs[:0]
+	for _, pkt := range pkts {
+		if pkt.Meta.Endpoint == nil {
+			lastErr = fmt.Errorf("endpoint is not set for packet %v", pkt)
+			dropped++
+			continue
+		}
+		msgs = msgs[:len(msgs)+1]
+		msgs[len(msgs)-1].Buffers[0] = pkt.Bytes
+		msgs[len(msgs)-1].Addr = pkt.Meta.Endpoint
+	}
+	defer func() {
+		for i := range msgs {
+			msgs[i].Buffers[0] = nil
+			msgs[i].Addr = nil
+		}
+	}()
+
+	written, sent := 0, 0
+	for written < len(msgs) {
+		n, err := s.batch.WriteBatch(msgs[written:], 0)
+		// n is negative when the first message failed.
+		if n < 0 {
+			n = 0
+		}
+		written += n
+		sent += n
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed) {
+			return sent, err
+		}
+		// Step past the message that failed.
+		lastErr = fmt.Errorf("failed to send to %v - err: %w", msgs[written].Addr, err)
+		written++
+		dropped++
+	}
+	if dropped > 0 {
+		return sent, fmt.Errorf("dropped %v of %v packets - err: %w", dropped, len(pkts), lastErr)
+	}
+	return sent, nil
+}
@@ -6,7 +6,9 @@ import (
 	"time"
 
 	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/devs"
 	"github.com/mazdakn/uproxy/pkg/packet"
+	"golang.org/x/net/ipv4"
 )
 
 const (
@@ -18,15 +20,27 @@ type udpServer struct {
 	conn  *net.UDPConn
 	index uint8
 
-	ingress, egress chan *packet.Packet
+	// Datagrams moved per recvmmsg/sendmmsg call, batching is disabled
+	// when it is not greater than one.
+	batchSize           int
+	batch               batchConn
+	readMsgs, writeMsgs []ipv4.Message
+
+	devs.Queues
 }
 
-func newUDPServer(conf *config.Config, index uint8) *udpServer {
+// newUDPServer returns a udp server whose queues hold at least two batches,
+// so that packets queued while a batch is written make up a full one.
+func newUDPServer(conf config.Device, index uint8) *udpServer {
+	capacity := queueCapacity
+	if 2*conf.BatchSize > capacity {
+		capacity = 2 * conf.BatchSize
+	}
 	return &udpServer{
-		addr:    conf.Address,
-		index:   index,
-		ingress: make(chan *packet.Packet, queueCapacity),
-		egress:  make(chan *packet.Packet, queueCapacity),
+		addr:      conf.Address,
+		index:     index,
+		batchSize: conf.BatchSize,
+		Queues:    devs.NewQueues(capacity),
 	}
 }
 
@@ -40,33 +54,32 @@ func (s *udpServer) Start() error {
 	if err != nil {
 		return fmt.Errorf("failed to start udp listener for %v. err: %w", addr, err)
 	}
+	if s.batchSize > 1 {
+		s.batch = newBatchConn(s.conn)
+		s.readMsgs = newMessages(s.batchSize)
+		s.writeMsgs = newMessages(s.batchSize)
+	}
 	return nil
 }
 
 func (s *udpServer) Stop() error {
-	// TODO: teardown listening socket
-	return nil
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
 }
 
 func (s *udpServer) Name() string {
 	return fmt.Sprintf("udp://%v", s.addr)
 }
 
-func (t udpServer) Ingress() chan<- *packet.Packet {
-	return t.ingress
-}
-
-func (t udpServer) Egress() <-chan *packet.Packet {
-	return t.egress
-}
-
 func (s *udpServer) Read(pkt *packet.Packet, deadline time.Time) (int, error) {
 	err := s.conn.SetReadDeadline(deadline)
 	if err != nil {
 		return 0, err
 	}
 	// TODO: check ignored udp address to verify the endpoint
-	n, addr, err := s.conn.ReadFromUDP(pkt.Bytes)
+	n, addr, err := s.conn.ReadFromUDPAddrPort(pkt.Bytes)
 	pkt.Meta.Origin = addr
 	pkt.Meta.SrcIndex = s.index
 	return n, err
@@ -0,0 +1,236 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	tcpHeaderLen  = 20
+	udpHeaderLen  = 8
+	icmpHeaderLen = 8
+	replyTTL      = 64
+
+	icmpv4Unreachable = 3
+	icmpv6Unreachable = 1
+
+	// Most of the original packet quoted by icmp errors, so replies fit in
+	// the minimum reassembly size of ipv4 and the minimum mtu of ipv6.
+	icmpv4MaxQuote = 576 - ipv4HeaderLen - icmpHeaderLen
+	icmpv6MaxQuote = 1280 - ipv6HeaderLen - icmpHeaderLen
+)
+
+// Spec describes a packet for Build. Ports are used by tcp and udp packets,
+// the icmp type and code by icmp and icmpv6 ones.
+type Spec struct {
+	Src, Dst           netip.Addr
+	Proto              byte
+	SrcPort, DstPort   uint16
+	ICMPType, ICMPCode uint8
+}
+
+// Build builds in p the packet described by the spec, with a bare transport
+// header for tcp, udp, icmp and icmpv6 and no payload.
+func (p *Packet) Build(s Spec) error {
+	src, dst := s.Src.Unmap(), s.Dst.Unmap()
+	if !src.IsValid() || !dst.IsValid() || src.Is4() != dst.Is4() {
+		return fmt.Errorf("invalid addresses %v and %v", s.Src, s.Dst)
+	}
+	l4Len := 0
+	switch s.Proto {
+	case unix.IPPROTO_TCP:
+		l4Len = tcpHeaderLen
+	case unix.IPPROTO_UDP:
+		l4Len = udpHeaderLen
+	case unix.IPPROTO_ICMP, unix.IPPROTO_ICMPV6:
+		l4Len = icmpHeaderLen
+	}
+	hdrLen := p.writeIPHeader(src.AsSlice(), dst.AsSlice(), s.Proto, l4Len)
+	b := p.Bytes[hdrLen:]
+	zero(b)
+	switch s.Proto {
+	case unix.IPPROTO_TCP:
+		binary.BigEndian.PutUint16(b[0:2], s.SrcPort)
+		binary.BigEndian.PutUint16(b[2:4], s.DstPort)
+		b[12] = (tcpHeaderLen / 4) << 4
+		sum := PseudoHeaderSum(s.Proto, p.SrcAddr(), p.DstAddr(), l4Len)
+		binary.BigEndian.PutUint16(b[16:18], Checksum(b, sum))
+	case unix.IPPROTO_UDP:
+		binary.BigEndian.PutUint16(b[0:2], s.SrcPort)
+		binary.BigEndian.PutUint16(b[2:4], s.DstPort)
+		binary.BigEndian.PutUint16(b[4:6], udpHeaderLen)
+		sum := PseudoHeaderSum(s.Proto, p.SrcAddr(), p.DstAddr(), l4Len)
+		binary.BigEndian.PutUint16(b[6:8], Checksum(b, sum))
+	case unix.IPPROTO_ICMP, unix.IPPROTO_ICMPV6:
+		b[0], b[1] = s.ICMPType, s.ICMPCode
+		var sum uint32
+		if p.ipv6 {
+			sum = PseudoHeaderSum(s.Proto, p.SrcAddr(), p.DstAddr(), l4Len)
+		}
+		binary.BigEndian.PutUint16(b[2:4], Checksum(b, sum))
+	}
+	return p.Parse()
+}
+
+// BuildReject builds in p the reply rejecting orig: a tcp reset for tcp
+// packets and a destination unreachable for others, port unreachable for
+// udp and administratively prohibited otherwise. Resets and icmp errors are
+// not answered, to avoid loops.
+func (p *Packet) BuildReject(orig *Packet) error {
+	if orig.Protocol() == unix.IPPROTO_TCP {
+		return p.BuildTCPReset(orig)
+	}
+	return p.BuildUnreachable(orig)
+}
+
+// BuildTCPReset builds in p the tcp reset answering the tcp packet orig.
+func (p *Packet) BuildTCPReset(orig *Packet) error {
+	l4 := orig.l4Offset
+	if orig.Protocol() != unix.IPPROTO_TCP || orig.fragment || len(orig.Bytes) < l4+tcpHeaderLen {
+		return fmt.Errorf("not a tcp packet: %v", orig)
+	}
+	tcp := orig.Bytes[l4:]
+	flags := tcp[13]
+	if flags&TCPFlagRST != 0 {
+		return fmt.Errorf("not answering reset %v", orig)
+	}
+
+	// RFC 9293: a segment with ACK set is reset using its ack number as
+	// sequence, others are acknowledged.
+	var seq, ack uint32
+	replyFlags := byte(TCPFlagRST)
+	if flags&TCPFlagACK != 0 {
+		seq = binary.BigEndian.Uint32(tcp[8:12])
+	} else {
+		dataOffset := int(tcp[12]>>4) * 4
+		ack = binary.BigEndian.Uint32(tcp[4:8]) + uint32(len(tcp)-dataOffset)
+		if flags&TCPFlagSYN != 0 {
+			ack++
+		}
+		if flags&TCPFlagFIN != 0 {
+			ack++
+		}
+		replyFlags |= TCPFlagACK
+	}
+
+	hdrLen := p.replyHeader(orig, unix.IPPROTO_TCP, tcpHeaderLen)
+	b := p.Bytes[hdrLen:]
+	copy(b[0:2], tcp[2:4])
+	copy(b[2:4], tcp[0:2])
+	binary.BigEndian.PutUint32(b[4:8], seq)
+	binary.BigEndian.PutUint32(b[8:12], ack)
+	b[12] = (tcpHeaderLen / 4) << 4
+	b[13] = replyFlags
+	zero(b[14:tcpHeaderLen])
+	sum := PseudoHeaderSum(unix.IPPROTO_TCP, p.SrcAddr(), p.DstAddr(), tcpHeaderLen)
+	binary.BigEndian.PutUint16(b[16:18], Checksum(b[:tcpHeaderLen], sum))
+	return p.Parse()
+}
+
+// BuildUnreachable builds in p the icmp or icmpv6 destination unreachable
+// answering orig, quoting as much of it as the reply allows.
+func (p *Packet) BuildUnreachable(orig *Packet) error {
+	if typ, _, ok := orig.ICMPTypeCode(); ok && isICMPError(orig.ipv6, typ) {
+		return fmt.Errorf("not answering icmp error %v", orig)
+	}
+	if orig.fragment {
+		return fmt.Errorf("not answering non-first fragment %v", orig)
+	}
+
+	proto, typ, code, maxQuote := byte(unix.IPPROTO_ICMP), byte(icmpv4Unreachable), byte(13), icmpv4MaxQuote
+	if orig.ipv6 {
+		proto, typ, code, maxQuote = unix.IPPROTO_ICMPV6, icmpv6Unreachable, 1, icmpv6MaxQuote
+	}
+	if orig.Protocol() == unix.IPPROTO_UDP {
+		code = 3
+		if orig.ipv6 {
+			code = 4
+		}
+	}
+	quote := orig.Bytes
+	if len(quote) > maxQuote {
+		quote = quote[:maxQuote]
+	}
+	hdrLen := ipv4HeaderLen
+	if orig.ipv6 {
+		hdrLen = ipv6HeaderLen
+	}
+	if room := cap(p.Bytes) - hdrLen - icmpHeaderLen; len(quote) > room {
+		quote = quote[:room]
+	}
+
+	hdrLen = p.replyHeader(orig, proto, icmpHeaderLen+len(quote))
+	b := p.Bytes[hdrLen:]
+	b[0], b[1] = typ, code
+	zero(b[2:icmpHeaderLen])
+	copy(b[icmpHeaderLen:], quote)
+	var sum uint32
+	if orig.ipv6 {
+		sum = PseudoHeaderSum(proto, p.SrcAddr(), p.DstAddr(), len(b))
+	}
+	binary.BigEndian.PutUint16(b[2:4], Checksum(b, sum))
+	return p.Parse()
+}
+
+// writeIPHeader resets p to an ip packet between the addresses, which are
+// both either 4 or 16 bytes long, with a payload of the given length, and
+// returns the length of the header.
+func (p *Packet) writeIPHeader(src, dst []byte, proto byte, payloadLen int) int {
+	p.ipv6 = len(src) == 16
+	p.Bytes = p.Bytes[:cap(p.Bytes)]
+	if p.ipv6 {
+		p.Size = ipv6HeaderLen + payloadLen
+		p.Bytes = p.Bytes[:p.Size]
+		b := p.Bytes
+		b[0], b[1], b[2], b[3] = 0x60, 0, 0, 0
+		binary.BigEndian.PutUint16(b[4:6], uint16(payloadLen))
+		b[6] = proto
+		b[7] = replyTTL
+		copy(b[8:24], src)
+		copy(b[24:40], dst)
+		return ipv6HeaderLen
+	}
+
+	p.Size = ipv4HeaderLen + payloadLen
+	p.Bytes = p.Bytes[:p.Size]
+	b := p.Bytes
+	b[0], b[1] = 0x45, 0
+	binary.BigEndian.PutUint16(b[2:4], uint16(p.Size))
+	zero(b[4:8])
+	b[8] = replyTTL
+	b[9] = proto
+	b[10], b[11] = 0, 0
+	copy(b[12:16], src)
+	copy(b[16:20], dst)
+	binary.BigEndian.PutUint16(b[10:12], Checksum(b[:ipv4HeaderLen], 0))
+	return ipv4HeaderLen
+}
+
+// replyHeader writes the ip header of a reply to orig, going back to its
+// source.
+func (p *Packet) replyHeader(orig *Packet, proto byte, payloadLen int) int {
+	return p.writeIPHeader(orig.DstAddr(), orig.SrcAddr(), proto, payloadLen)
+}
+
+// isICMPError reports whether the icmp or icmpv6 type is an error message.
+func isICMPError(ipv6 bool, typ uint8) bool {
+	if ipv6 {
+		return typ < 128
+	}
+	switch typ {
+	case 3, 4, 5, 11, 12:
+		return true
+	}
+	return false
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,142 @@
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+func parsed(b []byte) *Packet {
+	p := New(len(b))
+	p.Size = copy(p.Bytes, b)
+	Expect(p.Parse()).To(Succeed())
+	return p
+}
+
+// ipv4TCP returns a tcp segment from 10.0.0.1:1234 to 10.0.0.2:80 with the
+// given flags, sequence number and payload length.
+func ipv4TCP(flags byte, seq uint32, payload int) *Packet {
+	b := make([]byte, 40+payload)
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[8] = 64
+	b[9] = unix.IPPROTO_TCP
+	copy(b[12:16], net.IPv4(10, 0, 0, 1).To4())
+	copy(b[16:20], net.IPv4(10, 0, 0, 2).To4())
+	binary.BigEndian.PutUint16(b[20:22], 1234)
+	binary.BigEndian.PutUint16(b[22:24], 80)
+	binary.BigEndian.PutUint32(b[24:28], seq)
+	binary.BigEndian.PutUint32(b[28:32], 7777)
+	b[32] = 5 << 4
+	b[33] = flags
+	return parsed(b)
+}
+
+// ipv6UDP returns a udp datagram from fd00::1:1234 to fd00::2:53.
+func ipv6UDP(payload int) *Packet {
+	b := make([]byte, 48+payload)
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:6], uint16(8+payload))
+	b[6] = unix.IPPROTO_UDP
+	b[7] = 64
+	copy(b[8:24], net.ParseIP("fd00::1"))
+	copy(b[24:40], net.ParseIP("fd00::2"))
+	binary.BigEndian.PutUint16(b[40:42], 1234)
+	binary.BigEndian.PutUint16(b[42:44], 53)
+	binary.BigEndian.PutUint16(b[44:46], uint16(8+payload))
+	return parsed(b)
+}
+
+func TestBuildTCPReset(t *testing.T) {
+	RegisterTestingT(t)
+	reply := New(1600)
+	Expect(reply.BuildReject(ipv4TCP(TCPFlagSYN, 1000, 0))).To(Succeed())
+	Expect(reply.Parse()).To(Succeed())
+	Expect(reply.Len()).To(Equal(40))
+	Expect(reply.SrcAddr().String()).To(Equal("10.0.0.2"))
+	Expect(reply.DstAddr().String()).To(Equal("10.0.0.1"))
+	Expect(reply.SrcPort()).To(BeEquivalentTo(80))
+	Expect(reply.DstPort()).To(BeEquivalentTo(1234))
+	Expect(Checksum(reply.Bytes[:20], 0)).To(BeZero())
+	tcp := reply.Bytes[20:]
+	Expect(Checksum(tcp, PseudoHeaderSum(unix.IPPROTO_TCP, reply.SrcAddr(), reply.DstAddr(), len(tcp)))).To(BeZero())
+	Expect(tcp[13]).To(BeEquivalentTo(TCPFlagRST | TCPFlagACK))
+	Expect(binary.BigEndian.Uint32(tcp[4:8])).To(BeZero())
+	Expect(binary.BigEndian.Uint32(tcp[8:12])).To(BeEquivalentTo(1001))
+
+	// Segments with ack are reset with their ack number.
+	Expect(reply.BuildTCPReset(ipv4TCP(TCPFlagACK, 1000, 10))).To(Succeed())
+	Expect(reply.Bytes[33]).To(BeEquivalentTo(TCPFlagRST))
+	Expect(binary.BigEndian.Uint32(reply.Bytes[24:28])).To(BeEquivalentTo(7777))
+
+	Expect(reply.BuildReject(ipv4TCP(TCPFlagRST, 1000, 0))).NotTo(Succeed())
+}
+
+func TestBuildUnreachable(t *testing.T) {
+	RegisterTestingT(t)
+	orig := ipv6UDP(2000)
+	reply := New(1600)
+	Expect(reply.BuildReject(orig)).To(Succeed())
+	Expect(reply.Parse()).To(Succeed())
+	Expect(reply.Len()).To(Equal(1280))
+	Expect(reply.Protocol()).To(BeEquivalentTo(unix.IPPROTO_ICMPV6))
+	Expect(reply.SrcAddr().String()).To(Equal("fd00::2"))
+	Expect(reply.DstAddr().String()).To(Equal("fd00::1"))
+	typ, code, ok := reply.ICMPTypeCode()
+	Expect(ok).To(BeTrue())
+	Expect([]uint8{typ, code}).To(Equal([]uint8{1, 4}))
+	icmp := reply.Bytes[40:]
+	Expect(Checksum(icmp, PseudoHeaderSum(unix.IPPROTO_ICMPV6, reply.SrcAddr(), reply.DstAddr(), len(icmp)))).To(BeZero())
+	Expect(icmp[8:]).To(Equal(orig.Bytes[:len(icmp)-8]))
+
+	// Errors are not answered.
+	Expect(New(1600).BuildReject(reply)).NotTo(Succeed())
+
+	v4 := ipv4TCP(0, 0, 0)
+	v4.Bytes[9] = unix.IPPROTO_UDP
+	Expect(v4.Parse()).To(Succeed())
+	Expect(reply.BuildUnreachable(v4)).To(Succeed())
+	Expect(reply.Parse()).To(Succeed())
+	Expect(reply.Len()).To(Equal(20 + 8 + 40))
+	Expect(Checksum(reply.Bytes[:20], 0)).To(BeZero())
+	Expect(Checksum(reply.Bytes[20:], 0)).To(BeZero())
+	typ, code, _ = reply.ICMPTypeCode()
+	Expect([]uint8{typ, code}).To(Equal([]uint8{3, 3}))
+}
+
+func TestBuild(t *testing.T) {
+	RegisterTestingT(t)
+	p := New(1600)
+	Expect(p.Build(Spec{
+		Src:     netip.MustParseAddr("fd00::1"),
+		Dst:     netip.MustParseAddr("fd00::2"),
+		Proto:   unix.IPPROTO_TCP,
+		SrcPort: 1234,
+		DstPort: 443,
+	})).To(Succeed())
+	Expect(p.Parse()).To(Succeed())
+	Expect(p.Len()).To(Equal(60))
+	Expect(p.SrcAddr().String()).To(Equal("fd00::1"))
+	Expect(p.DstPort()).To(BeEquivalentTo(443))
+	tcp := p.Bytes[40:]
+	Expect(Checksum(tcp, PseudoHeaderSum(unix.IPPROTO_TCP, p.SrcAddr(), p.DstAddr(), len(tcp)))).To(BeZero())
+
+	Expect(p.Build(Spec{
+		Src:      netip.MustParseAddr("10.0.0.1"),
+		Dst:      netip.MustParseAddr("::ffff:10.0.0.2"),
+		Proto:    unix.IPPROTO_ICMP,
+		ICMPType: 8,
+	})).To(Succeed())
+	Expect(p.Parse()).To(Succeed())
+	Expect(p.Len()).To(Equal(28))
+	Expect(p.DstAddr().String()).To(Equal("10.0.0.2"))
+	typ, code, ok := p.ICMPTypeCode()
+	Expect(ok).To(BeTrue())
+	Expect([]uint8{typ, code}).To(Equal([]uint8{8, 0}))
+
+	Expect(p.Build(Spec{Src: netip.MustParseAddr("10.0.0.1"), Dst: netip.MustParseAddr("fd00::2")})).NotTo(Succeed())
+}
@@ -0,0 +1,50 @@
+package packet
+
+import "encoding/binary"
+
+// ChecksumSum adds b to the running one's complement sum without folding
+// it, so sums over several buffers can be chained. All but the last buffer
+// must have an even length.
+func ChecksumSum(b []byte, initial uint32) uint32 {
+	sum := uint64(initial)
+	for len(b) >= 2 {
+		sum += uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint64(b[0]) << 8
+	}
+	for sum > 0xffffffff {
+		sum = (sum >> 32) + (sum & 0xffffffff)
+	}
+	return uint32(sum)
+}
+
+// ChecksumFold folds a running sum into 16 bits without complementing it.
+func ChecksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+// Checksum returns the internet checksum of b, starting from initial.
+func Checksum(b []byte, initial uint32) uint16 {
+	return ^ChecksumFold(ChecksumSum(b, initial))
+}
+
+// PseudoHeaderSum returns the running sum of the tcp/udp pseudo header for
+// the given addresses, which are both either 4 or 16 bytes long.
+func PseudoHeaderSum(proto byte, src, dst []byte, length int) uint32 {
+	sum := ChecksumSum(src, 0)
+	sum = ChecksumSum(dst, sum)
+	sum = ChecksumSum([]byte{0, proto}, sum)
+	if len(src) == 16 {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(length))
+		return ChecksumSum(l[:], sum)
+	}
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(length))
+	return ChecksumSum(l[:], sum)
+}
@@ -0,0 +1,76 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// FlowKey identifies the flow of a packet by its protocol, addresses and,
+// for tcp and udp, ports. It is comparable, so it can key maps. IPv4
+// addresses are stored as IPv4-mapped IPv6 ones.
+type FlowKey struct {
+	Src, Dst         [16]byte
+	SrcPort, DstPort uint16
+	Proto            byte
+}
+
+// FlowKey returns the key of the flow of a parsed packet.
+func (p Packet) FlowKey() FlowKey {
+	k := FlowKey{Proto: p.proto, SrcPort: p.srcPort, DstPort: p.dstPort}
+	if p.ipv6 {
+		copy(k.Src[:], p.Bytes[8:24])
+		copy(k.Dst[:], p.Bytes[24:40])
+		return k
+	}
+	k.Src[10], k.Src[11] = 0xff, 0xff
+	k.Dst[10], k.Dst[11] = 0xff, 0xff
+	copy(k.Src[12:], p.Bytes[12:16])
+	copy(k.Dst[12:], p.Bytes[16:20])
+	return k
+}
+
+// Reverse returns the key of the packets flowing the other way.
+func (k FlowKey) Reverse() FlowKey {
+	return FlowKey{Src: k.Dst, Dst: k.Src, SrcPort: k.DstPort, DstPort: k.SrcPort, Proto: k.Proto}
+}
+
+// Hash mixes the key 64 bits at a time. It does not allocate.
+func (k FlowKey) Hash() uint32 {
+	const prime = 0x9e3779b97f4a7c15
+	h := uint64(k.Proto)<<32 | uint64(k.SrcPort)<<16 | uint64(k.DstPort)
+	for _, w := range [4]uint64{
+		binary.LittleEndian.Uint64(k.Src[:8]),
+		binary.LittleEndian.Uint64(k.Src[8:]),
+		binary.LittleEndian.Uint64(k.Dst[:8]),
+		binary.LittleEndian.Uint64(k.Dst[8:]),
+	} {
+		h = (h ^ w) * prime
+		h ^= h >> 29
+	}
+	return uint32(h ^ h>>32)
+}
+
+// SrcAddrPort returns the source address and port of the key, IPv4
+// addresses being unmapped.
+func (k FlowKey) SrcAddrPort() netip.AddrPort {
+	return netip.AddrPortFrom(netip.AddrFrom16(k.Src).Unmap(), k.SrcPort)
+}
+
+// DstAddrPort returns the destination address and port of the key.
+func (k FlowKey) DstAddrPort() netip.AddrPort {
+	return netip.AddrPortFrom(netip.AddrFrom16(k.Dst).Unmap(), k.DstPort)
+}
+
+// ProtoName returns the name of the protocol of the key, or its number for
+// protocols without one.
+func (k FlowKey) ProtoName() string {
+	if proto := ProtoToString(k.Proto); proto != "unsupported" {
+		return proto
+	}
+	return fmt.Sprintf("proto %v", k.Proto)
+}
+
+func (k FlowKey) String() string {
+	return fmt.Sprintf("%v(%v -> %v)", k.ProtoName(), k.SrcAddrPort(), k.DstAddrPort())
+}
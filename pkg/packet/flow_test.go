@@ -0,0 +1,86 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+func TestFlowKey(t *testing.T) {
+	RegisterTestingT(t)
+	p := ipv4TCP(TCPFlagSYN, 1, 0)
+	k := p.FlowKey()
+	Expect(k.String()).To(Equal("tcp(10.0.0.1:1234 -> 10.0.0.2:80)"))
+	Expect(k.Reverse().String()).To(Equal("tcp(10.0.0.2:80 -> 10.0.0.1:1234)"))
+	Expect(k.Reverse().Reverse()).To(Equal(k))
+	Expect(ipv4TCP(TCPFlagACK, 7, 10).FlowKey()).To(Equal(k))
+	Expect(p.FlowHash()).To(Equal(k.Hash()))
+	Expect(k.Reverse().Hash()).NotTo(Equal(k.Hash()))
+
+	// Replies have the reverse key.
+	reply := New(1600)
+	Expect(reply.BuildReject(p)).To(Succeed())
+	Expect(reply.FlowKey()).To(Equal(k.Reverse()))
+
+	v6 := ipv6UDP(0).FlowKey()
+	Expect(v6.String()).To(Equal("udp([fd00::1]:1234 -> [fd00::2]:53)"))
+	Expect(v6).NotTo(Equal(k))
+
+	p.Bytes[9] = unix.IPPROTO_GRE
+	Expect(p.Parse()).To(Succeed())
+	Expect(p.FlowKey().String()).To(Equal("proto 47(10.0.0.1:0 -> 10.0.0.2:0)"))
+}
+
+// tuple is the string key flows used to be looked up by.
+func tuple(p *Packet) string {
+	return fmt.Sprintf("%v(%v:%v -> %v:%v)", p.Protocol(), p.SrcAddr(), p.SrcPort(), p.DstAddr(), p.DstPort())
+}
+
+// benchmarkPackets returns udp packets of distinct flows.
+func benchmarkPackets(n int) []*Packet {
+	pkts := make([]*Packet, n)
+	for i := range pkts {
+		pkts[i] = ipv6UDP(0)
+		binary.BigEndian.PutUint16(pkts[i].Bytes[40:42], uint16(i))
+		Expect(pkts[i].Parse()).To(Succeed())
+	}
+	return pkts
+}
+
+func BenchmarkFlowLookup(b *testing.B) {
+	RegisterTestingT(b)
+	pkts := benchmarkPackets(1024)
+
+	b.Run("string", func(b *testing.B) {
+		flows := make(map[string]int, len(pkts))
+		for i, p := range pkts {
+			flows[tuple(p)] = i
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = flows[tuple(pkts[i%len(pkts)])]
+		}
+	})
+	b.Run("flowkey", func(b *testing.B) {
+		flows := make(map[FlowKey]int, len(pkts))
+		for i, p := range pkts {
+			flows[p.FlowKey()] = i
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = flows[pkts[i%len(pkts)].FlowKey()]
+		}
+	})
+}
+
+func BenchmarkFlowHash(b *testing.B) {
+	RegisterTestingT(b)
+	p := benchmarkPackets(1)[0]
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = p.FlowHash()
+	}
+}
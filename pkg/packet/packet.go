@@ -2,29 +2,39 @@ package packet
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"golang.org/x/sys/unix"
 )
 
 type Metadata struct {
 	// The followings are set when packet is read
 	SrcIndex uint8
-	Origin   *net.UDPAddr
+	Origin   netip.AddrPort
 	SrvConn  *net.UDPConn
 
 	// The following is set by policy matcher to endpoint packet should be sent
 	Endpoint *net.UDPAddr
+	// Set by conntrack when policies need it.
+	CTState CTState
 }
 
 type Packet struct {
 	Bytes []byte
 	Size  int
 	ipv6  bool
-	pkt   gopacket.Packet
+
+	// The followings are cached by Parse. l4Offset is the offset of the
+	// transport header, which fragment packets do not carry.
+	proto    byte
+	l4Offset int
+	fragment bool
+	hasPorts bool
+	srcPort  uint16
+	dstPort  uint16
 
 	Meta Metadata
 }
@@ -35,30 +45,131 @@ func New(MaxBufferSize int) *Packet {
 	}
 }
 
+// Reset restores the full buffer and clears the metadata so the packet can
+// be reused for the next read.
 func (p *Packet) Reset() {
+	p.Bytes = p.Bytes[:cap(p.Bytes)]
+	p.Size = 0
+	p.clearParsed()
 	p.Meta = Metadata{}
 }
 
+func (p *Packet) clearParsed() {
+	p.ipv6 = false
+	p.proto = 0
+	p.l4Offset = 0
+	p.fragment = false
+	p.hasPorts = false
+	p.srcPort, p.dstPort = 0, 0
+}
+
+// IPv6 extension headers walked by Parse.
+const (
+	ipv6HopByHop    = 0
+	ipv6Routing     = 43
+	ipv6Fragment    = 44
+	ipv6AuthHeader  = 51
+	ipv6DestOptions = 60
+)
+
+// Errors returned by Parse, preallocated to keep parsing allocation free.
+var (
+	errShortPacket     = errors.New("short packet")
+	errShortIPv4       = errors.New("short ipv4 packet")
+	errShortIPv6       = errors.New("short ipv6 packet")
+	errBadIPv4Header   = errors.New("invalid ipv4 header length")
+	errBadVersion      = errors.New("unknown ip version")
+	errShortExtHeaders = errors.New("truncated ipv6 extension header")
+)
+
+// Parse checks the ip header of the first Size bytes of the packet and
+// caches the transport protocol, its offset and, for tcp and udp, the ports.
+// IPv6 extension headers are skipped. Non-first fragments carry no
+// transport header and have no ports. Parse does not allocate.
 func (p *Packet) Parse() error {
 	p.Bytes = p.Bytes[:p.Size]
-	// At least 20 bytes (IPv4 header length) is needed
-	if len(p.Bytes) < 20 {
-		return fmt.Errorf("Short packet length=%v", len(p.Bytes))
+	p.clearParsed()
+	if len(p.Bytes) == 0 {
+		return errShortPacket
 	}
-	p.ipv6 = p.Version() == 6
-	if p.ipv6 && len(p.Bytes) < 40 {
-		return fmt.Errorf("Short ipv6 packet length=%v", len(p.Bytes))
+
+	switch p.Version() {
+	case 4:
+		if err := p.parseIPv4(); err != nil {
+			return err
+		}
+	case 6:
+		if err := p.parseIPv6(); err != nil {
+			return err
+		}
+	default:
+		return errBadVersion
 	}
 
-	if p.ipv6 {
-		p.pkt = gopacket.NewPacket(p.Bytes, layers.LayerTypeIPv6, gopacket.Default)
-	} else {
-		p.pkt = gopacket.NewPacket(p.Bytes, layers.LayerTypeIPv4, gopacket.Default)
+	if p.fragment || (p.proto != unix.IPPROTO_TCP && p.proto != unix.IPPROTO_UDP) {
+		return nil
 	}
+	if len(p.Bytes) >= p.l4Offset+4 {
+		p.hasPorts = true
+		p.srcPort = binary.BigEndian.Uint16(p.Bytes[p.l4Offset : p.l4Offset+2])
+		p.dstPort = binary.BigEndian.Uint16(p.Bytes[p.l4Offset+2 : p.l4Offset+4])
+	}
+	return nil
+}
 
+func (p *Packet) parseIPv4() error {
+	b := p.Bytes
+	if len(b) < ipv4HeaderLen {
+		return errShortIPv4
+	}
+	hdrLen := int(b[0]&0x0f) * 4
+	if hdrLen < ipv4HeaderLen || hdrLen > len(b) {
+		return errBadIPv4Header
+	}
+	p.proto = b[9]
+	p.l4Offset = hdrLen
+	p.fragment = binary.BigEndian.Uint16(b[6:8])&0x1fff != 0
 	return nil
 }
 
+func (p *Packet) parseIPv6() error {
+	b := p.Bytes
+	if len(b) < ipv6HeaderLen {
+		return errShortIPv6
+	}
+	p.ipv6 = true
+	next, offset := b[6], ipv6HeaderLen
+	for {
+		var hdrLen int
+		switch next {
+		case ipv6HopByHop, ipv6Routing, ipv6DestOptions:
+			if len(b) < offset+2 {
+				return errShortExtHeaders
+			}
+			hdrLen = (int(b[offset+1]) + 1) * 8
+		case ipv6AuthHeader:
+			if len(b) < offset+2 {
+				return errShortExtHeaders
+			}
+			hdrLen = (int(b[offset+1]) + 2) * 4
+		case ipv6Fragment:
+			hdrLen = 8
+			if len(b) >= offset+hdrLen && binary.BigEndian.Uint16(b[offset+2:offset+4])>>3 != 0 {
+				p.fragment = true
+			}
+		default:
+			p.proto = next
+			p.l4Offset = offset
+			return nil
+		}
+		if len(b) < offset+hdrLen {
+			return errShortExtHeaders
+		}
+		next = b[offset]
+		offset += hdrLen
+	}
+}
+
 func (p Packet) Len() int {
 	return len(p.Bytes)
 }
@@ -81,45 +192,66 @@ func (p Packet) DstAddr() net.IP {
 	return p.Bytes[16:20]
 }
 
+// Protocol returns the transport protocol, found after the extension
+// headers of ipv6 packets.
 func (p Packet) Protocol() byte {
-	if p.ipv6 {
-		return p.Bytes[6]
-	}
-	return p.Bytes[9]
+	return p.proto
 }
 
+// SrcPort returns the source port of tcp and udp packets, zero for others
+// and for fragments and truncated packets.
 func (p Packet) SrcPort() uint16 {
-	l4Offset := (p.Bytes[0] & 0x0f) * 4
-	if p.ipv6 {
-		l4Offset = 40
-	}
-	return binary.BigEndian.Uint16(p.Bytes[l4Offset : l4Offset+2])
+	return p.srcPort
 }
 
+// DstPort returns the destination port of tcp and udp packets, zero for
+// others and for fragments and truncated packets.
 func (p Packet) DstPort() uint16 {
-	l4Offset := (p.Bytes[0] & 0x0f) * 4
-	if p.ipv6 {
-		l4Offset = 40
+	return p.dstPort
+}
+
+// ICMPTypeCode returns the type and code of an icmp or icmpv6 packet, ok
+// being false for other, fragment or truncated packets.
+func (p Packet) ICMPTypeCode() (uint8, uint8, bool) {
+	if p.proto != unix.IPPROTO_ICMP && p.proto != unix.IPPROTO_ICMPV6 {
+		return 0, 0, false
 	}
-	return binary.BigEndian.Uint16(p.Bytes[l4Offset+2 : l4Offset+4])
+	if p.fragment || len(p.Bytes) < p.l4Offset+2 {
+		return 0, 0, false
+	}
+	return p.Bytes[p.l4Offset], p.Bytes[p.l4Offset+1], true
 }
 
+// Payload returns the data following the transport header, empty for
+// fragments and truncated packets.
 func (p Packet) Payload() []byte {
-	start := (p.Bytes[0]<<4)*32 + 8
-	return p.Bytes[start:] // only for ipv4 + udp
+	if p.fragment {
+		return nil
+	}
+	start := p.l4Offset
+	switch p.proto {
+	case unix.IPPROTO_UDP:
+		start += udpHeaderLen
+	case unix.IPPROTO_TCP:
+		if len(p.Bytes) < start+tcpHeaderLen {
+			return nil
+		}
+		start += int(p.Bytes[start+12]>>4) * 4
+	}
+	if start > len(p.Bytes) {
+		return nil
+	}
+	return p.Bytes[start:]
 }
 
 func (p Packet) Routed() bool {
 	return p.Meta.Endpoint != nil
 }
 
-func (p Packet) Tuple() string {
-	// TODO: find a way to make this more efficient
-	return fmt.Sprintf("%v(%v:%v -> %v:%v)",
-		p.Protocol(),
-		p.SrcAddr(), p.SrcPort(),
-		p.DstAddr(), p.DstPort(),
-	)
+// FlowHash returns the hash of the flow key of the packet. It does not
+// allocate.
+func (p Packet) FlowHash() uint32 {
+	return p.FlowKey().Hash()
 }
 
 func (p Packet) String() string {
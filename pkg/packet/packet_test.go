@@ -0,0 +1,156 @@
+package packet
+
+import (
+	"encoding/binary"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+// withExtHeaders inserts the ipv6 extension headers, given as next header
+// and length pairs, between the ipv6 header and the transport header.
+func withExtHeaders(p *Packet, headers ...[2]int) []byte {
+	b := append([]byte{}, p.Bytes[:ipv6HeaderLen]...)
+	next, proto := 6, b[6]
+	for _, h := range headers {
+		b[next] = byte(h[0])
+		ext := make([]byte, h[1])
+		switch h[0] {
+		case ipv6AuthHeader:
+			ext[1] = byte(h[1]/4 - 2)
+		case ipv6Fragment:
+		default:
+			ext[1] = byte(h[1]/8 - 1)
+		}
+		next = len(b)
+		b = append(b, ext...)
+	}
+	b[next] = proto
+	return append(b, p.Bytes[ipv6HeaderLen:]...)
+}
+
+func TestParse(t *testing.T) {
+	RegisterTestingT(t)
+	p := ipv4TCP(TCPFlagACK, 1, 10)
+	Expect(p.Protocol()).To(BeEquivalentTo(unix.IPPROTO_TCP))
+	Expect(p.SrcPort()).To(BeEquivalentTo(1234))
+	Expect(p.DstPort()).To(BeEquivalentTo(80))
+	Expect(p.Payload()).To(HaveLen(10))
+
+	// Options move the transport header.
+	b := append([]byte{}, p.Bytes[:20]...)
+	b[0] = 0x46
+	b = append(append(b, 1, 1, 1, 1), p.Bytes[20:]...)
+	p = parsed(b)
+	Expect(p.DstPort()).To(BeEquivalentTo(80))
+	Expect(p.Payload()).To(HaveLen(10))
+
+	// Non-first fragments have no transport header.
+	binary.BigEndian.PutUint16(b[6:8], 185)
+	p = parsed(b)
+	Expect(p.Protocol()).To(BeEquivalentTo(unix.IPPROTO_TCP))
+	Expect(p.SrcPort()).To(BeZero())
+	Expect(p.Payload()).To(BeEmpty())
+	Expect(p.FlowKey().String()).To(Equal("tcp(10.0.0.1:0 -> 10.0.0.2:0)"))
+
+	v6 := ipv6UDP(4)
+	Expect(v6.Payload()).To(HaveLen(4))
+	p = parsed(withExtHeaders(v6, [2]int{ipv6HopByHop, 8}, [2]int{ipv6Routing, 24}, [2]int{ipv6AuthHeader, 16}, [2]int{ipv6Fragment, 8}))
+	Expect(p.Protocol()).To(BeEquivalentTo(unix.IPPROTO_UDP))
+	Expect(p.SrcPort()).To(BeEquivalentTo(1234))
+	Expect(p.DstPort()).To(BeEquivalentTo(53))
+	Expect(p.Payload()).To(HaveLen(4))
+	Expect(p.FlowHash()).To(Equal(v6.FlowHash()))
+
+	b = withExtHeaders(v6, [2]int{ipv6DestOptions, 8}, [2]int{ipv6Fragment, 8})
+	binary.BigEndian.PutUint16(b[50:52], 1<<3)
+	p = parsed(b)
+	Expect(p.Protocol()).To(BeEquivalentTo(unix.IPPROTO_UDP))
+	Expect(p.DstPort()).To(BeZero())
+
+	// Truncated transport headers have no ports.
+	p = parsed(v6.Bytes[:42])
+	Expect(p.SrcPort()).To(BeZero())
+	Expect(p.Payload()).To(BeEmpty())
+
+	for _, bad := range [][]byte{
+		nil,
+		{0x45, 0, 0},
+		{0x00, 'u', 'p', 1},
+		append([]byte{0x4f}, make([]byte, 30)...),
+		append([]byte{0x42}, make([]byte, 30)...),
+		v6.Bytes[:39],
+		withExtHeaders(v6, [2]int{ipv6HopByHop, 8})[:44],
+	} {
+		p := New(64)
+		p.Size = copy(p.Bytes, bad)
+		Expect(p.Parse()).NotTo(Succeed(), "%v", bad)
+	}
+}
+
+func TestTCPSegment(t *testing.T) {
+	RegisterTestingT(t)
+	p := ipv4TCP(TCPFlagSYN|TCPFlagACK, 1000, 10)
+	binary.BigEndian.PutUint16(p.Bytes[34:36], 512)
+	seg, ok := p.TCPSegment()
+	Expect(ok).To(BeTrue())
+	Expect(seg).To(Equal(TCPSegment{Seq: 1000, Ack: 7777, Flags: TCPFlagSYN | TCPFlagACK, Window: 512, WScale: -1, DataLen: 10}))
+	Expect(seg.Has(TCPFlagSYN | TCPFlagACK)).To(BeTrue())
+	Expect(seg.Has(TCPFlagSYN | TCPFlagFIN)).To(BeFalse())
+
+	// Options: mss, nop and window scale, capped to 14.
+	b := append([]byte{}, p.Bytes[:40]...)
+	b[32] = 8 << 4
+	b = append(b, 2, 4, 5, 0xb4, 1, 3, 3, 15, 0, 0, 0, 0)
+	seg, ok = parsed(b).TCPSegment()
+	Expect(ok).To(BeTrue())
+	Expect(seg.WScale).To(BeEquivalentTo(14))
+	Expect(seg.DataLen).To(BeZero())
+	b[45] = 0
+	seg, _ = parsed(b).TCPSegment()
+	Expect(seg.WScale).To(BeEquivalentTo(-1))
+
+	_, ok = ipv6UDP(0).TCPSegment()
+	Expect(ok).To(BeFalse())
+	b[32] = 15 << 4
+	_, ok = parsed(b).TCPSegment()
+	Expect(ok).To(BeFalse())
+}
+
+func TestParseAllocs(t *testing.T) {
+	RegisterTestingT(t)
+	p := ipv6UDP(100)
+	b := withExtHeaders(p, [2]int{ipv6HopByHop, 8}, [2]int{ipv6Fragment, 8})
+	p.Size = copy(p.Bytes[:cap(p.Bytes)], b)
+	short := New(8)
+	short.Size = 3
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = p.Parse()
+		_ = p.FlowHash()
+		_ = short.Parse()
+	})
+	Expect(allocs).To(BeZero())
+}
+
+func FuzzParse(f *testing.F) {
+	RegisterTestingT(f)
+	f.Add(ipv4TCP(TCPFlagSYN, 1, 4).Bytes)
+	f.Add(ipv6UDP(4).Bytes)
+	f.Add(withExtHeaders(ipv6UDP(0), [2]int{ipv6HopByHop, 8}, [2]int{ipv6Fragment, 8}, [2]int{ipv6AuthHeader, 12}))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p := New(len(b))
+		p.Size = copy(p.Bytes, b)
+		if p.Parse() != nil {
+			return
+		}
+		_, _ = p.SrcPort(), p.DstPort()
+		_, _, _ = p.ICMPTypeCode()
+		_, _ = p.TCPSegment()
+		_ = p.Payload()
+		_ = p.FlowHash()
+		_ = p.FlowKey().String()
+		_ = p.String()
+		_ = New(1600).BuildReject(p)
+	})
+}
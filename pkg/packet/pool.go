@@ -0,0 +1,40 @@
+package packet
+
+import "sync"
+
+// Pool recycles packets of a fixed buffer size so the forwarding path does
+// not allocate in steady state.
+//
+// A packet has exactly one owner at a time. Get hands ownership to the
+// caller, sending a packet over a device channel hands it to the receiver,
+// and the last owner, usually the goroutine writing the packet to a device
+// or the one dropping it, returns it with Put. A packet must not be touched
+// after it has been sent on a channel or returned to the pool.
+type Pool struct {
+	size int
+	pool sync.Pool
+}
+
+func NewPool(size int) *Pool {
+	p := &Pool{size: size}
+	p.pool.New = func() any {
+		return New(size)
+	}
+	return p
+}
+
+// Get returns a reset packet with a buffer of the pool size.
+func (p *Pool) Get() *Packet {
+	pkt := p.pool.Get().(*Packet)
+	pkt.Reset()
+	return pkt
+}
+
+// Put returns the packet to the pool. Packets not allocated with the pool
+// buffer size are discarded.
+func (p *Pool) Put(pkt *Packet) {
+	if pkt == nil || cap(pkt.Bytes) != p.size {
+		return
+	}
+	p.pool.Put(pkt)
+}
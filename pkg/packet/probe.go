@@ -0,0 +1,39 @@
+package packet
+
+import "encoding/binary"
+
+// Probes are exchanged between uproxy peers over the udp tunnel to check
+// endpoints are alive. They start with a zero byte, which no ip packet does,
+// followed by a magic, the probe type and a sequence number.
+const (
+	ProbeRequest byte = 1
+	ProbeReply   byte = 2
+
+	ProbeLen = 12
+)
+
+var probeMagic = [3]byte{0, 'u', 'p'}
+
+// IsProbe reports whether the datagram is a probe rather than an ip packet.
+func IsProbe(b []byte) bool {
+	return len(b) >= ProbeLen && b[0] == probeMagic[0] && b[1] == probeMagic[1] && b[2] == probeMagic[2]
+}
+
+// ProbeType returns the type of a probe datagram.
+func ProbeType(b []byte) byte {
+	return b[3]
+}
+
+// ProbeSeq returns the sequence number of a probe datagram.
+func ProbeSeq(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b[4:ProbeLen])
+}
+
+// SetProbe turns the packet into a probe of the given type.
+func (p *Packet) SetProbe(typ byte, seq uint64) {
+	p.Bytes = p.Bytes[:ProbeLen]
+	copy(p.Bytes, probeMagic[:])
+	p.Bytes[3] = typ
+	binary.BigEndian.PutUint64(p.Bytes[4:], seq)
+	p.Size = ProbeLen
+}
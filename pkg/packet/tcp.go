@@ -0,0 +1,107 @@
+package packet
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/sys/unix"
+)
+
+// TCP flags.
+const (
+	TCPFlagFIN = 0x01
+	TCPFlagSYN = 0x02
+	TCPFlagRST = 0x04
+	TCPFlagACK = 0x10
+)
+
+const tcpOptionWScale = 3
+
+// TCPSegment holds the tcp header fields followed by conntrack.
+type TCPSegment struct {
+	Seq, Ack uint32
+	Flags    byte
+	Window   uint16
+	// Window scale option of SYN segments, negative when absent.
+	WScale  int8
+	DataLen int
+}
+
+// Has reports whether all the flags are set.
+func (s TCPSegment) Has(flags byte) bool {
+	return s.Flags&flags == flags
+}
+
+// TCPSegment returns the tcp header fields of the packet, ok being false for
+// other, fragment or truncated packets.
+func (p Packet) TCPSegment() (TCPSegment, bool) {
+	if p.proto != unix.IPPROTO_TCP || p.fragment || len(p.Bytes) < p.l4Offset+tcpHeaderLen {
+		return TCPSegment{}, false
+	}
+	b := p.Bytes[p.l4Offset:]
+	hdrLen := int(b[12]>>4) * 4
+	if hdrLen < tcpHeaderLen || hdrLen > len(b) {
+		return TCPSegment{}, false
+	}
+	s := TCPSegment{
+		Seq:     binary.BigEndian.Uint32(b[4:8]),
+		Ack:     binary.BigEndian.Uint32(b[8:12]),
+		Flags:   b[13],
+		Window:  binary.BigEndian.Uint16(b[14:16]),
+		WScale:  -1,
+		DataLen: len(b) - hdrLen,
+	}
+	if s.Flags&TCPFlagSYN != 0 {
+		s.WScale = wscaleOption(b[tcpHeaderLen:hdrLen])
+	}
+	return s, true
+}
+
+// wscaleOption returns the window scale found in the tcp options, capped to
+// 14 as RFC 7323 requires, or -1.
+func wscaleOption(opts []byte) int8 {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case 0:
+			return -1
+		case 1:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return -1
+		}
+		if opts[0] == tcpOptionWScale && opts[1] == 3 {
+			if opts[2] > 14 {
+				return 14
+			}
+			return int8(opts[2])
+		}
+		opts = opts[opts[1]:]
+	}
+	return -1
+}
+
+// CTState is the conntrack state of a packet, set before policies are
+// matched.
+type CTState uint8
+
+const (
+	// CTUntracked packets were not looked up, no policy needing it.
+	CTUntracked CTState = iota
+	// CTNew packets start a flow, or belong to one that saw no reply yet.
+	CTNew
+	// CTEstablished packets belong to a flow that saw packets both ways.
+	CTEstablished
+	// CTInvalid packets cannot start a flow or fall out of the tcp window
+	// of theirs.
+	CTInvalid
+)
+
+var ctStateNames = [...]string{"untracked", "new", "established", "invalid"}
+
+func (s CTState) String() string {
+	if int(s) < len(ctStateNames) {
+		return ctStateNames[s]
+	}
+	return "unknown"
+}
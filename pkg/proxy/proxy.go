@@ -24,6 +24,7 @@ type Proxy struct {
 	ingress chan *packet.Packet
 	//connections map[string]chan *packet.Packet
 	connections *conntrack.ConnTable
+	pool        *packet.Pool
 }
 
 func New(addr string) *Proxy {
@@ -31,6 +32,7 @@ func New(addr string) *Proxy {
 		lAddr:       addr,
 		ingress:     make(chan *packet.Packet, queueCapacity),
 		connections: conntrack.New(),
+		pool:        packet.NewPool(bufferCapacity),
 	}
 }
 
@@ -70,16 +72,18 @@ func (p *Proxy) readPackets(ctx context.Context, wg *sync.WaitGroup, deadline ti
 			logrus.WithError(err).Error("Failed to set reading deadline")
 			continue
 		}
-		pkt := packet.New(bufferCapacity)
-		n, addr, err := p.lConn.ReadFromUDP(pkt.Bytes)
+		pkt := p.pool.Get()
+		n, addr, err := p.lConn.ReadFromUDPAddrPort(pkt.Bytes)
 		if err != nil {
+			p.pool.Put(pkt)
 			nerr, ok := err.(net.Error)
 			if ok && !nerr.Timeout() {
 				logrus.WithError(err).Error("failure in reading from packet")
-				continue
 			}
+			continue
 		}
 		if n == 0 {
+			p.pool.Put(pkt)
 			logrus.Info("Received empty packet")
 			continue
 		}
@@ -109,12 +113,14 @@ func (p *Proxy) handlePackets(ctx context.Context, wg *sync.WaitGroup) {
 		for _, pkt := range pkts {
 			if err := pkt.Parse(); err != nil {
 				logrus.WithError(err).Error("Failed to parse packet")
+				p.pool.Put(pkt)
 				continue
 			}
 			logrus.Infof("Packet : %v", pkt)
 
 			if !supportedProtocols(pkt.Protocol()) {
 				logrus.Warnf("Unsupportd protocol %v", pkt.Protocol())
+				p.pool.Put(pkt)
 				continue
 			}
 
@@ -140,9 +146,8 @@ func (p *Proxy) handleClient(
 	initPkt *packet.Packet,
 	ingress *chan *packet.Packet,
 ) {
-	logrus.Infof("starting a new UDP client %v", initPkt.Tuple())
+	logrus.Infof("starting a new UDP client %v", initPkt.FlowKey())
 	defer func() {
-		// TODO: might need to lock
 		p.connections.Delete(initPkt)
 		wg.Done()
 	}()
@@ -168,13 +173,17 @@ func (p *Proxy) handleClient(
 				remoteConn, err = net.Dial(proto, remoteAddr)
 				if err != nil {
 					logrus.WithError(err).Errorf("Failed to connect to remote %v", remoteAddr)
+					p.pool.Put(pkt)
 					return
 				}
 				logrus.Infof("Connected to remote %v", remoteAddr)
 			}
 
-			payload := pkt.Payload()
-
+			_, err = remoteConn.Write(pkt.Payload())
+			if err != nil {
+				logrus.WithError(err).Errorf("Failed to write packet %v to remote", pkt)
+			}
+			p.pool.Put(pkt)
 		}
 	}
 }
@@ -0,0 +1,331 @@
+package tun
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mazdakn/uproxy/pkg/packet"
+	"golang.org/x/sys/unix"
+)
+
+// Offload flags accepted by TUNSETOFFLOAD, from linux/if_tun.h.
+const (
+	tunFCsum = 0x01
+	tunFTSO4 = 0x02
+	tunFTSO6 = 0x04
+	tunFUSO4 = 0x20
+	tunFUSO6 = 0x40
+)
+
+// Fields of struct virtio_net_hdr, from linux/virtio_net.h.
+const (
+	virtioNetHdrLen = 10
+
+	virtioNetHdrFNeedsCsum = 1
+
+	gsoNone  = 0
+	gsoTCPv4 = 1
+	gsoTCPv6 = 4
+	gsoUDPL4 = 5
+	gsoECN   = 0x80
+)
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+	tcpFlagURG = 0x20
+	tcpFlagECE = 0x40
+	tcpFlagCWR = 0x80
+
+	// Largest packet read from or written to an offloading tun device.
+	maxOffloadSize = 65535
+	// Packets a single super-packet may be split into, enough for the
+	// smallest segment size the kernel uses with the largest super-packet.
+	offloadBatchSize = 128
+)
+
+// virtioNetHdr precedes every packet read from or written to a tun device
+// created with IFF_VNET_HDR. The kernel uses the host byte order for it,
+// which is little endian on every platform we build for.
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (h *virtioNetHdr) decode(b []byte) error {
+	if len(b) < virtioNetHdrLen {
+		return fmt.Errorf("short virtio header length=%v", len(b))
+	}
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = binary.LittleEndian.Uint16(b[2:])
+	h.gsoSize = binary.LittleEndian.Uint16(b[4:])
+	h.csumStart = binary.LittleEndian.Uint16(b[6:])
+	h.csumOffset = binary.LittleEndian.Uint16(b[8:])
+	return nil
+}
+
+func (h virtioNetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.LittleEndian.PutUint16(b[2:], h.hdrLen)
+	binary.LittleEndian.PutUint16(b[4:], h.gsoSize)
+	binary.LittleEndian.PutUint16(b[6:], h.csumStart)
+	binary.LittleEndian.PutUint16(b[8:], h.csumOffset)
+}
+
+// segment splits a packet read from the tun device into packets no larger
+// than its gso size, fixing up lengths, sequence numbers and checksums, and
+// returns the number of packets filled.
+func segment(in []byte, hdr virtioNetHdr, pkts []*packet.Packet) (int, error) {
+	if len(pkts) == 0 {
+		return 0, fmt.Errorf("no packet to segment into")
+	}
+	if hdr.gsoType == gsoNone {
+		if hdr.flags&virtioNetHdrFNeedsCsum != 0 {
+			csumAt := int(hdr.csumStart) + int(hdr.csumOffset)
+			if csumAt+2 > len(in) {
+				return 0, fmt.Errorf("checksum offset %v out of packet length=%v", csumAt, len(in))
+			}
+			// The checksum field already holds the pseudo header sum.
+			sum := packet.Checksum(in[hdr.csumStart:], 0)
+			binary.BigEndian.PutUint16(in[csumAt:], sum)
+		}
+		if len(in) > len(pkts[0].Bytes) {
+			return 0, fmt.Errorf("packet length=%v exceeds buffer size %v", len(in), len(pkts[0].Bytes))
+		}
+		pkts[0].Size = copy(pkts[0].Bytes, in)
+		return 1, nil
+	}
+
+	if len(in) < 20 || hdr.gsoSize == 0 {
+		return 0, fmt.Errorf("invalid gso packet length=%v gso size=%v", len(in), hdr.gsoSize)
+	}
+	ipv6 := in[0]>>4 == 6
+	csumStart := int(hdr.csumStart)
+	var proto byte
+	var hdrLen, csumAt int
+	switch hdr.gsoType &^ gsoECN {
+	case gsoTCPv4, gsoTCPv6:
+		if csumStart+20 > len(in) {
+			return 0, fmt.Errorf("short tcp gso packet length=%v", len(in))
+		}
+		proto = unix.IPPROTO_TCP
+		hdrLen = csumStart + int(in[csumStart+12]>>4)*4
+		csumAt = csumStart + 16
+	case gsoUDPL4:
+		proto = unix.IPPROTO_UDP
+		hdrLen = csumStart + 8
+		csumAt = csumStart + 6
+	default:
+		return 0, fmt.Errorf("unsupported gso type %v", hdr.gsoType)
+	}
+	if hdrLen > len(in) {
+		return 0, fmt.Errorf("gso headers length=%v exceed packet length=%v", hdrLen, len(in))
+	}
+
+	src, dst := in[12:16], in[16:20]
+	if ipv6 {
+		if len(in) < 40 {
+			return 0, fmt.Errorf("short ipv6 gso packet length=%v", len(in))
+		}
+		src, dst = in[8:24], in[24:40]
+	}
+	firstSeq := uint32(0)
+	firstID := uint16(0)
+	if proto == unix.IPPROTO_TCP {
+		firstSeq = binary.BigEndian.Uint32(in[csumStart+4:])
+	}
+	if !ipv6 {
+		firstID = binary.BigEndian.Uint16(in[4:])
+	}
+
+	n := 0
+	gsoSize := int(hdr.gsoSize)
+	for off := hdrLen; off < len(in); off += gsoSize {
+		if n == len(pkts) {
+			return n, fmt.Errorf("gso packet length=%v needs more than %v segments", len(in), len(pkts))
+		}
+		end := off + gsoSize
+		if end > len(in) {
+			end = len(in)
+		}
+		segLen := hdrLen + end - off
+		seg := pkts[n].Bytes
+		if segLen > len(seg) {
+			return n, fmt.Errorf("segment length=%v exceeds buffer size %v", segLen, len(seg))
+		}
+		seg = seg[:segLen]
+		copy(seg, in[:hdrLen])
+		copy(seg[hdrLen:], in[off:end])
+
+		if ipv6 {
+			binary.BigEndian.PutUint16(seg[4:], uint16(segLen-40))
+		} else {
+			binary.BigEndian.PutUint16(seg[2:], uint16(segLen))
+			binary.BigEndian.PutUint16(seg[4:], firstID+uint16(n))
+			seg[10], seg[11] = 0, 0
+			binary.BigEndian.PutUint16(seg[10:], packet.Checksum(seg[:csumStart], 0))
+		}
+
+		if proto == unix.IPPROTO_TCP {
+			binary.BigEndian.PutUint32(seg[csumStart+4:], firstSeq+uint32(off-hdrLen))
+			if end != len(in) {
+				seg[csumStart+13] &^= tcpFlagFIN | tcpFlagPSH
+			}
+			if n > 0 {
+				seg[csumStart+13] &^= tcpFlagCWR
+			}
+		} else {
+			binary.BigEndian.PutUint16(seg[csumStart+4:], uint16(segLen-csumStart))
+		}
+
+		seg[csumAt], seg[csumAt+1] = 0, 0
+		sum := packet.Checksum(seg[csumStart:], packet.PseudoHeaderSum(proto, src, dst, segLen-csumStart))
+		if proto == unix.IPPROTO_UDP && sum == 0 {
+			sum = 0xffff
+		}
+		binary.BigEndian.PutUint16(seg[csumAt:], sum)
+
+		pkts[n].Size = segLen
+		n++
+	}
+	return n, nil
+}
+
+// tcpSegment returns the ip and tcp header lengths of a packet that can be
+// coalesced with others: a non fragmented tcp packet without ip options or
+// extension headers carrying payload and no flag other than ACK and PSH.
+func tcpSegment(b []byte) (int, int, bool) {
+	var iphLen int
+	switch b[0] >> 4 {
+	case 4:
+		if b[0]&0x0f != 5 || b[9] != unix.IPPROTO_TCP || binary.BigEndian.Uint16(b[6:])&0x3fff != 0 {
+			return 0, 0, false
+		}
+		iphLen = 20
+	case 6:
+		if b[6] != unix.IPPROTO_TCP {
+			return 0, 0, false
+		}
+		iphLen = 40
+	default:
+		return 0, 0, false
+	}
+	if len(b) < iphLen+20 {
+		return 0, 0, false
+	}
+	tcphLen := int(b[iphLen+12]>>4) * 4
+	if tcphLen < 20 || len(b) <= iphLen+tcphLen {
+		return 0, 0, false
+	}
+	if b[iphLen+13]&^(tcpFlagACK|tcpFlagPSH) != 0 {
+		return 0, 0, false
+	}
+	return iphLen, tcphLen, true
+}
+
+// sameFlow reports whether the candidate has the same headers as the first
+// packet of a coalesced run, ignoring the fields that differ per segment.
+func sameFlow(first, cand []byte, iphLen, tcphLen int) bool {
+	if len(cand) <= iphLen+tcphLen || cand[0] != first[0] {
+		return false
+	}
+	if iphLen == 20 {
+		if string(cand[0:2]) != string(first[0:2]) || string(cand[6:10]) != string(first[6:10]) ||
+			string(cand[12:20]) != string(first[12:20]) {
+			return false
+		}
+	} else if string(cand[0:4]) != string(first[0:4]) || string(cand[6:40]) != string(first[6:40]) {
+		return false
+	}
+	ft, ct := first[iphLen:], cand[iphLen:]
+	return string(ct[0:4]) == string(ft[0:4]) &&
+		string(ct[8:13]) == string(ft[8:13]) &&
+		ct[13]&^tcpFlagPSH == ft[13]&^tcpFlagPSH &&
+		string(ct[14:16]) == string(ft[14:16]) &&
+		string(ct[18:tcphLen]) == string(ft[18:tcphLen])
+}
+
+// coalesce writes into out a virtio header followed by the first packet
+// merged with as many of the following packets of the same tcp flow as
+// possible. It returns the bytes to write and the number of packets used.
+func coalesce(out []byte, pkts []*packet.Packet) ([]byte, int) {
+	first := pkts[0].Bytes
+	out = out[:virtioNetHdrLen]
+	for i := range out {
+		out[i] = 0
+	}
+
+	iphLen, tcphLen, ok := tcpSegment(first)
+	if !ok {
+		return append(out, first...), 1
+	}
+	hdrLen := iphLen + tcphLen
+	gsoSize := len(first) - hdrLen
+	nextSeq := binary.BigEndian.Uint32(first[iphLen+4:]) + uint32(gsoSize)
+	last := first
+
+	count := 1
+	size := len(first)
+	for ; count < len(pkts); count++ {
+		if last[iphLen+13]&tcpFlagPSH != 0 || len(last)-hdrLen < gsoSize {
+			break
+		}
+		cand := pkts[count].Bytes
+		if !sameFlow(first, cand, iphLen, tcphLen) {
+			break
+		}
+		payload := len(cand) - hdrLen
+		if payload > gsoSize || size+payload > maxOffloadSize ||
+			binary.BigEndian.Uint32(cand[iphLen+4:]) != nextSeq {
+			break
+		}
+		nextSeq += uint32(payload)
+		size += payload
+		last = cand
+	}
+	if count == 1 {
+		return append(out, first...), 1
+	}
+
+	out = append(out, first...)
+	for _, pkt := range pkts[1:count] {
+		out = append(out, pkt.Bytes[hdrLen:]...)
+	}
+	b := out[virtioNetHdrLen:]
+	b[iphLen+13] |= last[iphLen+13] & tcpFlagPSH
+
+	src, dst := b[12:16], b[16:20]
+	gsoType := uint8(gsoTCPv4)
+	if iphLen == 40 {
+		binary.BigEndian.PutUint16(b[4:], uint16(len(b)-40))
+		src, dst = b[8:24], b[24:40]
+		gsoType = gsoTCPv6
+	} else {
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+		b[10], b[11] = 0, 0
+		binary.BigEndian.PutUint16(b[10:], packet.Checksum(b[:iphLen], 0))
+	}
+	// With NEEDS_CSUM the kernel expects the pseudo header sum in place of
+	// the checksum and completes it for every segment.
+	binary.BigEndian.PutUint16(b[iphLen+16:],
+		packet.ChecksumFold(packet.PseudoHeaderSum(unix.IPPROTO_TCP, src, dst, len(b)-iphLen)))
+
+	virtioNetHdr{
+		flags:      virtioNetHdrFNeedsCsum,
+		gsoType:    gsoType,
+		hdrLen:     uint16(hdrLen),
+		gsoSize:    uint16(gsoSize),
+		csumStart:  uint16(iphLen),
+		csumOffset: 16,
+	}.encode(out)
+	return out, count
+}
@@ -0,0 +1,125 @@
+package tun
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/mazdakn/uproxy/pkg/packet"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+func superTCPv4(payload int) []byte {
+	b := make([]byte, 40+payload)
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	binary.BigEndian.PutUint16(b[4:], 100)
+	b[8] = 64
+	b[9] = unix.IPPROTO_TCP
+	copy(b[12:16], []byte{10, 0, 0, 1})
+	copy(b[16:20], []byte{10, 0, 0, 2})
+	binary.BigEndian.PutUint16(b[10:], packet.Checksum(b[:20], 0))
+
+	binary.BigEndian.PutUint16(b[20:], 40000)
+	binary.BigEndian.PutUint16(b[22:], 443)
+	binary.BigEndian.PutUint32(b[24:], 1000)
+	binary.BigEndian.PutUint32(b[28:], 2000)
+	b[32] = 5 << 4
+	b[33] = tcpFlagACK | tcpFlagPSH
+	binary.BigEndian.PutUint16(b[34:], 512)
+	for i := 40; i < len(b); i++ {
+		b[i] = byte(i)
+	}
+	binary.BigEndian.PutUint16(b[36:],
+		packet.ChecksumFold(packet.PseudoHeaderSum(unix.IPPROTO_TCP, b[12:16], b[16:20], len(b)-20)))
+	return b
+}
+
+func newPackets(count int) []*packet.Packet {
+	pkts := make([]*packet.Packet, count)
+	for i := range pkts {
+		pkts[i] = packet.New(1600)
+	}
+	return pkts
+}
+
+func TestSegmentCoalesceTCPv4(t *testing.T) {
+	RegisterTestingT(t)
+	in := superTCPv4(2500)
+	hdr := virtioNetHdr{
+		flags:      virtioNetHdrFNeedsCsum,
+		gsoType:    gsoTCPv4,
+		hdrLen:     40,
+		gsoSize:    1000,
+		csumStart:  20,
+		csumOffset: 16,
+	}
+	pkts := newPackets(offloadBatchSize)
+	n, err := segment(append([]byte(nil), in...), hdr, pkts)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(n).To(Equal(3))
+
+	for i, pkt := range pkts[:n] {
+		seg := pkt.Bytes[:pkt.Size]
+		Expect(packet.Checksum(seg[:20], 0)).To(BeZero())
+		pseudo := packet.PseudoHeaderSum(unix.IPPROTO_TCP, seg[12:16], seg[16:20], len(seg)-20)
+		Expect(packet.Checksum(seg[20:], pseudo)).To(BeZero())
+		Expect(binary.BigEndian.Uint32(seg[24:])).To(BeEquivalentTo(1000 + 1000*i))
+		Expect(binary.BigEndian.Uint16(seg[4:])).To(BeEquivalentTo(100 + i))
+		Expect(seg[33]&tcpFlagPSH != 0).To(Equal(i == n-1))
+		pkt.Bytes = seg
+	}
+	Expect(pkts[2].Size).To(Equal(540))
+
+	out, count := coalesce(make([]byte, virtioNetHdrLen+maxOffloadSize), pkts[:n])
+	Expect(count).To(Equal(3))
+	var outHdr virtioNetHdr
+	Expect(outHdr.decode(out)).To(Succeed())
+	Expect(outHdr).To(Equal(hdr))
+	Expect(out[virtioNetHdrLen:]).To(Equal(in))
+}
+
+func TestCoalesceStopsOnGap(t *testing.T) {
+	RegisterTestingT(t)
+	pkts := newPackets(offloadBatchSize)
+	hdr := virtioNetHdr{gsoType: gsoTCPv4, gsoSize: 500, csumStart: 20, csumOffset: 16}
+	n, err := segment(superTCPv4(1500), hdr, pkts)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(n).To(Equal(3))
+	for _, pkt := range pkts[:n] {
+		pkt.Bytes = pkt.Bytes[:pkt.Size]
+	}
+
+	pkts[0], pkts[1] = pkts[1], pkts[0]
+	out, count := coalesce(make([]byte, virtioNetHdrLen+maxOffloadSize), pkts[:n])
+	Expect(count).To(Equal(1))
+	Expect(out[1]).To(BeEquivalentTo(gsoNone))
+	Expect(out[virtioNetHdrLen:]).To(Equal(pkts[0].Bytes))
+}
+
+func TestSegmentUDPv6(t *testing.T) {
+	RegisterTestingT(t)
+	b := make([]byte, 48+300)
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:], uint16(len(b)-40))
+	b[6] = unix.IPPROTO_UDP
+	b[7] = 64
+	b[23], b[39] = 1, 2
+	binary.BigEndian.PutUint16(b[40:], 5000)
+	binary.BigEndian.PutUint16(b[42:], 53)
+	binary.BigEndian.PutUint16(b[44:], uint16(len(b)-40))
+
+	hdr := virtioNetHdr{gsoType: gsoUDPL4, gsoSize: 100, csumStart: 40, csumOffset: 6}
+	pkts := newPackets(offloadBatchSize)
+	n, err := segment(b, hdr, pkts)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(n).To(Equal(3))
+	for _, pkt := range pkts[:n] {
+		seg := pkt.Bytes[:pkt.Size]
+		Expect(seg).To(HaveLen(148))
+		Expect(binary.BigEndian.Uint16(seg[4:])).To(BeEquivalentTo(108))
+		Expect(binary.BigEndian.Uint16(seg[44:])).To(BeEquivalentTo(108))
+		pseudo := packet.PseudoHeaderSum(unix.IPPROTO_UDP, seg[8:24], seg[24:40], 108)
+		Expect(packet.Checksum(seg[40:], pseudo)).To(BeZero())
+	}
+}
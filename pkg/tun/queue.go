@@ -0,0 +1,143 @@
+package tun
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mazdakn/uproxy/pkg/devs"
+	"github.com/mazdakn/uproxy/pkg/packet"
+)
+
+// Queue is a single queue of a multi-queue tun device, backed by its own
+// file descriptor.
+type Queue struct {
+	tun  *TunDevice
+	id   int
+	file *os.File
+
+	// Buffers holding packets with their virtio header when offloads are
+	// enabled on the device.
+	readBuf, writeBuf []byte
+
+	devs.Queues
+}
+
+func newQueue(t *TunDevice, id int) *Queue {
+	q := &Queue{
+		tun:    t,
+		id:     id,
+		Queues: devs.NewQueues(queueCapacity),
+	}
+	if t.offload {
+		q.readBuf = make([]byte, virtioNetHdrLen+maxOffloadSize)
+		q.writeBuf = make([]byte, virtioNetHdrLen+maxOffloadSize)
+	}
+	return q
+}
+
+// Queues are started and stopped along with their tun device.
+func (q *Queue) Start() error {
+	return nil
+}
+
+func (q *Queue) Stop() error {
+	return nil
+}
+
+func (q *Queue) Name() string {
+	return fmt.Sprintf("tun://%v/%v", q.tun.name, q.id)
+}
+
+func (q *Queue) BatchSize() int {
+	if q.tun.offload {
+		return offloadBatchSize
+	}
+	return 1
+}
+
+func (q *Queue) Read(pkt *packet.Packet, deadline time.Time) (int, error) {
+	if q.tun.offload {
+		pkts := [1]*packet.Packet{pkt}
+		_, err := q.ReadBatch(pkts[:], deadline)
+		return pkt.Size, err
+	}
+	err := q.file.SetReadDeadline(deadline)
+	if err != nil {
+		return 0, err
+	}
+
+	pkt.Meta.SrcIndex = q.tun.index
+	return q.file.Read(pkt.Bytes)
+}
+
+// ReadBatch reads a single packet from the queue and, when offloads are
+// enabled, splits it into as many segments as its gso size requires.
+func (q *Queue) ReadBatch(pkts []*packet.Packet, deadline time.Time) (int, error) {
+	if !q.tun.offload {
+		n, err := q.Read(pkts[0], deadline)
+		if err != nil {
+			return 0, err
+		}
+		pkts[0].Size = n
+		return 1, nil
+	}
+	err := q.file.SetReadDeadline(deadline)
+	if err != nil {
+		return 0, err
+	}
+	n, err := q.file.Read(q.readBuf)
+	if err != nil {
+		return 0, err
+	}
+
+	var hdr virtioNetHdr
+	if err := hdr.decode(q.readBuf[:n]); err != nil {
+		return 0, err
+	}
+	count, err := segment(q.readBuf[virtioNetHdrLen:n], hdr, pkts)
+	for i := 0; i < count; i++ {
+		pkts[i].Meta.SrcIndex = q.tun.index
+	}
+	return count, err
+}
+
+func (q *Queue) Write(pkt *packet.Packet, deadline time.Time) (int, error) {
+	if q.tun.offload {
+		pkts := [1]*packet.Packet{pkt}
+		_, err := q.WriteBatch(pkts[:], deadline)
+		return pkt.Len(), err
+	}
+	err := q.file.SetWriteDeadline(deadline)
+	if err != nil {
+		return 0, err
+	}
+	return q.file.Write(pkt.Bytes)
+}
+
+// WriteBatch writes the packets to the queue. When offloads are enabled,
+// consecutive segments of a tcp flow are coalesced and handed to the kernel
+// as a single packet.
+func (q *Queue) WriteBatch(pkts []*packet.Packet, deadline time.Time) (int, error) {
+	if !q.tun.offload {
+		for i, pkt := range pkts {
+			if _, err := q.Write(pkt, deadline); err != nil {
+				return i, err
+			}
+		}
+		return len(pkts), nil
+	}
+	err := q.file.SetWriteDeadline(deadline)
+	if err != nil {
+		return 0, err
+	}
+	written := 0
+	for written < len(pkts) {
+		out, count := coalesce(q.writeBuf, pkts[written:])
+		if _, err := q.file.Write(out); err != nil {
+			return written, err
+		}
+		written += count
+	}
+	return written, nil
+}
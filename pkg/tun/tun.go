@@ -2,13 +2,13 @@ package tun
 
 import (
 	"fmt"
-	"os"
-	"time"
 
 	"github.com/mazdakn/uproxy/pkg/config"
+	"github.com/mazdakn/uproxy/pkg/devs"
 	"github.com/mazdakn/uproxy/pkg/packet"
 	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -16,28 +16,38 @@ const (
 )
 
 type TunDevice struct {
-	name    string
-	file    *os.File
-	mtu     int
-	address string
-	dev     *netlink.Tuntap
-	index   uint8
-
-	ingress, egress chan *packet.Packet
+	name      string
+	mtu       int
+	address   string
+	numQueues int
+	offload   bool
+	queues    []*Queue
+	dev       *netlink.Tuntap
+	index     uint8
 }
 
-func New(conf *config.Config, index uint8) *TunDevice {
-	if conf.Tun == nil {
+func New(conf *config.TunConfig, index uint8, opts ...Option) *TunDevice {
+	if conf == nil {
 		return nil
 	}
-	return &TunDevice{
-		name:    conf.Tun.Name,
-		mtu:     conf.Tun.MTU,
-		address: conf.Tun.Address,
-		index:   index,
-		ingress: make(chan *packet.Packet, queueCapacity),
-		egress:  make(chan *packet.Packet, queueCapacity),
+	t := &TunDevice{
+		name:      conf.Name,
+		mtu:       conf.MTU,
+		address:   conf.Address,
+		numQueues: conf.Queues,
+		offload:   conf.Offload,
+		index:     index,
 	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.numQueues < 1 {
+		t.numQueues = 1
+	}
+	for i := 0; i < t.numQueues; i++ {
+		t.queues = append(t.queues, newQueue(t, i))
+	}
+	return t
 }
 
 func (t *TunDevice) Start() error {
@@ -51,16 +61,21 @@ func (t *TunDevice) create() error {
 	if t.name == "" {
 		return fmt.Errorf("tun device not configured")
 	}
-	logrus.Infof("Creating tun device %v (address: %v, mtu: %v)", t.name, t.address, t.mtu)
+	logrus.Infof("Creating tun device %v (address: %v, mtu: %v, queues: %v, offload: %v)",
+		t.name, t.address, t.mtu, t.numQueues, t.offload)
 
 	la := netlink.NewLinkAttrs()
 	la.Name = t.name
 	la.MTU = t.mtu
+	flags := netlink.TUNTAP_NO_PI | netlink.TUNTAP_MULTI_QUEUE_DEFAULTS
+	if t.offload {
+		flags |= netlink.TUNTAP_VNET_HDR
+	}
 	tunDev := &netlink.Tuntap{
 		LinkAttrs: la,
 		Mode:      netlink.TUNTAP_MODE_TUN,
-		Flags:     netlink.TUNTAP_NO_PI | netlink.TUNTAP_MULTI_QUEUE_DEFAULTS,
-		Queues:    1,
+		Flags:     flags,
+		Queues:    t.numQueues,
 	}
 	err := netlink.LinkAdd(tunDev)
 	if err != nil {
@@ -87,18 +102,55 @@ func (t *TunDevice) create() error {
 		return fmt.Errorf("failed to set tun device up - err: %w", err)
 	}
 
-	if len(tunDev.Fds) == 0 {
-		return fmt.Errorf("no valid queue available for tun device")
+	if len(tunDev.Fds) != t.numQueues {
+		return fmt.Errorf("tun device has %v queues, expected %v", len(tunDev.Fds), t.numQueues)
 	}
 	t.dev = tunDev
-	t.file = tunDev.Fds[0]
+	for i, q := range t.queues {
+		q.file = tunDev.Fds[i]
+	}
+	if t.offload {
+		if err := t.setOffload(); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+// setOffload enables checksum and segmentation offloads on every queue, so
+// the kernel hands over tcp and udp super-packets. UDP segmentation needs
+// linux 6.2, older kernels fall back to tcp only.
+func (t *TunDevice) setOffload() error {
+	full := tunFCsum | tunFTSO4 | tunFTSO6 | tunFUSO4 | tunFUSO6
+	for _, q := range t.queues {
+		conn, err := q.file.SyscallConn()
+		if err != nil {
+			return fmt.Errorf("failed to access tun queue %v - err: %w", q.Name(), err)
+		}
+		var ioctlErr error
+		err = conn.Control(func(fd uintptr) {
+			ioctlErr = unix.IoctlSetInt(int(fd), unix.TUNSETOFFLOAD, full)
+			if ioctlErr != nil {
+				ioctlErr = unix.IoctlSetInt(int(fd), unix.TUNSETOFFLOAD, tunFCsum|tunFTSO4|tunFTSO6)
+			}
+		})
+		if err == nil {
+			err = ioctlErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set offloads on tun queue %v - err: %w", q.Name(), err)
+		}
+	}
+	return nil
+}
+
 func (t TunDevice) Stop() error {
-	if t.file != nil {
-		err := t.file.Close()
+	for _, q := range t.queues {
+		if q.file == nil {
+			continue
+		}
+		err := q.file.Close()
 		if err != nil {
 			return err
 		}
@@ -118,28 +170,20 @@ func (t *TunDevice) Name() string {
 	return fmt.Sprintf("tun://%v", t.name)
 }
 
+// Ingress and Egress of the device are those of its first queue. The engine
+// runs every queue separately and steers packets to them by flow hash.
 func (t TunDevice) Ingress() chan<- *packet.Packet {
-	return t.ingress
+	return t.queues[0].Ingress()
 }
 
 func (t TunDevice) Egress() <-chan *packet.Packet {
-	return t.egress
+	return t.queues[0].Egress()
 }
 
-func (t TunDevice) Read(pkt *packet.Packet, deadline time.Time) (int, error) {
-	err := t.file.SetReadDeadline(deadline)
-	if err != nil {
-		return 0, err
-	}
-
-	pkt.Meta.SrcIndex = t.index
-	return t.file.Read(pkt.Bytes)
+func (t TunDevice) NumQueues() int {
+	return len(t.queues)
 }
 
-func (t TunDevice) Write(pkt *packet.Packet, deadline time.Time) (int, error) {
-	err := t.file.SetWriteDeadline(deadline)
-	if err != nil {
-		return 0, err
-	}
-	return t.file.Write(pkt.Bytes)
+func (t TunDevice) Queue(i int) devs.NetIO {
+	return t.queues[i]
 }